@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+// Returns path relative to the source and target roots. path is either absolute, in source_dir or
+// target_dir, or already relative to them.
+func relativePath(cfg *config.Config, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return filepath.Clean(path), nil
+	}
+
+	for _, root := range []string{cfg.SourceDir, cfg.TargetDir} {
+		if relPath, err := filepath.Rel(root, path); err == nil && filepath.IsLocal(relPath) {
+			return relPath, nil
+		}
+	}
+	return "", fmt.Errorf("%s is neither in %s nor in %s", path, cfg.SourceDir, cfg.TargetDir)
+}
+
+// runExplain prints the score of a file, the contribution of each of its factors and whether it is
+// admitted to the target or would be evicted
+func runExplain(args []string) {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the explanation as JSON")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: filo explain [-json] <path>")
+		os.Exit(2)
+	}
+
+	if *asJSON {
+		// keep stdout clean for the JSON document
+		config.SetLogOutput(Cfg, os.Stderr)
+	}
+
+	relPath, err := relativePath(Cfg, flags.Arg(0))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	targetTree, err := fs.BuildTree(Cfg.TargetDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	evictor, _, err := newEvictor(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	evictor.Prioritize(srcTree)
+
+	explanation, err := evictor.Explain(srcTree, targetTree, relPath, maxFileSemaphore)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if !*asJSON {
+		explanation.WriteText(os.Stdout)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(explanation); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// ParseAge parses a duration like time.ParseDuration, with "d" accepted for days
+// so retention ages can be written as "7d" or "1d12h". Negative ages are an error.
+func ParseAge(s string) (time.Duration, error) {
+	trimmed := strings.TrimSpace(s)
+	// A sign on any component, so "-1d30h" isn't read as 6h
+	if strings.Contains(trimmed, "-") {
+		return 0, fmt.Errorf("invalid age '%s': negative", s)
+	}
+
+	days, rest, found := strings.Cut(trimmed, "d")
+	if !found {
+		return time.ParseDuration(trimmed)
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age '%s': %w", s, err)
+	}
+
+	age := time.Duration(n) * 24 * time.Hour
+	if rest != "" {
+		extra, err := time.ParseDuration(rest)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age '%s': %w", s, err)
+		}
+		age += extra
+	}
+
+	return age, nil
+}
+
+// Decodes strings into time.Duration with ParseAge
+func stringToAgeHookFunc() mapstructure.DecodeHookFuncType {
+	return func(from reflect.Type, to reflect.Type, data any) (any, error) {
+		if from.Kind() != reflect.String || to != reflect.TypeFor[time.Duration]() {
+			return data, nil
+		}
+
+		return ParseAge(data.(string))
+	}
+}
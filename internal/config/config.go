@@ -5,25 +5,112 @@ import (
 	"io"
 	"log"
 	"log/slog"
+	"math"
 	"os"
 	"slices"
 	"time"
 
+	"github.com/go-viper/mapstructure/v2"
 	"github.com/lmittmann/tint"
 	"github.com/spf13/viper"
 )
 
 // in-memory representation of the config.toml file.
 
+// RetentionRule drops the files matching Path from the target once their source mtime is older than MaxAge
+type RetentionRule struct {
+	Path   string        `mapstructure:"path" toml:"path"`
+	MaxAge time.Duration `mapstructure:"max_age" toml:"max_age"`
+}
+
+// JellyfinConfig is the Jellyfin server filo reads watch history from, disabled when URL and Database are
+// empty. Watch history is read from Database rather than the API when it is set.
+type JellyfinConfig struct {
+	URL               string   `mapstructure:"url" toml:"url"`
+	APIKey            string   `mapstructure:"api_key" toml:"api_key"`
+	Users             []string `mapstructure:"users" toml:"users"`                           // user names to read, every user when empty
+	Refresh           bool     `mapstructure:"refresh" toml:"refresh"`                       // rescan the library folders filo changes on the target
+	Database          string   `mapstructure:"database" toml:"database"`                     // library.db, read-only
+	PlaybackReporting string   `mapstructure:"playback_reporting" toml:"playback_reporting"` // playback_reporting.db, optional
+	Collections       []string `mapstructure:"collections" toml:"collections"`               // collections and playlists whose items are pinned
+}
+
+// PlexConfig is the Plex Media Server filo reads watch history from, disabled when URL and Database are
+// empty. Watch history is read from Database rather than the API when it is set.
+type PlexConfig struct {
+	URL         string   `mapstructure:"url" toml:"url"`
+	Token       string   `mapstructure:"token" toml:"token"`
+	Refresh     bool     `mapstructure:"refresh" toml:"refresh"`         // rescan the library folders filo changes on the target
+	Database    string   `mapstructure:"database" toml:"database"`       // com.plexapp.plugins.library.db, read-only
+	Collections []string `mapstructure:"collections" toml:"collections"` // collections and playlists whose items are pinned
+}
+
+// PathMapping rewrites paths between a media server and filo. Server is a directory as the media server
+// sees it, Local is the same directory as filo sees it.
+type PathMapping struct {
+	Server string `mapstructure:"server" toml:"server"`
+	Local  string `mapstructure:"local" toml:"local"`
+}
+
+// WebhookConfig is the HTTP listener receiving media server and Sonarr/Radarr webhooks, disabled when
+// Listen is empty
+type WebhookConfig struct {
+	Listen string `mapstructure:"listen" toml:"listen"` // address to listen on, i.e ":8095"
+	Token  string `mapstructure:"token" toml:"token"`   // required in the token query parameter when set
+}
+
+// Allowance caps the bytes of the target the in-progress, next up and favorite items of a media server
+// user are admitted with. User is server/name, i.e jellyfin/bebop831, or a bare name for the user of that
+// name on every server. The smaller of Share and MaxBytes applies when both are set.
+type Allowance struct {
+	User     string   `mapstructure:"user" toml:"user"`
+	Share    float64  `mapstructure:"share" toml:"share"`         // fraction of the target budget, 0 for none
+	MaxBytes ByteSize `mapstructure:"max_bytes" toml:"max_bytes"` // 0 for none
+}
+
+// ScoreWeights weigh the factors of the composite score that ranks files with eviction_policy = "score",
+// see fs.Scorer. Negative weights count against a file.
+type ScoreWeights struct {
+	Recency    float64 `mapstructure:"recency" toml:"recency"`         // 1 when watched or its target copy accessed just now, halving every week
+	Pinned     float64 `mapstructure:"pinned" toml:"pinned"`           // 1 for pinned files
+	Favorite   float64 `mapstructure:"favorite" toml:"favorite"`       // 1 for media server favorites and watchlist items
+	WatchCount float64 `mapstructure:"watch_count" toml:"watch_count"` // per play, across every user
+	Size       float64 `mapstructure:"size" toml:"size"`               // per GiB
+	Age        float64 `mapstructure:"age" toml:"age"`                 // per day since the source mtime
+	Rank       float64 `mapstructure:"rank" toml:"rank"`               // per 100 of media server priority, i.e 3 for next up
+}
+
 type Config struct {
-	SourceDir          string        `mapstructure:"source_dir"`
-	TargetDir          string        `mapstructure:"target_dir"`
-	MaxFill            float64       `mapstructure:"max_fill"`
-	LogLevel           string        `mapstructure:"log_level"`
-	SyncDelay          time.Duration `mapstructure:"sync_delay"`
-	ApprovedExtensions []string      `mapstructure:"approved_extensions"`
-	LogFile            string        `mapstructure:"log_file"`
-	MaxOpenFile        int           `mapstructure:"max_openfile"`
+	SourceDir          string          `mapstructure:"source_dir"`
+	TargetDir          string          `mapstructure:"target_dir"`
+	MaxFill            float64         `mapstructure:"max_fill"`
+	LogLevel           string          `mapstructure:"log_level"`
+	SyncDelay          time.Duration   `mapstructure:"sync_delay"`
+	ApprovedExtensions []string        `mapstructure:"approved_extensions"`
+	LogFile            string          `mapstructure:"log_file"`
+	MaxOpenFile        int             `mapstructure:"max_openfile"`
+	EvictionPolicy     string          `mapstructure:"eviction_policy"`
+	Pinned             []string        `mapstructure:"pinned"`
+	UnitDepth          []string        `mapstructure:"unit_depth"`
+	MaxBytes           ByteSize        `mapstructure:"max_bytes"`
+	ReserveFree        ByteSize        `mapstructure:"reserve_free"`
+	HighFill           float64         `mapstructure:"high_fill"`
+	LowFill            float64         `mapstructure:"low_fill"`
+	Retention          []RetentionRule `mapstructure:"retention"`
+	RetentionInterval  time.Duration   `mapstructure:"retention_interval"`
+	JournalFile        string          `mapstructure:"journal_file"`
+	Jellyfin           JellyfinConfig  `mapstructure:"jellyfin"`
+	Plex               PlexConfig      `mapstructure:"plex"`
+	PathMap            []PathMapping   `mapstructure:"path_map"`
+	PrefetchEpisodes   int             `mapstructure:"prefetch_episodes"`
+	Webhook            WebhookConfig   `mapstructure:"webhook"`
+	RefreshDelay       time.Duration   `mapstructure:"refresh_delay"`
+	RefreshRetries     int             `mapstructure:"refresh_retries"`
+	CollectionRefresh  time.Duration   `mapstructure:"collection_refresh"`
+	RankRefresh        time.Duration   `mapstructure:"rank_refresh"`
+	Allowances         []Allowance     `mapstructure:"allowance"`
+	WriteQuiet         time.Duration   `mapstructure:"write_quiet"`
+	Score              ScoreWeights    `mapstructure:"score"`
 }
 
 func (cfg *Config) Equal(otherCFG Config) bool {
@@ -31,7 +118,88 @@ func (cfg *Config) Equal(otherCFG Config) bool {
 	return cfg.TargetDir == otherCFG.TargetDir && cfg.SourceDir == otherCFG.SourceDir &&
 		cfg.MaxFill == otherCFG.MaxFill && cfg.SyncDelay == otherCFG.SyncDelay &&
 		slices.Equal(cfg.ApprovedExtensions, otherCFG.ApprovedExtensions) && cfg.LogFile == otherCFG.LogFile &&
-		cfg.MaxOpenFile == otherCFG.MaxOpenFile
+		cfg.MaxOpenFile == otherCFG.MaxOpenFile && cfg.EvictionPolicy == otherCFG.EvictionPolicy &&
+		slices.Equal(cfg.Pinned, otherCFG.Pinned) && slices.Equal(cfg.UnitDepth, otherCFG.UnitDepth) &&
+		cfg.MaxBytes == otherCFG.MaxBytes && cfg.ReserveFree == otherCFG.ReserveFree &&
+		cfg.HighFill == otherCFG.HighFill && cfg.LowFill == otherCFG.LowFill &&
+		slices.Equal(cfg.Retention, otherCFG.Retention) && cfg.RetentionInterval == otherCFG.RetentionInterval &&
+		cfg.JournalFile == otherCFG.JournalFile && cfg.Jellyfin.URL == otherCFG.Jellyfin.URL &&
+		cfg.Jellyfin.APIKey == otherCFG.Jellyfin.APIKey && slices.Equal(cfg.Jellyfin.Users, otherCFG.Jellyfin.Users) &&
+		cfg.Jellyfin.Refresh == otherCFG.Jellyfin.Refresh && cfg.Jellyfin.Database == otherCFG.Jellyfin.Database &&
+		cfg.Jellyfin.PlaybackReporting == otherCFG.Jellyfin.PlaybackReporting &&
+		slices.Equal(cfg.Jellyfin.Collections, otherCFG.Jellyfin.Collections) && cfg.Plex.URL == otherCFG.Plex.URL &&
+		cfg.Plex.Token == otherCFG.Plex.Token && cfg.Plex.Refresh == otherCFG.Plex.Refresh &&
+		cfg.Plex.Database == otherCFG.Plex.Database && slices.Equal(cfg.Plex.Collections, otherCFG.Plex.Collections) &&
+		slices.Equal(cfg.PathMap, otherCFG.PathMap) &&
+		cfg.PrefetchEpisodes == otherCFG.PrefetchEpisodes && cfg.Webhook == otherCFG.Webhook &&
+		cfg.RefreshDelay == otherCFG.RefreshDelay && cfg.RefreshRetries == otherCFG.RefreshRetries &&
+		cfg.Score == otherCFG.Score && cfg.CollectionRefresh == otherCFG.CollectionRefresh && cfg.RankRefresh == otherCFG.RankRefresh &&
+		slices.Equal(cfg.Allowances, otherCFG.Allowances) && cfg.WriteQuiet == otherCFG.WriteQuiet
+}
+
+// Returns the high watermark, max_fill when high_fill is not set
+func (cfg *Config) highFill() float64 {
+	if cfg.HighFill > 0 {
+		return cfg.HighFill
+	}
+	return cfg.MaxFill
+}
+
+// Returns the low watermark, the high watermark when low_fill is not set or above it
+func (cfg *Config) lowFill() float64 {
+	if high := cfg.highFill(); cfg.LowFill <= 0 || cfg.LowFill > high {
+		return high
+	}
+	return cfg.LowFill
+}
+
+// UsageLimit returns the target filesystem usage filo may not push past, the strictest of high_fill
+// (max_fill when unset), max_bytes and reserve_free. Each of them is ignored when set to 0. managed is
+// the number of bytes filo already holds on the target, max_bytes only caps those.
+func (cfg *Config) UsageLimit(total, used, free, managed uint64) uint64 {
+	limit := total
+	if fill := cfg.highFill(); fill > 0 {
+		limit = min(limit, uint64(fill*float64(total)))
+	}
+
+	if cfg.MaxBytes > 0 {
+		limit = min(limit, used-min(managed, used)+uint64(cfg.MaxBytes))
+	}
+
+	if cfg.ReserveFree > 0 {
+		limit = min(limit, used+free-min(uint64(cfg.ReserveFree), used+free))
+	}
+
+	return limit
+}
+
+// LowUsageLimit returns the target filesystem usage an eviction pass frees the target down to. It sits below
+// UsageLimit by the gap between high_fill and low_fill, of the disk when high_fill sets the limit and of the
+// Budget when max_bytes or reserve_free do. Only what filo manages is freed, it never goes below the rest.
+func (cfg *Config) LowUsageLimit(total, used, free, managed uint64) uint64 {
+	limit := cfg.UsageLimit(total, used, free, managed)
+	budget := cfg.Budget(total, used, free, managed)
+	high, low := cfg.highFill(), cfg.lowFill()
+	if high <= 0 || low >= high {
+		return limit
+	}
+
+	if limit == uint64(high*float64(total)) {
+		return max(uint64(low*float64(total)), limit-budget)
+	}
+	return limit - uint64(math.Round(float64(budget)*(high-low)/high))
+}
+
+// Budget returns the number of bytes filo may hold on the target, the usage limit minus
+// whatever on the target filo does not manage
+func (cfg *Config) Budget(total, used, free, managed uint64) uint64 {
+	limit := cfg.UsageLimit(total, used, free, managed)
+	unmanaged := used - min(managed, used)
+	if limit <= unmanaged {
+		return 0
+	}
+
+	return limit - unmanaged
 }
 
 var debugLevels = map[string]slog.Level{
@@ -42,13 +210,35 @@ var debugLevels = map[string]slog.Level{
 }
 
 func Load() *Config {
-	v := viper.New()
+	v := viper.NewWithOptions(viper.WithDecodeHook(mapstructure.ComposeDecodeHookFunc(
+		stringToAgeHookFunc(), // time.Duration, accepts days
+		mapstructure.StringToSliceHookFunc(","),
+		mapstructure.TextUnmarshallerHookFunc(), // ByteSize
+	)))
 
 	// Set defaults.
 	v.SetDefault("max_fill", 0.92) // The actions of this program cannot result in a change where new target size > max_fill
 	v.SetDefault("log_level", "info")
 	v.SetDefault("sync_delay", "30s")
 	v.SetDefault("max_openfile", "100")
+	v.SetDefault("eviction_policy", "filo")      // filo, lru, lfu, largest, score
+	v.SetDefault("max_bytes", 0)                 // 0 means no cap on the bytes filo manages
+	v.SetDefault("reserve_free", 0)              // free space always left on the target
+	v.SetDefault("retention_interval", "1h")     // how often [[retention]] rules are applied
+	v.SetDefault("journal_file", "filo.journal") // evictions and deletions are appended here, see filo restore
+	v.SetDefault("prefetch_episodes", 3)         // episodes kept on the target after the last one watched
+	v.SetDefault("refresh_delay", "1m")          // quiet period before media servers rescan what filo changed
+	v.SetDefault("refresh_retries", 3)           // attempts after a failed media server refresh
+	v.SetDefault("collection_refresh", "15m")    // how often the members of pinned collections are read
+	v.SetDefault("rank_refresh", "15m")          // how often the source is ranked again from the media servers
+	v.SetDefault("write_quiet", "1m")            // how long a source file must go unchanged before it is copied
+	v.SetDefault("score.recency", 100)           // weights of eviction_policy = "score", see ScoreWeights
+	v.SetDefault("score.pinned", 1000)
+	v.SetDefault("score.favorite", 50)
+	v.SetDefault("score.watch_count", 10)
+	v.SetDefault("score.size", -1)
+	v.SetDefault("score.age", -0.1)
+	v.SetDefault("score.rank", 100)
 
 	// Config file name and type
 	v.SetConfigName("filo") // without extension
@@ -75,17 +265,23 @@ func Load() *Config {
 		os.Exit(2)
 	}
 
+	SetLogOutput(&cfg, os.Stdout)
+	return &cfg
+}
+
+// SetLogOutput sends the logs to console, and to log_file when one is set
+func SetLogOutput(cfg *Config, console io.Writer) {
 	var outWriter io.Writer
 	if cfg.LogFile != "" {
 		outFile, err := os.OpenFile(cfg.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 		if err != nil {
 			log.Println(err.Error(), outFile)
-			outWriter = os.Stdout
+			outWriter = console
 		} else {
-			outWriter = io.MultiWriter(os.Stdout, outFile)
+			outWriter = io.MultiWriter(console, outFile)
 		}
 	} else {
-		outWriter = os.Stdout
+		outWriter = console
 	}
 
 	logger := slog.New(tint.NewHandler(outWriter, &tint.Options{
@@ -94,5 +290,4 @@ func Load() *Config {
 	}))
 
 	slog.SetDefault(logger)
-	return &cfg
 }
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ByteSize is a number of bytes that can be written in filo.toml as a plain integer
+// or as a human readable string like "500GiB", "1.5 TB" or "750M"
+type ByteSize uint64
+
+var byteSizeUnits = map[string]float64{
+	"":    1,
+	"b":   1,
+	"k":   1 << 10,
+	"kib": 1 << 10,
+	"kb":  1e3,
+	"m":   1 << 20,
+	"mib": 1 << 20,
+	"mb":  1e6,
+	"g":   1 << 30,
+	"gib": 1 << 30,
+	"gb":  1e9,
+	"t":   1 << 40,
+	"tib": 1 << 40,
+	"tb":  1e12,
+	"p":   1 << 50,
+	"pib": 1 << 50,
+	"pb":  1e15,
+}
+
+// ParseByteSize parses a size like "500GiB". Binary units (K, KiB) are powers of 1024
+// and decimal units (KB) are powers of 1000.
+func ParseByteSize(s string) (ByteSize, error) {
+	trimmed := strings.TrimSpace(s)
+	split := strings.IndexFunc(trimmed, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+
+	number, unit := trimmed, ""
+	if split >= 0 {
+		number, unit = trimmed[:split], strings.ToLower(strings.TrimSpace(trimmed[split:]))
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s': %w", s, err)
+	}
+
+	multiplier, ok := byteSizeUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s': unknown unit '%s'", s, unit)
+	}
+
+	return ByteSize(value * multiplier), nil
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	size, err := ParseByteSize(string(text))
+	if err != nil {
+		return err
+	}
+
+	*b = size
+	return nil
+}
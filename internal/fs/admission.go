@@ -0,0 +1,166 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"bebop831.com/filo/internal/util"
+)
+
+// Priority given to pinned files, they are admitted before anything else, see also FileNode.Priority
+const PinnedPriority = 1 << 16
+
+// Admission is a unit from the source waiting to be copied to the target, see UnitOf
+type Admission struct {
+	Node     *FileNode   // unit in the source tree
+	Files    []*FileNode // files of the unit missing from the target
+	RelPath  string      // path of the unit relative to both roots
+	Size     uint64      // size of the whole unit
+	ModTime  time.Time   // newest mtime in the unit
+	Priority int         // higher priorities are admitted first, regardless of age
+	Reason   string      // why the admission was skipped or rejected, empty when admitted
+}
+
+// NewAdmissionQueue turns the result of MissingIn into an ordered queue of units. Missing directories are
+// expanded into the files below them and the files are grouped by unit, the queue is sorted by priority
+// and then newest source mtime first so units holding a pinned file come before everything else.
+// A unit takes the highest priority of its files.
+func NewAdmissionQueue(src *FileTree, missing map[string][]*FileNode) []*Admission {
+	queue := make([]*Admission, 0)
+	byUnit := make(map[*FileNode]*Admission)
+
+	var enqueue func(n *FileNode)
+	enqueue = func(n *FileNode) {
+		if n == nil || n.Entry == nil {
+			return
+		}
+
+		if n.Entry.IsDir() {
+			for _, c := range n.Children {
+				enqueue(c)
+			}
+			return
+		}
+
+		unit := src.UnitOf(n)
+		a, ok := byUnit[unit]
+		if !ok {
+			a = &Admission{
+				Node:    unit,
+				RelPath: src.RelBaseFile(unit.Path),
+				Size:    unit.Size(),
+				ModTime: unit.ModTime(),
+			}
+
+			if hasPinned(unit) {
+				a.Priority = PinnedPriority
+			} else {
+				a.Priority = unitPriority(unit)
+			}
+
+			byUnit[unit] = a
+			queue = append(queue, a)
+		}
+
+		a.Files = append(a.Files, n)
+	}
+
+	for _, children := range missing {
+		for _, c := range children {
+			enqueue(c)
+		}
+	}
+
+	slices.SortFunc(queue, func(this, that *Admission) int {
+		switch {
+		case this.Priority > that.Priority:
+			return -1
+		case this.Priority < that.Priority:
+			return 1
+		}
+
+		if c := that.ModTime.Compare(this.ModTime); c != 0 {
+			return c
+		}
+		return strings.Compare(this.RelPath, that.RelPath)
+	})
+
+	return queue
+}
+
+// Copies the missing files of the admitted units from src into t in queue order, creating parent
+// directories as needed. Returns the target paths of the files copied.
+func (t *FileTree) CopyQueue(src *FileTree, admitted []*Admission, maxFileSemaphore chan struct{}, runAfter func()) []string {
+
+	tgtRoot, err := os.OpenRoot(t.Root.Path)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+	defer tgtRoot.Close()
+
+	var wg sync.WaitGroup
+	var copied, created copiedPaths
+	for _, a := range admitted {
+		for _, f := range a.Files {
+			relPath := src.RelBaseFile(f.Path)
+			if dir := filepath.Dir(relPath); dir != "." {
+				dirs, err := mkdirAll(tgtRoot, dir)
+				for _, d := range dirs {
+					created.add(filepath.Join(t.Root.Path, d))
+				}
+				if err != nil {
+					slog.Error(err.Error())
+					continue
+				}
+			}
+
+			maxFileSemaphore <- struct{}{}
+			wg.Go(func() {
+				defer func() { <-maxFileSemaphore }()
+
+				if _, hash, err := copyFile(src.Root.Path, t.Root.Path, relPath); err != nil {
+					slog.Error(err.Error())
+				} else {
+					f.Hash = hash
+					copied.add(filepath.Join(t.Root.Path, relPath))
+				}
+			})
+		}
+		slog.Debug(fmt.Sprintf("admitted %s (%s)", a.RelPath, util.BytesToString(a.Size)))
+	}
+
+	wg.Wait()
+	copyDirMetadata(src.Root.Path, t.Root.Path, copied.paths, created.paths)
+
+	if runAfter != nil {
+		runAfter()
+	}
+
+	return copied.paths
+}
+
+// Creates dir in root along with any missing parents like os.Root.MkdirAll. Returns the directories it
+// created, relative to root, parents first.
+func mkdirAll(root *os.Root, dir string) ([]string, error) {
+	parts := strings.Split(filepath.Clean(dir), string(filepath.Separator))
+	created := make([]string, 0)
+	for i := range parts {
+		p := filepath.Join(parts[:i+1]...)
+		if err := root.Mkdir(p, 0755); err != nil {
+			if errors.Is(err, os.ErrExist) {
+				continue
+			}
+			return created, err
+		}
+		created = append(created, p)
+	}
+	return created, nil
+}
@@ -0,0 +1,213 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/util"
+)
+
+// Returns the media server users owning n, those whose in-progress, next up or favorite items cover a
+// file of n, see WatchState.Users. Pinned units belong to no one.
+func unitOwners(n *FileNode) []string {
+	if n == nil || hasPinned(n) {
+		return nil
+	}
+
+	owners := make([]string, 0)
+	for _, f := range n.Files() {
+		for _, user := range f.Watch.Users {
+			if !slices.Contains(owners, user) {
+				owners = append(owners, user)
+			}
+		}
+	}
+	slices.Sort(owners)
+	return owners
+}
+
+// Returns the [[allowance]] rule of user, server/name, a rule naming the user on its server before
+// one naming the user on every server. Returns nil when no rule applies.
+func allowanceRule(rules []config.Allowance, user string) *config.Allowance {
+	_, name, _ := strings.Cut(user, "/")
+
+	var bare *config.Allowance
+	for i, rule := range rules {
+		switch {
+		case strings.EqualFold(rule.User, user):
+			return &rules[i]
+		case bare == nil && !strings.Contains(rule.User, "/") && strings.EqualFold(rule.User, name):
+			bare = &rules[i]
+		}
+	}
+	return bare
+}
+
+// Returns the bytes rule allows out of budget, the smaller of its share and max_bytes when both are set
+func allowanceBytes(rule *config.Allowance, budget uint64) uint64 {
+	allowance := uint64(0)
+	if rule.Share > 0 {
+		allowance = uint64(rule.Share * float64(budget))
+	}
+	if rule.MaxBytes > 0 && (allowance == 0 || uint64(rule.MaxBytes) < allowance) {
+		allowance = uint64(rule.MaxBytes)
+	}
+	return allowance
+}
+
+// shares tracks the bytes of the target owned by each media server user while a plan is made. A unit
+// owned by several users is split evenly between them.
+type shares struct {
+	rules  []config.Allowance
+	budget uint64
+	owned  map[string]uint64
+	units  map[string]int
+}
+
+// Returns the shares of the managed units of tgt, with allowances taken out of budget
+func newShares(rules []config.Allowance, budget uint64, src, tgt *FileTree) *shares {
+	s := &shares{rules: rules, budget: budget, owned: make(map[string]uint64), units: make(map[string]int)}
+	for _, unit := range managedUnits(src, tgt) {
+		s.charge(unitOwners(sourceNode(src, tgt, unit)), unit.Size())
+	}
+	return s
+}
+
+// Adds size bytes to owners
+func (s *shares) charge(owners []string, size uint64) {
+	for _, user := range owners {
+		s.owned[user] += size / uint64(len(owners))
+		s.units[user]++
+	}
+}
+
+// Takes size bytes back from owners
+func (s *shares) release(owners []string, size uint64) {
+	for _, user := range owners {
+		s.owned[user] -= min(size/uint64(len(owners)), s.owned[user])
+		s.units[user] = max(s.units[user]-1, 0)
+	}
+}
+
+// Returns the allowance of user in bytes, false when the user has none
+func (s *shares) allowance(user string) (uint64, bool) {
+	rule := allowanceRule(s.rules, user)
+	if rule == nil {
+		return 0, false
+	}
+	return allowanceBytes(rule, s.budget), true
+}
+
+// Returns true when owners holding size more bytes would put every one of them past their allowance.
+// Users without an allowance are never past it.
+func (s *shares) over(owners []string, size uint64) bool {
+	if len(owners) == 0 {
+		return false
+	}
+
+	for _, user := range owners {
+		allowance, ok := s.allowance(user)
+		if !ok || s.owned[user]+size/uint64(len(owners)) <= allowance {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the priority of the source unit n, at most 0 once every user owning it is past their allowance
+// so what they hold beyond it does not push out the items of other users
+func (s *shares) priority(n *FileNode) int {
+	priority := unitPriority(n)
+	if priority > 0 && s.over(unitOwners(n), 0) {
+		return 0
+	}
+	return priority
+}
+
+// UserShare is how much of the target a media server user owns, see Status
+type UserShare struct {
+	User      string `json:"user"`
+	Owned     uint64 `json:"owned"`
+	Units     int    `json:"units"`
+	Allowance uint64 `json:"allowance,omitempty"` // 0 when the user has none
+}
+
+// Status is how the bytes filo holds on the target are shared between pinned units, media server users
+// and everything else
+type Status struct {
+	Target  string      `json:"target"`
+	Budget  uint64      `json:"budget"` // bytes filo may hold on the target, see config.Budget
+	Managed uint64      `json:"managed"`
+	Pinned  uint64      `json:"pinned"`
+	Unowned uint64      `json:"unowned"` // neither pinned nor owned by a user
+	Users   []UserShare `json:"users"`
+}
+
+// Status works out how much of tgt each media server user owns, from the owners of src set by the
+// Prioritizer, see WatchState.Users. Users with an [[allowance]] are listed even when they own nothing.
+func (e *Evictor) Status(src, tgt *FileTree) (*Status, error) {
+	usage, err := e.Usage(tgt.Root.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", err.Error(), tgt.Root.Path)
+	}
+
+	managed := ManagedBytes(src, tgt)
+	status := &Status{
+		Target:  tgt.Root.Path,
+		Budget:  e.cfg.Budget(usage.Total, usage.Used, usage.Free, managed),
+		Managed: managed,
+		Users:   make([]UserShare, 0),
+	}
+
+	s := newShares(e.cfg.Allowances, status.Budget, src, tgt)
+	for _, unit := range managedUnits(src, tgt) {
+		srcUnit := sourceNode(src, tgt, unit)
+		switch {
+		case unitPinned(src, tgt, unit):
+			status.Pinned += unit.Size()
+		case len(unitOwners(srcUnit)) == 0:
+			status.Unowned += unit.Size()
+		}
+	}
+
+	for _, rule := range e.cfg.Allowances {
+		if strings.Contains(rule.User, "/") {
+			if _, ok := s.owned[rule.User]; !ok {
+				s.owned[rule.User] = 0
+			}
+		}
+	}
+
+	for _, user := range slices.Sorted(maps.Keys(s.owned)) {
+		share := UserShare{User: user, Owned: s.owned[user], Units: s.units[user]}
+		share.Allowance, _ = s.allowance(user)
+		status.Users = append(status.Users, share)
+	}
+
+	return status, nil
+}
+
+// WriteText writes the status to w in a human readable form
+func (s *Status) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s: filo holds %s of a %s budget\n", s.Target, util.BytesToString(s.Managed), util.BytesToString(s.Budget))
+	fmt.Fprintf(w, "  %-28s %12s\n", "pinned", util.BytesToString(s.Pinned))
+	fmt.Fprintf(w, "  %-28s %12s\n", "unowned", util.BytesToString(s.Unowned))
+
+	for _, u := range s.Users {
+		line := fmt.Sprintf("  %-28s %12s  %4d units", u.User, util.BytesToString(u.Owned), u.Units)
+		if u.Allowance == 0 {
+			fmt.Fprintln(w, line)
+			continue
+		}
+
+		line += fmt.Sprintf("  %3.0f%% of %s", 100*float64(u.Owned)/float64(u.Allowance), util.BytesToString(u.Allowance))
+		if u.Owned > u.Allowance {
+			line = util.RemoveColor(line)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
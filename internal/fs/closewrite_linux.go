@@ -0,0 +1,174 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// closeWatcher reports the files closed after being written in the directories it watches, fsnotify does
+// not expose IN_CLOSE_WRITE. The files are collected until taken, so the inotify queue keeps being read
+// while nothing takes them.
+type closeWatcher struct {
+	fd    int
+	f     *os.File
+	ready chan struct{} // holds a value while files or an overflow are waiting to be taken
+	done  chan struct{}
+
+	mu       sync.Mutex
+	dirs     map[int]string  // watch descriptor -> directory
+	wds      map[string]int  // directory -> watch descriptor
+	closed   map[string]bool // files closed after writing since the last Take
+	overflow bool            // the kernel dropped events since the last Take
+}
+
+// Returns a closeWatcher watching nothing yet, nil when inotify is unavailable
+func newCloseWatcher() *closeWatcher {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("IN_CLOSE_WRITE unavailable, waiting for write_quiet only: %v", err))
+		return nil
+	}
+
+	// Non-blocking, the file goes through the runtime poller and Close unblocks Read. f.Fd would make it
+	// blocking again, fd is kept aside.
+	w := &closeWatcher{
+		fd:     fd,
+		f:      os.NewFile(uintptr(fd), "inotify"),
+		ready:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+		dirs:   make(map[int]string),
+		wds:    make(map[string]int),
+		closed: make(map[string]bool),
+	}
+	go w.read()
+	return w
+}
+
+// Returns a channel receiving once files closed after writing are waiting to be taken, see Take. It is
+// closed when the watcher stops reading. Nil for a nil watcher.
+func (w *closeWatcher) Ready() <-chan struct{} {
+	if w == nil {
+		return nil
+	}
+	return w.ready
+}
+
+// Take returns the files closed after writing since the last Take, sorted, and true when the kernel
+// dropped events in the meantime, IN_Q_OVERFLOW, so closes may be missing
+func (w *closeWatcher) Take() ([]string, bool) {
+	if w == nil {
+		return nil, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	closed, overflow := slices.Sorted(maps.Keys(w.closed)), w.overflow
+	clear(w.closed)
+	w.overflow = false
+	return closed, overflow
+}
+
+// Signals ready, unless it already holds a signal nothing took yet
+func (w *closeWatcher) signal() {
+	select {
+	case w.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Add watches dir for files closed after writing, once
+func (w *closeWatcher) Add(dir string) {
+	if w == nil {
+		return
+	}
+
+	dir = filepath.Clean(dir)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.wds[dir]; ok {
+		return
+	}
+
+	wd, err := unix.InotifyAddWatch(w.fd, dir, unix.IN_CLOSE_WRITE|unix.IN_ONLYDIR)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("failed to watch %s for IN_CLOSE_WRITE: %v", dir, err))
+		return
+	}
+	w.dirs[wd] = dir
+	w.wds[dir] = wd
+}
+
+// Close stops the watcher, Ready is closed once it has
+func (w *closeWatcher) Close() {
+	if w == nil {
+		return
+	}
+	close(w.done)
+	w.f.Close()
+}
+
+// Reads the inotify events until the watcher is closed
+func (w *closeWatcher) read() {
+	defer close(w.ready)
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				slog.Error(err.Error())
+			}
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			wd := int(int32(binary.NativeEndian.Uint32(buf[off:])))
+			mask := binary.NativeEndian.Uint32(buf[off+4:])
+			nameLen := int(binary.NativeEndian.Uint32(buf[off+12:]))
+			name := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+nameLen]
+			off += unix.SizeofInotifyEvent + nameLen
+
+			if mask&unix.IN_Q_OVERFLOW != 0 {
+				w.mu.Lock()
+				w.overflow = true
+				w.mu.Unlock()
+				w.signal()
+				continue
+			}
+
+			w.mu.Lock()
+			dir := w.dirs[wd]
+			if mask&unix.IN_IGNORED != 0 {
+				// The directory was removed or unwatched
+				delete(w.dirs, wd)
+				delete(w.wds, dir)
+			}
+			w.mu.Unlock()
+
+			if mask&unix.IN_CLOSE_WRITE == 0 || dir == "" {
+				continue
+			}
+
+			// The name is padded with NULs
+			path := filepath.Join(dir, string(bytes.TrimRight(name, "\x00")))
+			if !IsApprovedPath(path) {
+				continue
+			}
+
+			w.mu.Lock()
+			w.closed[path] = true
+			w.mu.Unlock()
+			w.signal()
+		}
+	}
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package fs
+
+// closeWatcher is Linux only, elsewhere files are held back until they stop changing for write_quiet
+type closeWatcher struct{}
+
+// Returns nil, IN_CLOSE_WRITE is Linux only
+func newCloseWatcher() *closeWatcher {
+	return nil
+}
+
+// Returns nil, a channel that never fires
+func (w *closeWatcher) Ready() <-chan struct{} {
+	return nil
+}
+
+// Returns nothing
+func (w *closeWatcher) Take() ([]string, bool) {
+	return nil, false
+}
+
+// Does nothing
+func (w *closeWatcher) Add(dir string) {}
+
+// Does nothing
+func (w *closeWatcher) Close() {}
@@ -0,0 +1,381 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/util"
+
+	"github.com/shirou/gopsutil/v4/disk"
+)
+
+// Evictor keeps the target within its budget, see config.UsageLimit. Before a copy is made it projects
+// the target usage and removes managed files in the order chosen by Policy until the copy fits.
+type Evictor struct {
+	cfg    *config.Config
+	Policy EvictionPolicy
+
+	mu      sync.Mutex
+	evicted map[string]time.Time // source mtime of the units removed by eviction passes, by relative path
+
+	// Usage reports the filesystem usage of a path, defaults to disk.Usage
+	Usage func(path string) (*disk.UsageStat, error)
+
+	// Journal records every unit removed from the target, nil records nothing
+	Journal *Journal
+
+	// Prioritizer ranks the source tree before it is queued, see Prioritize
+	Prioritizer Prioritizer
+
+	// Scorer replaces the priorities of the source tree with composite scores, set for the score policy
+	Scorer *Scorer
+}
+
+func NewEvictor(cfg *config.Config) (*Evictor, error) {
+	policy, err := NewEvictionPolicy(cfg.EvictionPolicy, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Evictor{
+		cfg:     cfg,
+		Policy:  policy,
+		Usage:   disk.Usage,
+		Journal: NewJournal(cfg.JournalFile),
+		evicted: make(map[string]time.Time),
+	}
+
+	if _, ok := policy.(ScorePolicy); ok {
+		e.Scorer = &Scorer{Weights: cfg.Score, Target: cfg.TargetDir}
+	}
+
+	return e, nil
+}
+
+// Limit returns the number of bytes the target filesystem may hold according to high_fill, max_bytes
+// and reserve_free, managed is the number of bytes filo holds on the target
+func (e *Evictor) Limit(usage *disk.UsageStat, managed uint64) uint64 {
+	return e.cfg.UsageLimit(usage.Total, usage.Used, usage.Free, managed)
+}
+
+// LowLimit returns the target usage an eviction pass frees the target down to, see low_fill
+func (e *Evictor) LowLimit(usage *disk.UsageStat, managed uint64) uint64 {
+	return e.cfg.LowUsageLimit(usage.Total, usage.Used, usage.Free, managed)
+}
+
+// AdmissionPlan is the outcome of walking an admission queue against the target budget
+type AdmissionPlan struct {
+	Admitted  []*Admission
+	Skipped   []*Admission
+	Evict     []*FileNode // target units removed to make room for Admitted
+	Used      uint64      // target usage before the plan is applied
+	Limit     uint64      // high watermark, crossing it starts an eviction pass
+	LowLimit  uint64      // low watermark, an eviction pass frees the target down to it
+	Projected uint64      // target usage once the plan is applied
+	Copied    []string    // target paths of the admitted files copied, set by Admit
+}
+
+// EvictionPass is a single round of evictions performed on the target
+type EvictionPass struct {
+	Policy  string
+	Evicted []*FileNode
+	Freed   uint64
+	Before  uint64 // target usage before the pass
+	After   uint64 // projected target usage once the admitted units are copied
+	Limit   uint64
+	Low     uint64
+}
+
+func (p *EvictionPass) String() string {
+	return fmt.Sprintf("Eviction pass (%s): removed %d units, freed %s, target usage %s -> %s (high %s, low %s)",
+		p.Policy, len(p.Evicted), util.BytesToString(p.Freed), util.BytesToString(p.Before),
+		util.BytesToString(p.After), util.BytesToString(p.Limit), util.BytesToString(p.Low))
+}
+
+// Returns true when a may take the place of the target node victim, the higher priority wins and
+// the newer source mtime breaks ties. The priority of victim is capped by the allowances of its owners.
+func outranks(src, tgt *FileTree, a *Admission, victim *FileNode, s *shares) bool {
+	srcVictim := sourceNode(src, tgt, victim)
+	if priority := s.priority(srcVictim); a.Priority != priority {
+		return a.Priority > priority
+	}
+	return srcVictim.ModTime().Before(a.ModTime)
+}
+
+// Returns true if a was removed by an earlier eviction pass and has not changed on the source since
+func (e *Evictor) wasEvicted(a *Admission) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	modTime, ok := e.evicted[a.RelPath]
+	return ok && modTime.Equal(a.ModTime)
+}
+
+// Plan walks queue in order and admits every item that fits under the high watermark. When an item does
+// not fit, managed units are chosen for eviction in policy order until usage is back down to the low
+// watermark, so the target does not churn on every new file. A unit is never evicted to make room for one
+// older than itself, age is taken from the source copy since the target mtime is the time it was copied.
+// Units removed by an earlier pass are only admitted again once they fit under the low watermark.
+// Units owned by media server users past their [[allowance]] are admitted and evicted like unranked ones.
+// Items past their retention max_age or larger than the whole budget are rejected up front.
+// Plan does not modify the target.
+func (e *Evictor) Plan(src, tgt *FileTree, queue []*Admission) (*AdmissionPlan, error) {
+
+	usage, err := e.Usage(tgt.Root.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", err.Error(), tgt.Root.Path)
+	}
+
+	return e.plan(src, tgt, queue, usage), nil
+}
+
+// Same as Plan with the target usage given by the caller
+func (e *Evictor) plan(src, tgt *FileTree, queue []*Admission, usage *disk.UsageStat) *AdmissionPlan {
+
+	managed := ManagedBytes(src, tgt)
+	limit, low := e.Limit(usage, managed), e.LowLimit(usage, managed)
+	plan := &AdmissionPlan{Used: usage.Used, Limit: limit, LowLimit: low}
+	shares := newShares(e.cfg.Allowances, e.cfg.Budget(usage.Total, usage.Used, usage.Free, managed), src, tgt)
+
+	candidates := e.Policy.Candidates(src, tgt)
+	var evictable uint64
+	for _, c := range candidates {
+		evictable += c.Size()
+	}
+
+	// The most an item could ever be given is the limit minus whatever cannot be evicted
+	var budget uint64
+	if fixed := usage.Used - min(evictable, usage.Used); limit > fixed {
+		budget = limit - fixed
+	}
+
+	now := time.Now()
+	avail := int64(limit) - int64(usage.Used)
+	band := int64(limit - low)
+	evicted := make(map[*FileNode]bool)
+
+	// Picks victims in policy order until want bytes are freed, a is nil when the target is already
+	// past the high watermark and nothing is being admitted
+	pick := func(a *Admission, replacing *FileNode, want int64) ([]*FileNode, int64) {
+		var freed int64
+		victims := make([]*FileNode, 0)
+		for _, c := range candidates {
+			if freed >= want {
+				break
+			}
+
+			if evicted[c] || c == replacing || (a != nil && !outranks(src, tgt, a, c, shares)) {
+				continue
+			}
+
+			victims = append(victims, c)
+			freed += int64(c.Size())
+		}
+		return victims, freed
+	}
+
+	commit := func(victims []*FileNode, freed int64) {
+		for _, v := range victims {
+			evicted[v] = true
+			shares.release(unitOwners(sourceNode(src, tgt, v)), v.Size())
+		}
+		plan.Evict = append(plan.Evict, victims...)
+		avail += freed
+	}
+
+	if avail < 0 {
+		commit(pick(nil, nil, band-avail))
+	}
+
+	for _, a := range queue {
+		if !hasPinned(a.Node) && isExpired(e.cfg.Retention, a.RelPath, a.ModTime, now) {
+			a.Reason = "older than the max_age of its retention rule"
+			plan.skip(a)
+			continue
+		}
+
+		if a.Size > budget {
+			a.Reason = fmt.Sprintf("larger than the %s budget", util.BytesToString(budget))
+			plan.skip(a)
+			continue
+		}
+
+		// Overwriting a file or completing a unit only costs the difference, and what is being
+		// replaced cannot be evicted for it
+		need := int64(a.Size)
+		replacing := tgt.Index[filepath.Join(tgt.Root.Path, a.RelPath)]
+		if replacing != nil {
+			need -= int64(replacing.Size())
+		}
+
+		owners := unitOwners(a.Node)
+		if a.Priority > 0 && shares.over(owners, uint64(max(need, 0))) {
+			slog.Debug(fmt.Sprintf("%s is past the allowance of %v, admitting it as unranked", a.RelPath, owners))
+			a.Priority = 0
+		}
+
+		if a.Priority <= 0 && e.wasEvicted(a) {
+			if need > avail-band {
+				a.Reason = "evicted by an earlier pass, waiting for room under the low watermark"
+				plan.skip(a)
+				continue
+			}
+		} else if need > avail {
+			// Crossing the high watermark, free down to the low watermark in the same pass
+			victims, freed := pick(a, replacing, need-avail+band)
+			if avail+freed < need {
+				a.Reason = "would push the target past its budget"
+				plan.skip(a)
+				continue
+			}
+
+			commit(victims, freed)
+		}
+
+		avail -= need
+		shares.charge(owners, uint64(max(need, 0)))
+		plan.Admitted = append(plan.Admitted, a)
+	}
+
+	plan.Projected = uint64(max(int64(limit)-avail, 0))
+	return plan
+}
+
+func (p *AdmissionPlan) skip(a *Admission) {
+	slog.Info(fmt.Sprintf("Skipping %s (%s): %s", a.RelPath, util.BytesToString(a.Size), a.Reason))
+	p.Skipped = append(p.Skipped, a)
+}
+
+// Evict removes the units chosen by Plan from tgt in a single pass. Returns nil when the plan
+// has nothing to evict.
+func (e *Evictor) Evict(src, tgt *FileTree, plan *AdmissionPlan) *EvictionPass {
+	if len(plan.Evict) == 0 {
+		return nil
+	}
+
+	tgtRoot, err := os.OpenRoot(tgt.Root.Path)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+	defer tgtRoot.Close()
+
+	pass := &EvictionPass{
+		Policy:  e.Policy.Name(),
+		Evicted: make([]*FileNode, 0, len(plan.Evict)),
+		Before:  plan.Used,
+		After:   plan.Projected,
+		Limit:   plan.Limit,
+		Low:     plan.LowLimit,
+	}
+
+	for _, tgtNode := range plan.Evict {
+		size := tgtNode.Size()
+		modTime := sourceNode(src, tgt, tgtNode).ModTime()
+		relBaseFile := tgt.RelBaseFile(tgtNode.Path)
+		if !filepath.IsLocal(relBaseFile) {
+			slog.Info(fmt.Sprintf("failed to evict %s", tgtNode.Path))
+			continue
+		}
+
+		entries := e.Journal.Entries(src, tgt, tgtNode, ReasonEvicted, e.Policy.Name())
+		if err := tgtRoot.RemoveAll(relBaseFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error(err.Error())
+			continue
+		}
+		e.Journal.Record(entries)
+
+		slog.Debug(fmt.Sprintf("%s evicted from %s (%s)", relBaseFile, tgt.Root.Path, util.BytesToString(size)))
+		tgt.detach(tgtNode)
+
+		e.mu.Lock()
+		e.evicted[relBaseFile] = modTime
+		e.mu.Unlock()
+
+		pass.Evicted = append(pass.Evicted, tgtNode)
+		pass.Freed += size
+	}
+
+	return pass
+}
+
+// Admit plans the queue against the target budget, evicts what the plan requires and copies the
+// admitted files from src into tgt in queue order. tgt is kept in step with the target, evicted units
+// are removed from it and copied files inserted. Returns the eviction pass, nil if nothing was evicted.
+func (e *Evictor) Admit(src, tgt *FileTree, queue []*Admission, maxFileSemaphore chan struct{}, runAfter func()) (*AdmissionPlan, *EvictionPass) {
+	plan, err := e.Plan(src, tgt, queue)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil, nil
+	}
+
+	pass := e.Evict(src, tgt, plan)
+	if pass != nil {
+		slog.Info(pass.String())
+	}
+
+	plan.Copied = tgt.CopyQueue(src, plan.Admitted, maxFileSemaphore, runAfter)
+	tgt.patch(plan.Copied)
+
+	e.mu.Lock()
+	for _, a := range plan.Admitted {
+		delete(e.evicted, a.RelPath)
+	}
+	e.mu.Unlock()
+
+	return plan, pass
+}
+
+// CheckPinned warns when the pinned files in src alone would not fit in the budget of tgt.
+// Returns the number of pinned bytes in src.
+func (e *Evictor) CheckPinned(src, tgt *FileTree) uint64 {
+	var pinned uint64
+	for _, n := range src.Index {
+		if n.Pinned && n.Entry != nil && !n.Entry.IsDir() {
+			pinned += n.Size()
+		}
+	}
+
+	if pinned == 0 {
+		return 0
+	}
+
+	usage, err := e.Usage(tgt.Root.Path)
+	if err != nil {
+		slog.Error(err.Error() + " " + tgt.Root.Path)
+		return pinned
+	}
+
+	budget := e.cfg.Budget(usage.Total, usage.Used, usage.Free, ManagedBytes(src, tgt))
+	if pinned > budget {
+		slog.Warn(fmt.Sprintf("pinned files need %s but the budget only allows %s on %s, not every pinned file will be synced",
+			util.BytesToString(pinned), util.BytesToString(budget), tgt.Root.Path))
+	}
+
+	return pinned
+}
+
+// Removes n and everything below it from the tree index and n from its parents children
+func (t *FileTree) detach(n *FileNode) {
+	var unindex func(n *FileNode)
+	unindex = func(n *FileNode) {
+		delete(t.Index, n.Path)
+		for _, c := range n.Children {
+			unindex(c)
+		}
+	}
+
+	unindex(n)
+	if n.Parent != nil {
+		n.Parent.Children = slices.DeleteFunc(n.Parent.Children, func(c *FileNode) bool {
+			return c == n
+		})
+	}
+}
@@ -2,17 +2,22 @@ package fs
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
 	"slices"
 	"strings"
 	"sync"
+	"time"
+
+	"bebop831.com/filo/internal/config"
 )
 
 var Mu *sync.Mutex
@@ -28,12 +33,31 @@ type FileNode struct {
 	Entry    fs.DirEntry
 	Parent   *FileNode
 	Children []*FileNode
-	Hash     []byte
+	Hash     []byte // sha256 of the file, set once filo copied it
+	Pinned   bool   // always synced and never evicted, see the pinned key in filo.toml
+	Priority int    // set by a Prioritizer, higher priorities are admitted first and evicted last
+	Watch    WatchState
 }
 
 type FileTree struct {
 	Root  *FileNode
 	Index map[string]*FileNode
+	opts  TreeOptions
+
+	only        map[string]bool // opts.Only
+	onlyParents map[string]bool // parent directories of opts.Only
+}
+
+// TreeOptions describe how a FileTree groups and marks its nodes
+type TreeOptions struct {
+	Pinned []string // globs relative to the root that mark nodes as pinned, along with everything below them
+	Units  []string // globs relative to the root of directories that are admitted, sized and evicted as one
+	Only   []string // paths relative to the root the tree is limited to, along with everything below them. Empty walks everything.
+}
+
+// Returns the TreeOptions set in filo.toml
+func NewTreeOptions(cfg *config.Config) TreeOptions {
+	return TreeOptions{Pinned: cfg.Pinned, Units: cfg.UnitDepth}
 }
 
 func (t *FileNode) SetFileHash() {
@@ -54,14 +78,121 @@ func (t *FileNode) SetFileHash() {
 	}
 }
 
-func buildTree(src *FileTree, rootPath string) (*FileTree, error) {
+// Returns true if relPath matches one of the globs in patterns
+func matchAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		if ok, err := filepath.Match(filepath.FromSlash(pattern), relPath); err != nil {
+			slog.Error(fmt.Sprintf("invalid glob '%s': %s", pattern, err.Error()))
+		} else if ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if relPath is in the part of the tree set by TreeOptions.Only
+func (ft *FileTree) included(relPath string) bool {
+	if len(ft.only) == 0 || relPath == "." || ft.onlyParents[relPath] {
+		return true
+	}
+
+	for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if ft.only[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if relPath matches one of the pinned globs of the tree
+func (ft *FileTree) isPinned(relPath string) bool {
+	return matchAny(ft.opts.Pinned, relPath)
+}
+
+// Size returns the size of n in bytes, directory sizes roll up across their Children
+func (n *FileNode) Size() uint64 {
+	if n == nil || n.Entry == nil {
+		return 0
+	}
+
+	if n.Entry.IsDir() {
+		var total uint64
+		for _, c := range n.Children {
+			total += c.Size()
+		}
+		return total
+	}
+
+	info, err := n.Entry.Info()
+	if err != nil {
+		slog.Error(err.Error())
+		return 0
+	}
+
+	return uint64(info.Size())
+}
+
+// ModTime returns the mtime of n, for directories this is the newest mtime found below n
+func (n *FileNode) ModTime() time.Time {
+	if n == nil || n.Entry == nil {
+		return time.Time{}
+	}
+
+	if n.Entry.IsDir() {
+		var newest time.Time
+		for _, c := range n.Children {
+			if mt := c.ModTime(); mt.After(newest) {
+				newest = mt
+			}
+		}
+		return newest
+	}
+
+	info, err := n.Entry.Info()
+	if err != nil {
+		slog.Error(err.Error())
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// Returns the files below n, or n itself when it is a file
+func (n *FileNode) Files() []*FileNode {
+	if n == nil || n.Entry == nil {
+		return nil
+	}
+
+	if !n.Entry.IsDir() {
+		return []*FileNode{n}
+	}
+
+	files := make([]*FileNode, 0)
+	for _, c := range n.Children {
+		files = append(files, c.Files()...)
+	}
+	return files
+}
+
+func buildTree(src *FileTree, rootPath string, opts TreeOptions) (*FileTree, error) {
 
 	sanitized_path := filepath.Clean(rootPath)
 	if _, err := os.Lstat(sanitized_path); err != nil {
 		return nil, err
 	}
 
-	ft := &FileTree{Index: make(map[string]*FileNode), Root: &FileNode{Path: rootPath}}
+	ft := &FileTree{Index: make(map[string]*FileNode), Root: &FileNode{Path: rootPath}, opts: opts}
+	if len(opts.Only) > 0 {
+		ft.only, ft.onlyParents = make(map[string]bool), make(map[string]bool)
+		for _, relPath := range opts.Only {
+			relPath = filepath.Clean(relPath)
+			ft.only[relPath] = true
+			for p := filepath.Dir(relPath); p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+				ft.onlyParents[p] = true
+			}
+		}
+	}
 
 	filepath.WalkDir(ft.Root.Path, func(path string, d fs.DirEntry, err error) error {
 		switch {
@@ -97,6 +228,13 @@ func buildTree(src *FileTree, rootPath string) (*FileTree, error) {
 			}
 		}
 
+		if !ft.included(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		if IsApprovedPath(path) {
 
 			currentNode := ft.Index[path]
@@ -134,7 +272,12 @@ func buildTree(src *FileTree, rootPath string) (*FileTree, error) {
 							}
 						}
 
+						if !ft.included(relPath) {
+							continue
+						}
+
 						childNode := &FileNode{Path: possiblePath, Entry: e, Parent: currentNode, Children: make([]*FileNode, 0)}
+						childNode.Pinned = currentNode.Pinned || ft.isPinned(relPath)
 						currentNode.Children = append(currentNode.Children, childNode)
 						ft.Index[childNode.Path] = childNode
 
@@ -169,18 +312,32 @@ func buildTree(src *FileTree, rootPath string) (*FileTree, error) {
 
 // Same as BuildTree except checks if file in rootPath is also in src.
 // Prevents removing files that that don't exist in src but do in tgt.
-func BuildTargetTree(src *FileTree, rootPath string) (*FileTree, error) {
-	return buildTree(src, rootPath)
+func BuildTargetTree(src *FileTree, rootPath string, opts ...TreeOptions) (*FileTree, error) {
+	return buildTree(src, rootPath, firstTreeOptions(opts))
 }
 
-func BuildTree(rootPath string) (*FileTree, error) {
+// BuildTree walks rootPath into a FileTree. opts is optional, nodes matching its pinned globs
+// are marked as pinned along with everything below them.
+func BuildTree(rootPath string, opts ...TreeOptions) (*FileTree, error) {
 	slog.Debug(fmt.Sprintf("building FiloTree for \"%s\"\n", rootPath))
-	return buildTree(nil, rootPath)
+	return buildTree(nil, rootPath, firstTreeOptions(opts))
+}
+
+func firstTreeOptions(opts []TreeOptions) TreeOptions {
+	if len(opts) == 0 {
+		return TreeOptions{}
+	}
+	return opts[0]
 }
 
 func IsApprovedPath(path string) bool {
 
 	cleanedFilePath := filepath.Clean(path)
+	// Half written copies, hidden by their leading dot everywhere but on Windows
+	if isTempFile(filepath.Base(cleanedFilePath)) {
+		return false
+	}
+
 	isHidden, err := IsHiddenFile(cleanedFilePath)
 
 	if err != nil {
@@ -373,7 +530,21 @@ func (ft *FileTree) RelBaseFile(fileToBeRemoved string) string {
 	return relBaseFile
 }
 
-func copyChildren(src *FileTree, tgt *FileTree, currentPath string, children []*FileNode, maxFileSemaphore chan struct{}, wg *sync.WaitGroup) {
+// copiedPaths collects the target paths of the files copied or directories created by concurrent copies
+type copiedPaths struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+func (c *copiedPaths) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paths = append(c.paths, path)
+}
+
+// Copies children into currentPath in tgt, the files concurrently. The target paths of the files copied are
+// added to copied, the ones of the directories created to created.
+func copyChildren(src *FileTree, tgt *FileTree, currentPath string, children []*FileNode, maxFileSemaphore chan struct{}, wg *sync.WaitGroup, copied, created *copiedPaths) {
 
 	slog.Debug(fmt.Sprint("rootPath: ", currentPath))
 	slog.Debug(fmt.Sprint("children:", children))
@@ -389,10 +560,12 @@ func copyChildren(src *FileTree, tgt *FileTree, currentPath string, children []*
 				}
 
 				slog.Info(err.Error())
+			} else {
+				created.add(tgtPath)
 			}
 
 			slog.Debug(fmt.Sprint(cc.Path, " -> ", tgtPath))
-			copyChildren(src, tgt, tgtPath, cc.Children, maxFileSemaphore, wg)
+			copyChildren(src, tgt, tgtPath, cc.Children, maxFileSemaphore, wg, copied, created)
 		} else {
 			wg.Go(func() {
 				maxFileSemaphore <- struct{}{}
@@ -402,8 +575,11 @@ func copyChildren(src *FileTree, tgt *FileTree, currentPath string, children []*
 					slog.Error(err.Error())
 				}
 
-				if _, err := copyFile(src.Root.Path, tgt.Root.Path, relPath); err != nil {
+				if _, hash, err := copyFile(src.Root.Path, tgt.Root.Path, relPath); err != nil {
 					slog.Error(err.Error())
+				} else {
+					cc.Hash = hash
+					copied.add(tgtPath)
 				}
 				<-maxFileSemaphore
 			})
@@ -411,56 +587,260 @@ func copyChildren(src *FileTree, tgt *FileTree, currentPath string, children []*
 	}
 }
 
-func copyFile(srcRootPath string, tgtRootPath string, relPath string) (int64, error) {
+// Prefix and suffix of the temp files copies are written to, IsApprovedPath skips them so they are never
+// synced or indexed
+const (
+	tempPrefix = ".filo-"
+	tempSuffix = ".tmp"
+)
+
+// Returns true when name is a temp file left by a copy
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempPrefix) && strings.HasSuffix(name, tempSuffix)
+}
+
+// Copies relPath from srcRootPath to tgtRootPath. The copy is written to a hidden temp file next to the
+// target file, synced to disk and renamed over it, so the target file is either the old one or a full copy.
+// Returns the bytes written and the sha256 of what was read from the source.
+func copyFile(srcRootPath string, tgtRootPath string, relPath string) (int64, []byte, error) {
 
 	srcRoot, err := os.OpenRoot(srcRootPath)
 	if err != nil {
 		slog.Error(err.Error())
-		return -1, err
+		return -1, nil, err
 	}
 	defer srcRoot.Close()
 
 	tgtRoot, err := os.OpenRoot(tgtRootPath)
 	if err != nil {
 		slog.Error(err.Error())
-		return -1, err
+		return -1, nil, err
 	}
 	defer tgtRoot.Close()
 
 	srcReader, err := srcRoot.OpenFile(relPath, os.O_RDONLY, 0666)
 	if err != nil {
 		slog.Error(err.Error())
-		return -1, err
+		return -1, nil, err
 	}
 	defer srcReader.Close()
 
-	tgtWriter, err := tgtRoot.OpenFile(relPath, os.O_CREATE|os.O_WRONLY, 0644)
+	// Read before the copy moves the atime
+	srcInfo, err := srcReader.Stat()
+	if err != nil {
+		slog.Error(err.Error())
+		return -1, nil, err
+	}
+
+	tempPath := filepath.Join(filepath.Dir(relPath), tempPrefix+rand.Text()+tempSuffix)
+	tgtWriter, err := tgtRoot.OpenFile(tempPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
 	if err != nil {
 		slog.Error(err.Error())
-		return -1, err
+		return -1, nil, err
+	}
+
+	// Hashed while it is read, so evictions can journal it without reading the source again
+	h := sha256.New()
+	written, err := io.Copy(tgtWriter, io.TeeReader(srcReader, h))
+	// The attributes and times are set before the sync so it covers them along with the data
+	if err == nil {
+		if attrErr := copyAttributes(srcReader, tgtWriter); attrErr != nil {
+			slog.Warn(attrErr.Error())
+		}
+		if timesErr := tgtRoot.Chtimes(tempPath, AccessTime(srcInfo), srcInfo.ModTime()); timesErr != nil {
+			slog.Warn(timesErr.Error())
+		}
+		err = tgtWriter.Sync()
+	}
+	if closeErr := tgtWriter.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = tgtRoot.Rename(tempPath, relPath)
+	}
+
+	if err != nil {
+		if removeErr := tgtRoot.Remove(tempPath); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			slog.Error(removeErr.Error())
+		}
+		return -1, nil, err
+	}
+
+	// The data was synced before the rename, the rename itself is only durable once its directory is
+	if err := syncDir(tgtRoot, filepath.Dir(relPath)); err != nil {
+		slog.Warn(err.Error())
 	}
-	defer tgtWriter.Close()
 
-	written, err := io.Copy(tgtWriter, srcReader)
 	slog.Debug(fmt.Sprintf("%s -> %s", filepath.Join(srcRootPath, relPath), filepath.Join(tgtRootPath, relPath)))
-	return written, err
+	return written, h.Sum(nil), nil
+}
+
+// Copies the extended attributes, the owner when running as root and the mode of src to dst. Times are
+// left to the caller, they have to be set once nothing else is written to dst.
+func copyAttributes(src, dst *os.File) error {
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := copyXattrs(src, dst); err != nil {
+		return err
+	}
+
+	// Before the mode, a chown clears the setuid and setgid bits
+	if uid, gid, ok := fileOwner(info); ok && os.Geteuid() == 0 {
+		if err := dst.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+
+	return dst.Chmod(info.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky))
+}
+
+// Copies the metadata of the source directories holding paths, target files just copied, and of dirs,
+// target directories just created, along with the directories above them to their target counterparts
+// from the deepest up. Run once every file below them is written so their mtime stays put. The roots are
+// left alone.
+func copyDirMetadata(srcRootPath string, tgtRootPath string, paths, dirs []string) {
+	seen := make(map[string]struct{})
+	add := func(p string, isDir bool) {
+		relPath, err := filepath.Rel(tgtRootPath, p)
+		if err != nil || !filepath.IsLocal(relPath) {
+			return
+		}
+
+		dir := relPath
+		if !isDir {
+			dir = filepath.Dir(relPath)
+		}
+
+		// The directories above one already seen were seen along with it
+		for ; dir != "."; dir = filepath.Dir(dir) {
+			if _, ok := seen[dir]; ok {
+				break
+			}
+			seen[dir] = struct{}{}
+		}
+	}
+
+	for _, p := range paths {
+		add(p, false)
+	}
+	for _, d := range dirs {
+		add(d, true)
+	}
+
+	if len(seen) == 0 {
+		return
+	}
+
+	srcRoot, err := os.OpenRoot(srcRootPath)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer srcRoot.Close()
+
+	tgtRoot, err := os.OpenRoot(tgtRootPath)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer tgtRoot.Close()
+
+	// Reverse sorted, a directory comes after the ones below it
+	sorted := slices.Sorted(maps.Keys(seen))
+	slices.Reverse(sorted)
+	for _, dir := range sorted {
+		if err := copyDirAttributes(srcRoot, tgtRoot, dir); err != nil {
+			slog.Warn(err.Error())
+		}
+	}
+}
+
+// Copies the attributes and times of the directory relPath in srcRoot to relPath in tgtRoot
+func copyDirAttributes(srcRoot, tgtRoot *os.Root, relPath string) error {
+	srcDir, err := srcRoot.Open(relPath)
+	if err != nil {
+		return err
+	}
+	defer srcDir.Close()
+
+	info, err := srcDir.Stat()
+	if err != nil {
+		return err
+	}
+
+	tgtDir, err := tgtRoot.Open(relPath)
+	if err != nil {
+		return err
+	}
+	defer tgtDir.Close()
+
+	if err := copyAttributes(srcDir, tgtDir); err != nil {
+		return err
+	}
+	return tgtRoot.Chtimes(relPath, AccessTime(info), info.ModTime())
+}
+
+// RemoveTempFiles removes the temp files copies left in root when filo stopped mid-copy. Returns the paths removed.
+func RemoveTempFiles(root string) ([]string, error) {
+	tgtRoot, err := os.OpenRoot(root)
+	if err != nil {
+		return nil, err
+	}
+	defer tgtRoot.Close()
+
+	removed := make([]string, 0)
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			slog.Error(err.Error())
+			if d != nil && d.IsDir() && path != root {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil || !filepath.IsLocal(relPath) {
+			return nil
+		}
+
+		if err := tgtRoot.Remove(relPath); err != nil {
+			slog.Error(err.Error())
+			return nil
+		}
+		slog.Info(fmt.Sprintf("removed %s left by an interrupted copy", path))
+		removed = append(removed, path)
+		return nil
+	})
+
+	return removed, err
 }
 
 // CopyFrom will copy the children located in the childrenByTgtPath map, this map uses abs paths in t *FileTree as keys and the values are
 // slices containing the nodes that will be copied to that key/path in t. childrenByTgtPath will look like { "/path/to/tgt", ["movies", "tv", "yt"]}
-// This mean in "/path/to/tgt" copy movies, tv and yt
-func (t *FileTree) CopyFrom(src *FileTree, childrenByTgtPath map[string][]*FileNode, maxFileSemaphore chan struct{}, runAfter func()) {
+// This mean in "/path/to/tgt" copy movies, tv and yt. Returns the target paths of the files copied.
+func (t *FileTree) CopyFrom(src *FileTree, childrenByTgtPath map[string][]*FileNode, maxFileSemaphore chan struct{}, runAfter func()) []string {
 
 	var wg sync.WaitGroup
+	var copied, created copiedPaths
 	for targetPath, currentChildren := range childrenByTgtPath {
-		copyChildren(src, t, targetPath, currentChildren, maxFileSemaphore, &wg)
+		copyChildren(src, t, targetPath, currentChildren, maxFileSemaphore, &wg, &copied, &created)
 	}
 
 	wg.Wait()
+	copyDirMetadata(src.Root.Path, t.Root.Path, copied.paths, created.paths)
 
 	if runAfter != nil {
 		runAfter()
 	}
+
+	return copied.paths
 }
 
 func removeChildren(tgtRoot *os.Root, tgt *FileTree, currentPath string, children []*FileNode, wg *sync.WaitGroup) {
@@ -1,7 +1,47 @@
 package fs
 
-import "path/filepath"
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
 
 func IsHiddenFile(path string) (bool, error) {
 	return filepath.Base(path)[0] == '.', nil
 }
+
+// Returns the last access time of info, falls back to the mtime when atime is unavailable
+func AccessTime(info fs.FileInfo) time.Time {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return info.ModTime()
+}
+
+// Returns the device and inode of info, false when they are unavailable
+func fileIdentity(info fs.FileInfo) (fileID, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileID{dev: uint64(st.Dev), ino: st.Ino}, true
+	}
+	return fileID{}, false
+}
+
+// Returns the owner and group of info, false when they are unavailable
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(st.Uid), int(st.Gid), true
+	}
+	return 0, 0, false
+}
+
+// Flushes the directory dir of root to disk, so a rename into it survives a crash
+func syncDir(root *os.Root, dir string) error {
+	d, err := root.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -5,7 +5,10 @@
 package fs
 
 import (
+	"io/fs"
+	"os"
 	"syscall"
+	"time"
 )
 
 func IsHiddenFile(filename string) (bool, error) {
@@ -21,3 +24,26 @@ func IsHiddenFile(filename string) (bool, error) {
 
 	return attributes&syscall.FILE_ATTRIBUTE_HIDDEN != 0, nil
 }
+
+// Returns the last access time of info, falls back to the mtime when atime is unavailable
+func AccessTime(info fs.FileInfo) time.Time {
+	if attr, ok := info.Sys().(*syscall.Win32FileAttributeData); ok {
+		return time.Unix(0, attr.LastAccessTime.Nanoseconds())
+	}
+	return info.ModTime()
+}
+
+// Returns false, the file index of a Windows file is not part of its FileInfo so renames are never confirmed
+func fileIdentity(info fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+// Returns false, Windows files have no uid and gid
+func fileOwner(info fs.FileInfo) (int, int, bool) {
+	return 0, 0, false
+}
+
+// Does nothing, directories cannot be flushed on Windows
+func syncDir(root *os.Root, dir string) error {
+	return nil
+}
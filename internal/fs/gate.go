@@ -0,0 +1,150 @@
+package fs
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// writeState is the size and mtime of a source file when the WriteGate last looked at it
+type writeState struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // when the file last changed, as far as the gate knows
+}
+
+// WriteGate holds back the source files still being written, i.e downloads and imports, so they are not
+// copied half written. A file passes once its size and mtime went unchanged for Quiet, or once it was closed
+// after its last write. A nil WriteGate lets everything through.
+type WriteGate struct {
+	Quiet time.Duration
+
+	mu     sync.Mutex
+	seen   map[string]writeState
+	closed map[string]time.Time
+}
+
+// Returns a WriteGate waiting for quiet, nil when quiet is 0
+func NewWriteGate(quiet time.Duration) *WriteGate {
+	if quiet <= 0 {
+		return nil
+	}
+	return &WriteGate{Quiet: quiet, seen: make(map[string]writeState), closed: make(map[string]time.Time)}
+}
+
+// Closed records that path, an absolute path in the source, was closed after being written at t, i.e on
+// IN_CLOSE_WRITE
+func (g *WriteGate) Closed(path string, t time.Time) {
+	if g == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed[filepath.Clean(path)] = t
+}
+
+// Holding returns the paths of the files the gate held back at the last Hold and still does
+func (g *WriteGate) Holding() []string {
+	if g == nil {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return slices.Sorted(maps.Keys(g.seen))
+}
+
+// Returns true when the file n can be copied at now. Otherwise returns the time it may be copied at if it
+// stops changing. A file first seen is taken to have last changed at its mtime, a file that changed since
+// the gate last looked at it at now.
+func (g *WriteGate) stable(n *FileNode, now time.Time) (bool, time.Time) {
+	info, err := n.Entry.Info()
+	if err != nil {
+		// Gone, its removal is synced on its own
+		slog.Debug(err.Error())
+		return false, time.Time{}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if closed, ok := g.closed[n.Path]; ok && !info.ModTime().After(closed) {
+		delete(g.closed, n.Path)
+		delete(g.seen, n.Path)
+		return true, now
+	}
+
+	s, ok := g.seen[n.Path]
+	if !ok || s.size != info.Size() || !s.modTime.Equal(info.ModTime()) {
+		s = writeState{size: info.Size(), modTime: info.ModTime(), since: info.ModTime()}
+		if ok {
+			s.since = now
+		}
+		g.seen[n.Path] = s
+	}
+
+	if now.Sub(s.since) >= g.Quiet {
+		delete(g.seen, n.Path)
+		delete(g.closed, n.Path)
+		return true, now
+	}
+	return false, s.since.Add(g.Quiet)
+}
+
+// Hold takes the files still being written out of queue, admissions left without files are dropped.
+// Returns the queue left, the paths of the files held back to be tried again with a later batch and the
+// earliest time one of them may pass, the zero time when nothing was held. queue is expected to hold every
+// file missing from the target, the gate forgets the others.
+func (g *WriteGate) Hold(queue []*Admission, now time.Time) ([]*Admission, []string, time.Time) {
+	if g == nil {
+		return queue, nil, time.Time{}
+	}
+
+	admitted := make([]*Admission, 0, len(queue))
+	held := make([]string, 0)
+	var retry time.Time
+	looked := make(map[string]bool)
+	for _, a := range queue {
+		files := make([]*FileNode, 0, len(a.Files))
+		for _, f := range a.Files {
+			looked[f.Path] = true
+			ok, at := g.stable(f, now)
+			switch {
+			case ok:
+				files = append(files, f)
+			case !at.IsZero():
+				slog.Info(fmt.Sprintf("%s is still being written, holding it back until %s", f.Path, at.Format(time.TimeOnly)))
+				held = append(held, f.Path)
+				if retry.IsZero() || at.Before(retry) {
+					retry = at
+				}
+			}
+		}
+
+		if len(files) > 0 {
+			a.Files = files
+			admitted = append(admitted, a)
+		}
+	}
+
+	// Files removed or copied some other way, and closes older than Quiet the quiet period covers by now
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for path := range g.seen {
+		if !looked[path] {
+			delete(g.seen, path)
+		}
+	}
+	for path, closed := range g.closed {
+		if now.Sub(closed) >= g.Quiet {
+			delete(g.closed, path)
+		}
+	}
+
+	return admitted, held, retry
+}
@@ -0,0 +1,239 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons recorded in the journal for a removal from the target
+const (
+	ReasonEvicted = "evicted"
+	ReasonExpired = "expired"
+	ReasonRemoved = "removed from source"
+)
+
+// JournalEntry records a single file removed from the target
+type JournalEntry struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"` // relative to both roots
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"mtime,omitzero"` // mtime of the source copy, zero when the source is gone
+	Hash    string    `json:"hash,omitempty"` // sha256 of the source copy, empty when filo didn't copy it since it started
+	Reason  string    `json:"reason"`
+	Policy  string    `json:"policy,omitempty"` // eviction policy, only set for evictions
+}
+
+// Journal is an append only log of every file filo removes from the target, one JSON entry per line.
+// A nil Journal records nothing.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Returns a Journal appending to path, nil when path is empty
+func NewJournal(path string) *Journal {
+	if path == "" {
+		return nil
+	}
+	return &Journal{path: path}
+}
+
+// Entries returns an entry for every file of the target unit, to be recorded once the unit is removed.
+// Source mtimes and hashes are taken from src, the file is left without them when it is missing from src.
+// Hashes are the ones taken while copying, source files are never read here. Returns nil for a nil Journal.
+func (j *Journal) Entries(src, tgt *FileTree, unit *FileNode, reason, policy string) []JournalEntry {
+	if j == nil {
+		return nil
+	}
+
+	now := time.Now()
+	entries := make([]JournalEntry, 0)
+	for _, f := range unit.Files() {
+		entry := JournalEntry{Time: now, Path: tgt.RelBaseFile(f.Path), Size: f.Size(), Reason: reason, Policy: policy}
+		if srcFile := sourceNode(src, tgt, f); srcFile != nil {
+			if info, err := srcFile.Entry.Info(); err == nil {
+				entry.ModTime = info.ModTime()
+			}
+			if srcFile.Hash != nil {
+				entry.Hash = hex.EncodeToString(srcFile.Hash)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries
+}
+
+// Record appends entries to the journal
+func (j *Journal) Record(entries []JournalEntry) {
+	if j == nil || len(entries) == 0 {
+		return
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	journalFile, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	defer journalFile.Close()
+
+	enc := json.NewEncoder(journalFile)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			slog.Error(err.Error())
+			return
+		}
+	}
+}
+
+// ReadJournal returns the entries of the journal at path in the order they were recorded
+func ReadJournal(path string) ([]JournalEntry, error) {
+	journalFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer journalFile.Close()
+
+	entries := make([]JournalEntry, 0)
+	scanner := bufio.NewScanner(journalFile)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, line, err.Error())
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// JournalFilter selects journal entries, zero fields match everything
+type JournalFilter struct {
+	Paths []string  // globs matched against the path of the entry or one of its parent directories
+	Since time.Time // inclusive
+	Until time.Time // exclusive
+}
+
+// Returns true if entry is selected by f
+func (f JournalFilter) Match(entry JournalEntry) bool {
+	if !f.Since.IsZero() && entry.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && !entry.Time.Before(f.Until) {
+		return false
+	}
+
+	if len(f.Paths) == 0 {
+		return true
+	}
+
+	for p := entry.Path; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if matchAny(f.Paths, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the latest entry for each path selected by f, ordered by path
+func (f JournalFilter) Filter(entries []JournalEntry) []JournalEntry {
+	latest := make(map[string]JournalEntry)
+	for _, entry := range entries {
+		if f.Match(entry) {
+			latest[entry.Path] = entry
+		}
+	}
+
+	selected := make([]JournalEntry, 0, len(latest))
+	for _, entry := range latest {
+		selected = append(selected, entry)
+	}
+
+	slices.SortFunc(selected, func(this, that JournalEntry) int {
+		return strings.Compare(this.Path, that.Path)
+	})
+
+	return selected
+}
+
+// Returns true if srcFile differs from the source copy entry was recorded with. The size and mtime are
+// compared when the entry has no hash, the source is only hashed when it does.
+func sourceChanged(entry JournalEntry, srcFile *FileNode) bool {
+	if entry.Hash != "" {
+		if srcFile.Hash == nil {
+			srcFile.SetFileHash()
+		}
+		return hex.EncodeToString(srcFile.Hash) != entry.Hash
+	}
+
+	if entry.ModTime.IsZero() {
+		return false
+	}
+
+	info, err := srcFile.Entry.Info()
+	if err != nil {
+		slog.Error(err.Error())
+		return false
+	}
+	return uint64(info.Size()) != entry.Size || !info.ModTime().Equal(entry.ModTime)
+}
+
+// Restore copies the files of entries back from src into tgt through the regular admission path, so
+// restored files still have to fit the target budget. Files already on the target or gone from the
+// source are skipped, files whose source changed since they were removed are restored with a warning.
+func (e *Evictor) Restore(src, tgt *FileTree, entries []JournalEntry, maxFileSemaphore chan struct{}) (*AdmissionPlan, error) {
+	files := make([]*FileNode, 0, len(entries))
+	for _, entry := range entries {
+		if !filepath.IsLocal(entry.Path) {
+			slog.Warn(fmt.Sprintf("skipping %s: not a path inside %s", entry.Path, src.Root.Path))
+			continue
+		}
+
+		if _, ok := tgt.Index[filepath.Join(tgt.Root.Path, entry.Path)]; ok {
+			slog.Info(fmt.Sprintf("skipping %s: already on %s", entry.Path, tgt.Root.Path))
+			continue
+		}
+
+		srcFile, ok := src.Index[filepath.Join(src.Root.Path, entry.Path)]
+		if !ok || srcFile.Entry == nil || srcFile.Entry.IsDir() {
+			slog.Warn(fmt.Sprintf("skipping %s: no longer in %s", entry.Path, src.Root.Path))
+			continue
+		}
+
+		if sourceChanged(entry, srcFile) {
+			slog.Warn(fmt.Sprintf("%s changed on %s since it was %s, restoring the current copy", entry.Path, src.Root.Path, entry.Reason))
+		}
+
+		files = append(files, srcFile)
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("nothing to restore")
+	}
+
+	queue := NewAdmissionQueue(src, map[string][]*FileNode{src.Root.Path: files})
+	plan, _ := e.Admit(src, tgt, queue, maxFileSemaphore, nil)
+	if plan == nil {
+		return nil, fmt.Errorf("failed to plan the restore into %s", tgt.Root.Path)
+	}
+
+	return plan, nil
+}
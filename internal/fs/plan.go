@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"bebop831.com/filo/internal/util"
+)
+
+// PlanEntry is a single unit a sync would copy, evict, delete or skip
+type PlanEntry struct {
+	Path   string `json:"path"`
+	Size   uint64 `json:"size"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// SyncPlan is everything a sync would do to the target, see DryRun
+type SyncPlan struct {
+	Source        string      `json:"source"`
+	Target        string      `json:"target"`
+	Policy        string      `json:"policy"`
+	Copy          []PlanEntry `json:"copy"`
+	Evict         []PlanEntry `json:"evict"`
+	Delete        []PlanEntry `json:"delete"`
+	Skip          []PlanEntry `json:"skip"`
+	CopyBytes     uint64      `json:"copy_bytes"`
+	EvictBytes    uint64      `json:"evict_bytes"`
+	DeleteBytes   uint64      `json:"delete_bytes"`
+	Total         uint64      `json:"total"`
+	Used          uint64      `json:"used"`
+	Limit         uint64      `json:"limit"`
+	LowLimit      uint64      `json:"low_limit"`
+	Projected     uint64      `json:"projected"`
+	ProjectedFill float64     `json:"projected_fill"`
+}
+
+// DryRun works out what a sync from src into tgt would do right now without modifying the target.
+// Deletions are the units past their retention max_age, evictions are the units the policy would drop
+// to fit the copies. tgt is modified in memory and should not be reused.
+func (e *Evictor) DryRun(src, tgt *FileTree, maxFileSemaphore chan struct{}) (*SyncPlan, error) {
+
+	usage, err := e.Usage(tgt.Root.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s", err.Error(), tgt.Root.Path)
+	}
+
+	sp := &SyncPlan{
+		Source: src.Root.Path,
+		Target: tgt.Root.Path,
+		Policy: e.Policy.Name(),
+		Copy:   make([]PlanEntry, 0),
+		Evict:  make([]PlanEntry, 0),
+		Delete: make([]PlanEntry, 0),
+		Skip:   make([]PlanEntry, 0),
+		Total:  usage.Total,
+		Used:   usage.Used,
+	}
+
+	// Retention runs before anything is admitted, so its deletions free space for the plan
+	for _, unit := range Expired(src, tgt, e.cfg.Retention, time.Now()) {
+		size := unit.Size()
+		sp.Delete = append(sp.Delete, PlanEntry{Path: tgt.RelBaseFile(unit.Path), Size: size, Reason: "retention max_age"})
+		sp.DeleteBytes += size
+		tgt.detach(unit)
+	}
+
+	afterRetention := *usage
+	afterRetention.Used -= min(sp.DeleteBytes, usage.Used)
+	afterRetention.Free += sp.DeleteBytes
+
+	missing := src.MissingIn(tgt, maxFileSemaphore, nil)
+	plan := e.plan(src, tgt, NewAdmissionQueue(src, missing), &afterRetention)
+
+	for _, a := range plan.Admitted {
+		sp.Copy = append(sp.Copy, PlanEntry{Path: a.RelPath, Size: a.Size})
+		sp.CopyBytes += a.Size
+	}
+
+	for _, a := range plan.Skipped {
+		sp.Skip = append(sp.Skip, PlanEntry{Path: a.RelPath, Size: a.Size, Reason: a.Reason})
+	}
+
+	for _, unit := range plan.Evict {
+		size := unit.Size()
+		sp.Evict = append(sp.Evict, PlanEntry{Path: tgt.RelBaseFile(unit.Path), Size: size, Reason: e.Policy.Name()})
+		sp.EvictBytes += size
+	}
+
+	sp.Limit, sp.LowLimit, sp.Projected = plan.Limit, plan.LowLimit, plan.Projected
+	if sp.Total > 0 {
+		sp.ProjectedFill = float64(sp.Projected) / float64(sp.Total)
+	}
+
+	return sp, nil
+}
+
+// WriteText writes the plan to w in a human readable form
+func (sp *SyncPlan) WriteText(w io.Writer) {
+	section := func(title string, entries []PlanEntry, total uint64, color func(a ...interface{}) string) {
+		fmt.Fprintf(w, "%s %d units, %s\n", color(title), len(entries), util.BytesToString(total))
+		for _, entry := range entries {
+			if entry.Reason != "" {
+				fmt.Fprintf(w, "  %-10s %s (%s)\n", util.BytesToString(entry.Size), entry.Path, entry.Reason)
+			} else {
+				fmt.Fprintf(w, "  %-10s %s\n", util.BytesToString(entry.Size), entry.Path)
+			}
+		}
+	}
+
+	var skipped uint64
+	for _, entry := range sp.Skip {
+		skipped += entry.Size
+	}
+
+	fmt.Fprintf(w, "Plan for %s -> %s (%s policy)\n", sp.Source, sp.Target, sp.Policy)
+	section("Copy  :", sp.Copy, sp.CopyBytes, util.CreateColor)
+	section("Evict :", sp.Evict, sp.EvictBytes, util.RemoveColor)
+	section("Delete:", sp.Delete, sp.DeleteBytes, util.RemoveColor)
+	section("Skip  :", sp.Skip, skipped, util.RenameColor)
+	fmt.Fprintf(w, "Target usage %s -> %s of %s (%.2f projected fill, high %s, low %s)\n",
+		util.BytesToString(sp.Used), util.BytesToString(sp.Projected), util.BytesToString(sp.Total),
+		sp.ProjectedFill, util.BytesToString(sp.Limit), util.BytesToString(sp.LowLimit))
+}
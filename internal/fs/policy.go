@@ -0,0 +1,204 @@
+package fs
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy decides which managed files on the target are dropped first once it is over budget.
+// Candidates returns the managed units of tgt ordered from first to last evicted, pinned units are
+// left out. It only reads the trees so a policy can be tested against in-memory FileNodes.
+type EvictionPolicy interface {
+	Name() string
+	Candidates(src, tgt *FileTree) []*FileNode
+}
+
+// Returns the eviction policy registered under name, see the eviction_policy key in filo.toml
+func NewEvictionPolicy(name string, tracker *AccessTracker) (EvictionPolicy, error) {
+	switch name {
+	case "", "filo":
+		return FILOPolicy{}, nil
+	case "lru":
+		return LRUPolicy{}, nil
+	case "lfu":
+		if tracker == nil {
+			tracker = NewAccessTracker()
+		}
+		return LFUPolicy{Tracker: tracker}, nil
+	case "largest":
+		return LargestPolicy{}, nil
+	case "score":
+		return ScorePolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction_policy '%s', expected one of filo, lru, lfu, largest, score", name)
+	}
+}
+
+// Returns the counterpart of the target node tgtNode in src
+func sourceNode(src, tgt *FileTree, tgtNode *FileNode) *FileNode {
+	return src.Index[filepath.Join(src.Root.Path, tgt.RelBaseFile(tgtNode.Path))]
+}
+
+// Returns the last access time of n, the zero time if it cannot be read.
+// For directories this is the most recent access of any file below n.
+func nodeAccessTime(n *FileNode) time.Time {
+	if n == nil || n.Entry == nil {
+		return time.Time{}
+	}
+
+	if n.Entry.IsDir() {
+		var newest time.Time
+		for _, c := range n.Children {
+			if at := nodeAccessTime(c); at.After(newest) {
+				newest = at
+			}
+		}
+		return newest
+	}
+
+	info, err := n.Entry.Info()
+	if err != nil {
+		slog.Error(err.Error())
+		return time.Time{}
+	}
+
+	return AccessTime(info)
+}
+
+// Sorts the managed units in tgt by the priority of their source, lowest first, and then by key. Ties are
+// broken by path so the order is stable between passes. Units holding a pinned file are never candidates.
+func sortedCandidates[K any](src, tgt *FileTree, key func(tgtNode *FileNode) K, cmp func(this, that K) int) []*FileNode {
+	managed := slices.DeleteFunc(managedUnits(src, tgt), func(n *FileNode) bool { return unitPinned(src, tgt, n) })
+	keys := make(map[*FileNode]K, len(managed))
+	priorities := make(map[*FileNode]int, len(managed))
+	for _, n := range managed {
+		keys[n] = key(n)
+		priorities[n] = unitPriority(sourceNode(src, tgt, n))
+	}
+
+	slices.SortFunc(managed, func(this, that *FileNode) int {
+		if c := priorities[this] - priorities[that]; c != 0 {
+			return c
+		}
+
+		if c := cmp(keys[this], keys[that]); c != 0 {
+			return c
+		}
+		return strings.Compare(this.Path, that.Path)
+	})
+
+	return managed
+}
+
+// FILOPolicy evicts the files with the oldest source mtime first. The source mtime is used because
+// the target mtime is the time the file was copied.
+type FILOPolicy struct{}
+
+func (FILOPolicy) Name() string { return "filo" }
+
+func (FILOPolicy) Candidates(src, tgt *FileTree) []*FileNode {
+	return sortedCandidates(src, tgt, func(n *FileNode) time.Time {
+		return sourceNode(src, tgt, n).ModTime()
+	}, time.Time.Compare)
+}
+
+// LRUPolicy evicts the files on the target that were accessed least recently first
+type LRUPolicy struct{}
+
+func (LRUPolicy) Name() string { return "lru" }
+
+func (LRUPolicy) Candidates(src, tgt *FileTree) []*FileNode {
+	return sortedCandidates(src, tgt, nodeAccessTime, time.Time.Compare)
+}
+
+// LFUPolicy evicts the files on the target that were accessed the fewest times first.
+// Ties are evicted least recently accessed first.
+type LFUPolicy struct {
+	Tracker *AccessTracker
+}
+
+func (LFUPolicy) Name() string { return "lfu" }
+
+func (p LFUPolicy) Candidates(src, tgt *FileTree) []*FileNode {
+	p.Tracker.Observe(tgt)
+
+	type usage struct {
+		count  uint64
+		access time.Time
+	}
+
+	return sortedCandidates(src, tgt, func(n *FileNode) usage {
+		var count uint64
+		for _, f := range n.Files() {
+			count += p.Tracker.Count(tgt.RelBaseFile(f.Path))
+		}
+		return usage{count: count, access: nodeAccessTime(n)}
+	}, func(this, that usage) int {
+		switch {
+		case this.count < that.count:
+			return -1
+		case this.count > that.count:
+			return 1
+		}
+		return this.access.Compare(that.access)
+	})
+}
+
+// LargestPolicy evicts the largest files first, freeing the most space with the fewest removals
+type LargestPolicy struct{}
+
+func (LargestPolicy) Name() string { return "largest" }
+
+func (LargestPolicy) Candidates(src, tgt *FileTree) []*FileNode {
+	return sortedCandidates(src, tgt, (*FileNode).Size, func(this, that uint64) int {
+		switch {
+		case this > that:
+			return -1
+		case this < that:
+			return 1
+		}
+		return 0
+	})
+}
+
+// AccessTracker counts how often files on the target are accessed. The filesystem only keeps the last
+// access time, so each Observe compares the atime of every file with the one seen on the previous
+// Observe and counts a hit when it moved forward. Counts are keyed by path relative to the target root.
+type AccessTracker struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	counts map[string]uint64
+}
+
+func NewAccessTracker() *AccessTracker {
+	return &AccessTracker{seen: make(map[string]time.Time), counts: make(map[string]uint64)}
+}
+
+func (a *AccessTracker) Observe(tgt *FileTree) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for tgtPath, n := range tgt.Index {
+		if n.Entry == nil || n.Entry.IsDir() {
+			continue
+		}
+
+		relPath := tgt.RelBaseFile(tgtPath)
+		accessed := nodeAccessTime(n)
+		if last, ok := a.seen[relPath]; ok && accessed.After(last) {
+			a.counts[relPath]++
+		}
+		a.seen[relPath] = accessed
+	}
+}
+
+func (a *AccessTracker) Count(relPath string) uint64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.counts[relPath]
+}
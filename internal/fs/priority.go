@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"errors"
+	"log/slog"
+	"path/filepath"
+	"time"
+)
+
+// WatchState is what the media servers report about a file, set by a Prioritizer along with
+// FileNode.Priority and read by Scorer
+type WatchState struct {
+	Rank       int // priority given by the media servers, FileNode.Priority before it is scored
+	Favorite   bool
+	PlayCount  int // across every user
+	LastPlayed time.Time
+	Users      []string // media server users, server/name, whose in-progress, next up or favorite items cover the file
+}
+
+// Prioritizer ranks the nodes of a freshly built source tree by setting FileNode.Priority on its files,
+// i.e from the watch history of a media server
+type Prioritizer interface {
+	Prioritize(src *FileTree) error
+}
+
+// Prioritizers runs each Prioritizer in turn, i.e one ranking the source and one pinning media server
+// collections. Every Prioritizer runs even when one before it fails.
+type Prioritizers []Prioritizer
+
+func (p Prioritizers) Prioritize(src *FileTree) error {
+	var errs []error
+	for _, prioritizer := range p {
+		if err := prioritizer.Prioritize(src); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the highest priority of the files in n, 0 when n holds no files
+func unitPriority(n *FileNode) int {
+	files := n.Files()
+	if len(files) == 0 {
+		return 0
+	}
+
+	priority := files[0].Priority
+	for _, f := range files[1:] {
+		priority = max(priority, f.Priority)
+	}
+	return priority
+}
+
+// Prioritize ranks the files of src with the Prioritizer of e, if any, and then scores them with the Scorer
+// of e, if any. src is left unranked by a Prioritizer that fails.
+func (e *Evictor) Prioritize(src *FileTree) {
+	if e.Prioritizer != nil {
+		if err := e.Prioritizer.Prioritize(src); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+
+	if e.Scorer != nil {
+		e.Scorer.Prioritize(src)
+	}
+}
+
+// rank is what a Prioritizer set on a node, kept while the node is walked again, see Evictor.rerank
+type rank struct {
+	watch  WatchState
+	pinned bool
+}
+
+// Returns the nodes of ft at and below paths, absolute paths in the tree
+func (ft *FileTree) nodesBelow(paths []string) []*FileNode {
+	nodes := make([]*FileNode, 0)
+	var walk func(n *FileNode)
+	walk = func(n *FileNode) {
+		nodes = append(nodes, n)
+		for _, c := range n.Children {
+			walk(c)
+		}
+	}
+
+	for _, p := range topPaths(paths) {
+		if n, ok := ft.Index[filepath.Clean(p)]; ok {
+			walk(n)
+		}
+	}
+	return nodes
+}
+
+// Returns the ranks of the nodes of src at and below paths by path, to be given back by rerank once
+// they are walked again
+func ranksBelow(src *FileTree, paths []string) map[string]rank {
+	ranks := make(map[string]rank)
+	for _, n := range src.nodesBelow(paths) {
+		ranks[n.Path] = rank{watch: n.Watch, pinned: n.Pinned}
+	}
+	return ranks
+}
+
+// rerank gives the nodes of src at and below paths, just walked again, the ranks they had in ranks and
+// scores them with the Scorer of e, if any. The Prioritizer is not run, nodes new to src are left unranked
+// by it until the next Prioritize.
+func (e *Evictor) rerank(src *FileTree, paths []string, ranks map[string]rank) {
+	for _, n := range src.nodesBelow(paths) {
+		if r, ok := ranks[n.Path]; ok {
+			n.Watch = r.watch
+			n.Pinned = n.Pinned || r.pinned
+		}
+		// Below a directory pinned by a collection, walked before the directory got its pin back
+		n.Pinned = n.Pinned || n.Parent != nil && n.Parent.Pinned
+
+		if n.Entry != nil && !n.Entry.IsDir() {
+			n.Priority = n.Watch.Rank
+		}
+		if e.Scorer != nil {
+			e.Scorer.prioritize(n)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// fileID identifies a file on its device, it is kept across a rename
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// identity is what a source node looked like when it was last seen on disk. Directories are compared on
+// their own size and mtime, neither changes when a file below them does nor when they are renamed.
+type identity struct {
+	id      fileID
+	size    int64
+	modTime time.Time
+}
+
+// Returns true when i and other are the same file with the same size and mtime
+func (i identity) same(other identity) bool {
+	return i.id == other.id && i.size == other.size && i.modTime.Equal(other.modTime)
+}
+
+// Snapshot holds the identities of the nodes of a source tree by their path relative to the root. It is
+// taken while the nodes are still at those paths, so a renamed node is recognised at its new one.
+type Snapshot map[string]identity
+
+// Returns the identity of info, false when its inode is unavailable
+func infoIdentity(info fs.FileInfo) (identity, bool) {
+	id, ok := fileIdentity(info)
+	if !ok {
+		return identity{}, false
+	}
+	return identity{id: id, size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// Returns the identity of n, false when it cannot be read
+func nodeIdentity(n *FileNode) (identity, bool) {
+	if n == nil || n.Entry == nil {
+		return identity{}, false
+	}
+
+	info, err := n.Entry.Info()
+	if err != nil {
+		slog.Error(err.Error())
+		return identity{}, false
+	}
+	return infoIdentity(info)
+}
+
+// Returns the identity of the file at path, false when it cannot be read
+func pathIdentity(path string) (identity, bool) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return identity{}, false
+	}
+	return infoIdentity(info)
+}
+
+// Snapshot returns the identities of the nodes of ft, nodes without an inode are left out
+func (ft *FileTree) Snapshot() Snapshot {
+	snapshot := make(Snapshot, len(ft.Index))
+	for path, n := range ft.Index {
+		if id, ok := nodeIdentity(n); ok {
+			snapshot[ft.RelBaseFile(path)] = id
+		}
+	}
+	return snapshot
+}
+
+// Calls fn on n and everything below it
+func walkNodes(n *FileNode, fn func(n *FileNode)) {
+	fn(n)
+	for _, c := range n.Children {
+		walkNodes(c, fn)
+	}
+}
+
+// Drops the identities of the node of src at path and everything below it, before src is patched
+func (s Snapshot) forget(src *FileTree, path string) {
+	if n := src.Index[filepath.Clean(path)]; n != nil {
+		walkNodes(n, func(n *FileNode) { delete(s, src.RelBaseFile(n.Path)) })
+	}
+}
+
+// Takes the identities of the node of src at path, everything below it and the directory holding it, whose
+// mtime moved along, once src is patched
+func (s Snapshot) remember(src *FileTree, path string) {
+	path = filepath.Clean(path)
+	if n := src.Index[path]; n != nil {
+		walkNodes(n, func(n *FileNode) {
+			if id, ok := nodeIdentity(n); ok {
+				s[src.RelBaseFile(n.Path)] = id
+			}
+		})
+	}
+
+	if parent := src.parentNode(path); parent != nil && parent != src.Root {
+		if id, ok := nodeIdentity(parent); ok {
+			s[src.RelBaseFile(parent.Path)] = id
+		}
+	}
+}
+
+// Rename is a source node moved from From to To, both absolute paths in the source
+type Rename struct {
+	From string
+	To   string
+}
+
+// Returns true when path is below dir
+func isBelow(path, dir string) bool {
+	return strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// Pairs renamed, the source paths of RENAME events, with created, the source paths of CREATE events. A pair
+// is confirmed when the file at the created path has the size, mtime and inode the renamed path had in
+// before. Paths below a renamed directory are left to it. Returns the pairs and the renamed paths left unmatched.
+func pairRenames(renamed, created []string, before Snapshot, src *FileTree) ([]Rename, []string) {
+	pairs := make([]Rename, 0)
+	unmatched := make([]string, 0)
+	used := make(map[string]bool)
+
+	for _, from := range topPaths(renamed) {
+		old, ok := before[src.RelBaseFile(from)]
+		i := -1
+		if ok {
+			i = slices.IndexFunc(created, func(to string) bool {
+				id, found := pathIdentity(to)
+				return !used[to] && found && id.same(old)
+			})
+		}
+
+		if i < 0 {
+			unmatched = append(unmatched, from)
+			continue
+		}
+		pairs = append(pairs, Rename{From: from, To: created[i]})
+		used[created[i]] = true
+	}
+
+	return pairs, unmatched
+}
+
+// Renames the target counterparts of renames inside the target root and moves their nodes in tgt. Renames
+// whose source is not on the target are skipped. Returns the target paths renamed, before and after, and the source paths whose rename
+// failed or whose new path is already taken on the target.
+func syncRenames(renames []Rename, src, tgt *FileTree) ([]string, []string) {
+	tgtRoot, err := os.OpenRoot(tgt.Root.Path)
+	if err != nil {
+		slog.Error(err.Error())
+		failed := make([]string, 0, len(renames))
+		for _, r := range renames {
+			failed = append(failed, r.From)
+		}
+		return nil, failed
+	}
+	defer tgtRoot.Close()
+
+	changed := make([]string, 0)
+	failed := make([]string, 0)
+	for _, r := range renames {
+		fromRel, toRel := src.RelBaseFile(r.From), src.RelBaseFile(r.To)
+		if !filepath.IsLocal(fromRel) || !filepath.IsLocal(toRel) {
+			slog.Info(fmt.Sprintf("failed to rename %s to %s", r.From, r.To))
+			failed = append(failed, r.From)
+			continue
+		}
+
+		if _, ok := tgt.Index[filepath.Join(tgt.Root.Path, fromRel)]; !ok {
+			slog.Debug(fmt.Sprintf("%s is not in %s, nothing to rename", fromRel, tgt.Root.Path))
+			continue
+		}
+
+		if _, err := tgtRoot.Lstat(toRel); !errors.Is(err, os.ErrNotExist) {
+			slog.Warn(fmt.Sprintf("%s already exists in %s, removing %s instead of renaming it", toRel, tgt.Root.Path, fromRel))
+			failed = append(failed, r.From)
+			continue
+		}
+
+		if dir := filepath.Dir(toRel); dir != "." {
+			if err := tgtRoot.MkdirAll(dir, 0755); err != nil {
+				slog.Error(err.Error())
+				failed = append(failed, r.From)
+				continue
+			}
+		}
+
+		if err := tgtRoot.Rename(fromRel, toRel); err != nil {
+			slog.Error(err.Error())
+			failed = append(failed, r.From)
+			continue
+		}
+
+		slog.Info(fmt.Sprintf("%s successfully renamed to %s in %s", fromRel, toRel, tgt.Root.Path))
+		tgtFrom, tgtTo := filepath.Join(tgt.Root.Path, fromRel), filepath.Join(tgt.Root.Path, toRel)
+		if _, err := tgt.MoveNode(tgtFrom, tgtTo); err != nil {
+			slog.Error(err.Error())
+		}
+		changed = append(changed, tgtFrom, tgtTo)
+	}
+
+	return changed, failed
+}
+
+// SyncRenames pairs renamed, the source paths of RENAME events, with created, the source paths of CREATE
+// events, and renames the target counterparts of the pairs confirmed against before, see Snapshot. Returns
+// the target paths renamed and the renamed source paths to be treated as removals.
+func SyncRenames(renamed, created []string, before Snapshot, src, tgt *FileTree) ([]string, []string) {
+	pairs, unmatched := pairRenames(renamed, created, before, src)
+	changed, failed := syncRenames(pairs, src, tgt)
+	return changed, append(unmatched, failed...)
+}
@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+)
+
+// Returns the first retention rule matching relPath or one of its parent directories, nil if none match
+func retentionRule(rules []config.RetentionRule, relPath string) *config.RetentionRule {
+	for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		for i, rule := range rules {
+			if matchAny([]string{rule.Path}, p) {
+				return &rules[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the unit at relPath, last modified at modTime on the source, is past its retention max_age
+func isExpired(rules []config.RetentionRule, relPath string, modTime time.Time, now time.Time) bool {
+	rule := retentionRule(rules, relPath)
+	return rule != nil && rule.MaxAge > 0 && now.Sub(modTime) > rule.MaxAge
+}
+
+// Expired returns the managed units of tgt covered by a retention rule whose source mtime is older
+// than the max_age of the rule. Pinned units never expire.
+func Expired(src, tgt *FileTree, rules []config.RetentionRule, now time.Time) []*FileNode {
+	expired := make([]*FileNode, 0)
+	if len(rules) == 0 {
+		return expired
+	}
+
+	for _, unit := range managedUnits(src, tgt) {
+		if unitPinned(src, tgt, unit) {
+			continue
+		}
+
+		if isExpired(rules, tgt.RelBaseFile(unit.Path), sourceNode(src, tgt, unit).ModTime(), now) {
+			expired = append(expired, unit)
+		}
+	}
+
+	return expired
+}
+
+// ApplyRetention removes the expired units from tgt, see Expired, and records them in journal.
+// Returns the units that were removed.
+func ApplyRetention(src, tgt *FileTree, rules []config.RetentionRule, now time.Time, journal *Journal) []*FileNode {
+	expired := Expired(src, tgt, rules, now)
+	if len(expired) == 0 {
+		return nil
+	}
+
+	tgtRoot, err := os.OpenRoot(tgt.Root.Path)
+	if err != nil {
+		slog.Error(err.Error())
+		return nil
+	}
+	defer tgtRoot.Close()
+
+	removed := make([]*FileNode, 0, len(expired))
+	for _, unit := range expired {
+		relBaseFile := tgt.RelBaseFile(unit.Path)
+		if !filepath.IsLocal(relBaseFile) {
+			slog.Info(fmt.Sprintf("failed to delete %s", unit.Path))
+			continue
+		}
+
+		entries := journal.Entries(src, tgt, unit, ReasonExpired, "")
+		if err := tgtRoot.RemoveAll(relBaseFile); err != nil {
+			slog.Error(err.Error())
+			continue
+		}
+
+		if _, err := tgtRoot.Lstat(relBaseFile); errors.Is(err, os.ErrNotExist) {
+			slog.Info(fmt.Sprintf("%s expired and was deleted from %s", relBaseFile, tgt.Root.Path))
+			journal.Record(entries)
+			tgt.detach(unit)
+			removed = append(removed, unit)
+		} else {
+			slog.Error(err.Error())
+		}
+	}
+
+	return removed
+}
@@ -0,0 +1,266 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/util"
+)
+
+// The recency factor halves every recencyHalfLife since a file was last watched or its target copy accessed
+const recencyHalfLife = 7 * 24 * time.Hour
+
+// Factor is one weighted term of a composite score
+type Factor struct {
+	Name   string  `json:"name"`
+	Value  float64 `json:"value"`
+	Weight float64 `json:"weight"`
+}
+
+// Contribution returns what f adds to the score
+func (f Factor) Contribution() float64 {
+	return f.Value * f.Weight
+}
+
+// Score is the composite score of a node and the factors it is made of
+type Score struct {
+	Factors []Factor `json:"factors"`
+}
+
+// Total returns the sum of the contributions of every factor
+func (s Score) Total() float64 {
+	var total float64
+	for _, f := range s.Factors {
+		total += f.Contribution()
+	}
+	return total
+}
+
+// Scorer ranks the files of the source tree by a weighted sum of recency, pin state, favorites, watch
+// count, size and age, see config.ScoreWeights. The media server priority of a file, WatchState.Rank, is
+// one more factor so the scores stay comparable with and without media servers.
+type Scorer struct {
+	Weights config.ScoreWeights
+	Now     time.Time // time the factors are computed at, the current time when zero
+	Target  string    // target_dir, files never played count as watched when their copy there was last accessed
+}
+
+// Returns the time s scores at
+func (s *Scorer) now() time.Time {
+	if s.Now.IsZero() {
+		return time.Now()
+	}
+	return s.Now
+}
+
+// Score returns the composite score of n. For directories the files below n are taken as a whole, the
+// most recent and highest ranked of them count and their plays and sizes add up.
+func (s *Scorer) Score(n *FileNode) Score {
+	var lastWatched time.Time
+	var pinned, favorite bool
+	var plays int
+	rank := math.MinInt
+	for _, f := range n.Files() {
+		at := f.Watch.LastPlayed
+		if at.IsZero() {
+			at = s.targetAccessTime(f)
+		}
+		if at.After(lastWatched) {
+			lastWatched = at
+		}
+		pinned = pinned || f.Pinned
+		favorite = favorite || f.Watch.Favorite
+		plays += f.Watch.PlayCount
+		rank = max(rank, f.Watch.Rank)
+	}
+
+	if rank == math.MinInt {
+		rank = 0
+	}
+
+	now := s.now()
+	recency := 0.0
+	if !lastWatched.IsZero() {
+		recency = math.Pow(0.5, max(now.Sub(lastWatched), 0).Hours()/recencyHalfLife.Hours())
+	}
+
+	boolValue := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+
+	return Score{Factors: []Factor{
+		{Name: "recency", Value: recency, Weight: s.Weights.Recency},
+		{Name: "pinned", Value: boolValue(pinned), Weight: s.Weights.Pinned},
+		{Name: "favorite", Value: boolValue(favorite), Weight: s.Weights.Favorite},
+		{Name: "watch_count", Value: float64(plays), Weight: s.Weights.WatchCount},
+		{Name: "size", Value: float64(n.Size()) / (1 << 30), Weight: s.Weights.Size},
+		{Name: "age", Value: max(now.Sub(n.ModTime()), 0).Hours() / 24, Weight: s.Weights.Age},
+		{Name: "rank", Value: float64(rank) / 100, Weight: s.Weights.Rank},
+	}}
+}
+
+// Returns the last access time of the target copy of the source file f, the zero time when it is not on the
+// target. The source atime is never used, filo moves it whenever it compares, copies or restores a file.
+func (s *Scorer) targetAccessTime(f *FileNode) time.Time {
+	if s.Target == "" {
+		return time.Time{}
+	}
+
+	root := f
+	for root.Parent != nil {
+		root = root.Parent
+	}
+
+	relPath, err := filepath.Rel(root.Path, f.Path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(filepath.Join(s.Target, relPath))
+	if err != nil {
+		return time.Time{}
+	}
+	return AccessTime(info)
+}
+
+// Prioritize sets FileNode.Priority on every file of src to its score rounded to an integer, see Prioritizer
+func (s *Scorer) Prioritize(src *FileTree) error {
+	for _, n := range src.Index {
+		s.prioritize(n)
+	}
+	return nil
+}
+
+// Sets FileNode.Priority on n to its score rounded to an integer, directories are left alone
+func (s *Scorer) prioritize(n *FileNode) {
+	if n.Entry != nil && !n.Entry.IsDir() {
+		n.Priority = int(math.Round(s.Score(n).Total()))
+	}
+}
+
+// ScorePolicy evicts the units with the lowest composite score first, see Scorer. The score is the
+// priority of the units, ties are evicted oldest source mtime first like FILOPolicy.
+type ScorePolicy struct{}
+
+func (ScorePolicy) Name() string { return "score" }
+
+func (ScorePolicy) Candidates(src, tgt *FileTree) []*FileNode {
+	return FILOPolicy{}.Candidates(src, tgt)
+}
+
+// Explanation is why a node of the source is or is not on the target, see Explain
+type Explanation struct {
+	Path       string `json:"path"`
+	Unit       string `json:"unit"` // unit the node is admitted and evicted with
+	Score      Score  `json:"score"`
+	Priority   int    `json:"priority"` // priority of the unit, see Admission.Priority
+	Policy     string `json:"policy"`
+	OnTarget   bool   `json:"on_target"`
+	Action     string `json:"action"` // what the next sync would do to the unit: copy, evict, delete, skip, keep or none
+	Status     string `json:"status"`
+	Position   int    `json:"position"` // 1 when the unit is the first eviction candidate, 0 when it is not a candidate
+	Candidates int    `json:"candidates"`
+}
+
+// Explain works out the score of the node at relPath in src, the position of its unit in eviction order
+// and what a sync would do to it right now, see DryRun. The score is computed with the Scorer of e, or
+// with the weights of filo.toml when the policy is not score. tgt is modified in memory and should not
+// be reused.
+func (e *Evictor) Explain(src, tgt *FileTree, relPath string, maxFileSemaphore chan struct{}) (*Explanation, error) {
+	n := src.Index[filepath.Join(src.Root.Path, relPath)]
+	if n == nil || n.Entry == nil {
+		return nil, fmt.Errorf("%s is not in %s", relPath, src.Root.Path)
+	}
+
+	scorer := e.Scorer
+	if scorer == nil {
+		scorer = &Scorer{Weights: e.cfg.Score, Target: e.cfg.TargetDir}
+	}
+
+	unit := src.UnitOf(n)
+	ex := &Explanation{
+		Path:     src.RelBaseFile(n.Path),
+		Unit:     src.RelBaseFile(unit.Path),
+		Score:    scorer.Score(n),
+		Priority: unitPriority(unit),
+		Policy:   e.Policy.Name(),
+	}
+	if hasPinned(unit) {
+		ex.Priority = PinnedPriority
+	}
+
+	tgtUnit := tgt.Index[filepath.Join(tgt.Root.Path, ex.Unit)]
+	ex.OnTarget = tgt.Index[filepath.Join(tgt.Root.Path, ex.Path)] != nil
+
+	candidates := e.Policy.Candidates(src, tgt)
+	ex.Candidates = len(candidates)
+	if i := slices.Index(candidates, tgtUnit); tgtUnit != nil && i >= 0 {
+		ex.Position = i + 1
+	}
+
+	plan, err := e.DryRun(src, tgt, maxFileSemaphore)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := func(entries []PlanEntry) (PlanEntry, bool) {
+		i := slices.IndexFunc(entries, func(entry PlanEntry) bool { return entry.Path == ex.Unit })
+		if i < 0 {
+			return PlanEntry{}, false
+		}
+		return entries[i], true
+	}
+
+	if _, ok := planned(plan.Evict); ok {
+		ex.Action, ex.Status = "evict", "admitted, would be evicted by the next sync"
+	} else if entry, ok := planned(plan.Delete); ok {
+		ex.Action, ex.Status = "delete", fmt.Sprintf("admitted, would be deleted by the next sync (%s)", entry.Reason)
+	} else if _, ok := planned(plan.Copy); ok {
+		ex.Action, ex.Status = "copy", "not admitted, would be copied by the next sync"
+	} else if entry, ok := planned(plan.Skip); ok {
+		ex.Action, ex.Status = "skip", fmt.Sprintf("not admitted, would be skipped by the next sync (%s)", entry.Reason)
+	} else if ex.OnTarget {
+		ex.Action, ex.Status = "keep", "admitted, kept by the next sync"
+	} else {
+		ex.Action, ex.Status = "none", "not admitted"
+	}
+
+	return ex, nil
+}
+
+// WriteText writes the explanation to w in a human readable form
+func (ex *Explanation) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s", ex.Path)
+	if ex.Unit != ex.Path {
+		fmt.Fprintf(w, " (unit %s)", ex.Unit)
+	}
+	fmt.Fprintln(w)
+
+	for _, f := range ex.Score.Factors {
+		fmt.Fprintf(w, "  %-12s %10.2f x %8.2f = %10.2f\n", f.Name, f.Value, f.Weight, f.Contribution())
+	}
+	fmt.Fprintf(w, "  %-12s %34.2f\n", "score", ex.Score.Total())
+
+	fmt.Fprintf(w, "Priority %d, %s policy\n", ex.Priority, ex.Policy)
+	if ex.Position > 0 {
+		fmt.Fprintf(w, "Eviction candidate %d of %d\n", ex.Position, ex.Candidates)
+	}
+
+	color := util.CreateColor
+	switch ex.Action {
+	case "evict", "delete":
+		color = util.RemoveColor
+	case "skip", "none":
+		color = util.RenameColor
+	}
+	fmt.Fprintf(w, "Status: %s\n", color(ex.Status))
+}
@@ -4,29 +4,35 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
 	"os"
 	"path/filepath"
-	"sync"
+	"slices"
+	"strings"
 	"time"
 
 	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/util"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-func syncRemove(filesRemoved []string, src *FileTree, tgt *FileTree) {
+// Removes the target counterparts of the files removed from src, from disk and from tgt. Returns the target
+// paths removed.
+func syncRemove(filesRemoved []string, src *FileTree, tgt *FileTree, journal *Journal) []string {
 
 	tgtRoot, err := os.OpenRoot(tgt.Root.Path)
 	if err != nil {
 		slog.Error(err.Error())
-		return
+		return nil
 	}
 	defer tgtRoot.Close()
 
+	removed := make([]string, 0, len(filesRemoved))
 	for _, fileRemoved := range filesRemoved {
 		relBaseFile := src.RelBaseFile(fileRemoved)
 		tgtFilePath := filepath.Join(tgt.Root.Path, relBaseFile)
-		_, ok := tgt.Index[tgtFilePath]
+		tgtNode, ok := tgt.Index[tgtFilePath]
 		if !ok {
 			slog.Error(fmt.Sprintf("removed filepath '%s' missing from tgt.Index, skipping", tgtFilePath))
 			continue
@@ -34,6 +40,7 @@ func syncRemove(filesRemoved []string, src *FileTree, tgt *FileTree) {
 
 		if filepath.IsLocal(relBaseFile) {
 
+			entries := journal.Entries(src, tgt, tgtNode, ReasonRemoved, "")
 			if err := tgtRoot.RemoveAll(relBaseFile); err != nil {
 				slog.Error(err.Error())
 				continue
@@ -41,6 +48,9 @@ func syncRemove(filesRemoved []string, src *FileTree, tgt *FileTree) {
 
 			if _, err := tgtRoot.Lstat(relBaseFile); errors.Is(err, os.ErrNotExist) {
 				slog.Info(fmt.Sprintf("%s successfully deleted from %s", relBaseFile, tgt.Root.Path))
+				journal.Record(entries)
+				tgt.RemoveNode(tgtFilePath)
+				removed = append(removed, tgtFilePath)
 			} else {
 				slog.Error(err.Error())
 			}
@@ -50,18 +60,198 @@ func syncRemove(filesRemoved []string, src *FileTree, tgt *FileTree) {
 		}
 	}
 
+	return removed
 }
 
-// Sync maintains 2 directories that should be the same.
-func SyncChanges(eventChan <-chan fsnotify.Event, exit chan struct{}, maxFileSemaphore chan struct{}, cfg *config.Config) {
+// ChangedDirs returns the target directories holding paths, the target files a sync copied or removed,
+// leaving out the directories below another one of them
+func ChangedDirs(paths []string) []string {
+	dirs := make([]string, 0)
+	for _, p := range paths {
+		if dir := filepath.Dir(p); !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	slices.Sort(dirs)
+
+	// Sorted, a directory comes before the ones below it
+	result := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if !slices.ContainsFunc(result, func(parent string) bool {
+			return strings.HasPrefix(dir, parent+string(filepath.Separator))
+		}) {
+			result = append(result, dir)
+		}
+	}
+	return result
+}
+
+// Returns the target paths a sync copied or removed through plan, pass and removed, any of them may be nil
+func changedPaths(plan *AdmissionPlan, pass *EvictionPass, removed []*FileNode) []string {
+	paths := make([]string, 0)
+	if plan != nil {
+		paths = append(paths, plan.Copied...)
+	}
+	if pass != nil {
+		removed = append(removed, pass.Evicted...)
+	}
+	for _, n := range removed {
+		paths = append(paths, n.Path)
+	}
+	return paths
+}
+
+// Returns the admissions of queue for paths, absolute paths in the source: the units holding one of them
+// or below one of them. Units are admitted whole, a path inside a unit brings the rest of it along.
+func admissionsFor(queue []*Admission, paths []string) []*Admission {
+	selected := make([]*Admission, 0)
+	for _, a := range queue {
+		if slices.ContainsFunc(paths, func(p string) bool {
+			return a.Node.Path == p || isBelow(a.Node.Path, p) || isBelow(p, a.Node.Path)
+		}) {
+			selected = append(selected, a)
+		}
+	}
+	return selected
+}
+
+// Returns the source and target trees of cfg
+func buildTrees(cfg *config.Config) (*FileTree, *FileTree, error) {
+	srcFileTree, err := BuildTree(cfg.SourceDir, NewTreeOptions(cfg))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targetFileTree, err := BuildTree(cfg.TargetDir, NewTreeOptions(cfg))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if srcFileTree == nil || targetFileTree == nil {
+		return nil, nil, fmt.Errorf("failed to walk %s or %s", cfg.SourceDir, cfg.TargetDir)
+	}
+	return srcFileTree, targetFileTree, nil
+}
+
+// Sync maintains 2 directories that should be the same. Paths received on syncNow, i.e from webhooks,
+// are synced right away instead of waiting for sync_delay, only the units at or below them are admitted.
+// A nil syncNow is never read.
+// The target directories every sync changed are sent on changed, see ChangedDirs, unless it is nil. Syncs
+// never wait for it, directories it has not taken yet are merged and sent together.
+// src and tgt are the trees walked and ranked at startup, they are walked here when either is nil. Both are
+// then patched with the paths named by the events and the target paths each sync changed, the target is
+// expected to change through filo only. The source is ranked again every cfg.RankRefresh, nodes walked
+// again in between keep their ranks. Files still being written are held back by a WriteGate of
+// cfg.WriteQuiet and synced again once they may pass.
+func SyncChanges(src, tgt *FileTree, eventChan <-chan fsnotify.Event, syncNow <-chan []string, changed chan<- []string, exit chan struct{}, maxFileSemaphore chan struct{}, evictor *Evictor, cfg *config.Config) {
 	minInterval := cfg.SyncDelay
 
 	var lastEvent time.Time
-	var wg sync.WaitGroup
 	lastFSEvents := make(map[string][]string)
 
+	// Long-lived trees, walked again on the next sync when they cannot be walked now
+	srcFileTree, targetFileTree := src, tgt
+
+	// Identities of the source nodes as of the last sync, RENAME events are paired against them
+	var before Snapshot
+	if srcFileTree != nil && targetFileTree != nil {
+		before = srcFileTree.Snapshot()
+	}
+
+	trees := func() error {
+		if srcFileTree != nil && targetFileTree != nil {
+			return nil
+		}
+
+		var err error
+		if srcFileTree, targetFileTree, err = buildTrees(cfg); err != nil {
+			return err
+		}
+		before = srcFileTree.Snapshot()
+		evictor.Prioritize(srcFileTree)
+		return nil
+	}
+
+	if err := trees(); err != nil {
+		slog.Error(err.Error())
+	}
+
+	// Files held back have their directory watched for IN_CLOSE_WRITE, on Linux
+	gate := NewWriteGate(cfg.WriteQuiet)
+	var closes *closeWatcher
+	if gate != nil {
+		closes = newCloseWatcher()
+		defer closes.Close()
+	}
+	closeReady := closes.Ready()
+
+	// Walks the source again at paths, along with the identities of the nodes there. The nodes walked again
+	// keep their ranks, the media servers are only read again on rankTick.
+	patchSource := func(paths []string) {
+		paths = topPaths(paths)
+		ranks := ranksBelow(srcFileTree, paths)
+		for _, p := range paths {
+			before.forget(srcFileTree, p)
+		}
+		srcFileTree.patch(paths)
+		for _, p := range paths {
+			before.remember(srcFileTree, p)
+		}
+
+		evictor.rerank(srcFileTree, paths, ranks)
+	}
+
+	// Files held back by the gate are synced again as WRITE events once the earliest of them may pass
+	deferHeld := func(held []string, retry time.Time) {
+		if len(held) == 0 {
+			return
+		}
+
+		lastFSEvents["WRITE"] = append(lastFSEvents["WRITE"], held...)
+		if at := retry.Add(-minInterval); at.After(lastEvent) {
+			lastEvent = at
+		}
+		for _, p := range held {
+			closes.Add(filepath.Dir(p))
+		}
+		slog.Info(fmt.Sprintf("Holding back %d files still being written until %s", len(held), retry.Format(time.TimeOnly)))
+	}
+
+	// Target paths changed by syncs that changed has not taken yet. They are handed over while the loop
+	// waits for events, so a media server refresh in progress never holds up a sync.
+	var unsent, unsentDirs []string
+	notifyChanged := func(paths []string) {
+		if changed == nil || len(paths) == 0 {
+			return
+		}
+		unsent = append(unsent, paths...)
+		unsentDirs = ChangedDirs(unsent)
+	}
+
+	// Retention rules are applied on their own schedule, a nil channel never fires
+	var retentionTick <-chan time.Time
+	if len(cfg.Retention) > 0 && cfg.RetentionInterval > 0 {
+		retentionTicker := time.NewTicker(cfg.RetentionInterval)
+		defer retentionTicker.Stop()
+		retentionTick = retentionTicker.C
+	}
+
+	// The source is ranked again on its own schedule, reading the media servers can take up to their timeout
+	var rankTick <-chan time.Time
+	if (evictor.Prioritizer != nil || evictor.Scorer != nil) && cfg.RankRefresh > 0 {
+		rankTicker := time.NewTicker(cfg.RankRefresh)
+		defer rankTicker.Stop()
+		rankTick = rankTicker.C
+	}
+
 exitFor:
 	for {
+		// A nil channel is never sent on, nothing changed since changed last took the directories
+		var sendChanged chan<- []string
+		if len(unsentDirs) > 0 {
+			sendChanged = changed
+		}
+
 		select {
 		case e := <-eventChan:
 			fsAction, filePath := e.Op.String(), e.Name //CREATE, REMOVE, WRITE, etc | filePath (i.e /tmp/tempfile1.txt)
@@ -72,51 +262,75 @@ exitFor:
 			lastFSEvents[fsAction] = append(lastFSEvents[fsAction], filePath)
 			lastEvent = time.Now()
 
+		case _, ok := <-closeReady:
+			if !ok {
+				// The watcher stopped reading, a nil channel never fires
+				slog.Warn(fmt.Sprintf("IN_CLOSE_WRITE detection disabled, files are held back until unchanged for %s", cfg.WriteQuiet))
+				closeReady = nil
+				continue
+			}
+
+			now := time.Now()
+			closed, overflow := closes.Take()
+			if overflow {
+				// Closes were dropped, everything held back is let through rather than left to write_quiet
+				slog.Warn("IN_CLOSE_WRITE events overflowed, releasing every file held back")
+				closed = append(closed, gate.Holding()...)
+			}
+
+			// Written and closed, synced like WRITEs that may pass the gate right away
+			for _, p := range closed {
+				gate.Closed(p, now)
+			}
+			lastFSEvents["WRITE"] = append(lastFSEvents["WRITE"], closed...)
+			lastEvent = now
+
 		case <-time.After(minInterval):
 			if !lastEvent.IsZero() && time.Since(lastEvent) >= minInterval {
 
 				slog.Info(fmt.Sprintf("Syncing started: %v -> %v...", cfg.SourceDir, cfg.TargetDir))
 				syncTime := time.Now()
 
-				//Build Tree
-				srcFileTree, err := BuildTree(cfg.SourceDir)
-				if err != nil {
+				if err := trees(); err != nil {
 					slog.Error(err.Error())
 					close(exit)
 					break exitFor
 				}
 
-				targetFileTree, err := BuildTree(cfg.TargetDir)
-				if err != nil {
-					slog.Error(err.Error())
-					close(exit)
-					break exitFor
+				needsCopy := false
+				var plan *AdmissionPlan
+				var pass *EvictionPass
+				var removed, renamed, held []string
+				var retry time.Time
+				eventMap := lastFSEvents //parseFSEvents(lastFSEvents)
+
+				// Renamed before anything is copied so a moved node is not copied again under its new path,
+				// renames without a matching create were moved out of the source and are removed
+				if len(eventMap["RENAME"]) > 0 {
+					var unmatched []string
+					renamed, unmatched = SyncRenames(eventMap["RENAME"], eventMap["CREATE"], before, srcFileTree, targetFileTree)
+					if len(unmatched) > 0 {
+						eventMap["REMOVE"] = append(eventMap["REMOVE"], unmatched...)
+					}
 				}
 
-				eventMap := lastFSEvents //parseFSEvents(lastFSEvents)
+				// Only the subtrees named by the events are walked again
+				patchSource(slices.Concat(slices.Collect(maps.Values(eventMap))...))
+
 				for fsAction, filePaths := range eventMap {
 					switch fsAction {
 					case "REMOVE":
 						// Delete the file where the event is Rename or Remove. Will treat same for now
-						wg.Go(func() { syncRemove(filePaths, srcFileTree, targetFileTree) })
+						removed = syncRemove(filePaths, srcFileTree, targetFileTree, evictor.Journal)
 
 					case "RENAME":
-						// Rename with no matching Create? Removed from watch dir, delete file/dir
-						// Rename with matching Create? File was moved from current loc to somewhere else in srcDir
-						// Check if any rename matches a create content. Pop entry from fileEvents?
-						// wg.Go(func() { syncRemove(paths, srcFileTree, dstFileTree) })
+						// Paired with the CREATE events above, see SyncRenames
 
 					case "WRITE", "CREATE":
 						// Check if exists. If exists, compare fileState info between src -> target
-						// wg.Go(func() { syncRemove(paths, srcFileTree, dstFileTree) })
 						// If dir, create dir. If file create file.
 						// Filo should only every write in the target dir and not outside.
-						wg.Go(func() {
-							missing := srcFileTree.MissingIn(targetFileTree, maxFileSemaphore, nil)
-							if len(missing) > 0 {
-								targetFileTree.CopyFrom(srcFileTree, missing, maxFileSemaphore, nil)
-							}
-						})
+						needsCopy = true
 
 					default:
 						slog.Debug(fmt.Sprintf("Skipping file event: %s %v", fsAction, filePaths))
@@ -124,15 +338,102 @@ exitFor:
 					}
 				}
 
-				wg.Wait()
+				// A single admission pass covers both WRITE and CREATE, room is made before anything is copied.
+				// Files still being written are left out of it.
+				if needsCopy {
+					missing := srcFileTree.MissingIn(targetFileTree, maxFileSemaphore, nil)
+					if len(missing) > 0 {
+						var queue []*Admission
+						queue, held, retry = gate.Hold(NewAdmissionQueue(srcFileTree, missing), time.Now())
+						if len(queue) > 0 {
+							plan, pass = evictor.Admit(srcFileTree, targetFileTree, queue, maxFileSemaphore, nil)
+						}
+					}
+				}
+
+				notifyChanged(slices.Concat(changedPaths(plan, pass, nil), removed, renamed))
 
 				// reset
 				lastEvent = time.Time{}
 				lastFSEvents = make(map[string][]string)
+				deferHeld(held, retry)
+
+				if pass != nil {
+					slog.Info(fmt.Sprintf("Sync completed successfully after evicting %d units (%s), Elapsed time: %v",
+						len(pass.Evicted), util.BytesToString(pass.Freed), time.Since(syncTime)))
+				} else {
+					slog.Info(fmt.Sprintf("Sync completed successfully, Elapsed time: %v", time.Since(syncTime)))
+				}
+
+			}
+
+		case paths := <-syncNow:
+			slog.Info(fmt.Sprintf("Syncing %d paths right away: %v -> %v...", len(paths), cfg.SourceDir, cfg.TargetDir))
+			syncTime := time.Now()
+
+			if err := trees(); err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+
+			srcPaths := make([]string, 0, len(paths))
+			for _, p := range paths {
+				if _, _, err := srcFileTree.relPath(p); err != nil {
+					slog.Warn(fmt.Sprintf("skipping %s: %s", p, err.Error()))
+					continue
+				}
+				srcPaths = append(srcPaths, filepath.Clean(p))
+			}
+
+			if len(srcPaths) == 0 {
+				continue
+			}
+
+			// The paths may not have been synced yet, i.e a webhook for an import the watcher has not reported
+			patchSource(srcPaths)
+
+			var plan *AdmissionPlan
+			var pass *EvictionPass
+			missing := srcFileTree.MissingIn(targetFileTree, maxFileSemaphore, nil)
+			if len(missing) > 0 {
+				queue, held, retry := gate.Hold(NewAdmissionQueue(srcFileTree, missing), time.Now())
+				if queue = admissionsFor(queue, srcPaths); len(queue) > 0 {
+					plan, pass = evictor.Admit(srcFileTree, targetFileTree, queue, maxFileSemaphore, nil)
+				}
+				deferHeld(held, retry)
+			}
+
+			notifyChanged(changedPaths(plan, pass, nil))
+			if pass != nil {
+				slog.Info(fmt.Sprintf("Sync completed successfully after evicting %d units (%s), Elapsed time: %v",
+					len(pass.Evicted), util.BytesToString(pass.Freed), time.Since(syncTime)))
+			} else {
 				slog.Info(fmt.Sprintf("Sync completed successfully, Elapsed time: %v", time.Since(syncTime)))
+			}
+
+		case <-retentionTick:
+			if err := trees(); err != nil {
+				slog.Error(err.Error())
+				continue
+			}
 
+			if expired := ApplyRetention(srcFileTree, targetFileTree, cfg.Retention, time.Now(), evictor.Journal); len(expired) > 0 {
+				slog.Info(fmt.Sprintf("Retention pass removed %d expired units from %s", len(expired), cfg.TargetDir))
+				notifyChanged(changedPaths(nil, nil, expired))
 			}
 
+		case <-rankTick:
+			if err := trees(); err != nil {
+				slog.Error(err.Error())
+				continue
+			}
+
+			srcFileTree.unrank()
+			evictor.Prioritize(srcFileTree)
+
+		case sendChanged <- unsentDirs:
+			unsent, unsentDirs = nil, nil
+
 		case <-exit:
 			break exitFor
 		}
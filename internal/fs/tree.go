@@ -0,0 +1,240 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// pathEntry is the fs.DirEntry of a node inserted or moved on its own. Like the entries of os.ReadDir its
+// FileInfo is read from disk on every call.
+type pathEntry struct {
+	path string
+	typ  fs.FileMode
+}
+
+func (e pathEntry) Name() string               { return filepath.Base(e.path) }
+func (e pathEntry) IsDir() bool                { return e.typ.IsDir() }
+func (e pathEntry) Type() fs.FileMode          { return e.typ }
+func (e pathEntry) Info() (fs.FileInfo, error) { return os.Lstat(e.path) }
+
+// Returns the index of the child of n named name and whether it exists, Children are sorted by name
+func (n *FileNode) childIndex(name string) (int, bool) {
+	return slices.BinarySearchFunc(n.Children, name, func(c *FileNode, name string) int {
+		return strings.Compare(c.Entry.Name(), name)
+	})
+}
+
+// Adds c to the children of n in name order, replacing the child with the same name
+func (n *FileNode) addChild(c *FileNode) {
+	c.Parent = n
+	if i, found := n.childIndex(c.Entry.Name()); found {
+		n.Children[i] = c
+	} else {
+		n.Children = slices.Insert(n.Children, i, c)
+	}
+}
+
+// Returns true if relPath is pinned by the globs of the tree, either itself or through a directory above it
+func (ft *FileTree) pinnedPath(relPath string) bool {
+	for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if ft.isPinned(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if BuildTree would walk relPath, neither it nor a directory above it is hidden and it is in
+// the part of the tree set by TreeOptions.Only
+func (ft *FileTree) walked(relPath string) bool {
+	for p := relPath; p != "." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if !IsApprovedPath(filepath.Join(ft.Root.Path, p)) {
+			return false
+		}
+	}
+	return ft.included(relPath)
+}
+
+// Returns the node of the directory holding path, the root for the paths right below it, nil when the
+// directory is not in the tree
+func (ft *FileTree) parentNode(path string) *FileNode {
+	dir := filepath.Dir(path)
+	if dir == filepath.Clean(ft.Root.Path) {
+		return ft.Root
+	}
+	return ft.Index[dir]
+}
+
+// Returns path cleaned along with its path relative to the root, an error when path is not below the root
+func (ft *FileTree) relPath(path string) (string, string, error) {
+	path = filepath.Clean(path)
+	relPath, err := filepath.Rel(ft.Root.Path, path)
+	if err != nil || !filepath.IsLocal(relPath) || relPath == "." {
+		return "", "", fmt.Errorf("%s is not in %s", path, ft.Root.Path)
+	}
+	return path, relPath, nil
+}
+
+// Walks the directory n into the tree the way BuildTree does, children sorted by name
+func (ft *FileTree) walkChildren(n *FileNode) {
+	entries, err := os.ReadDir(n.Path)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+
+	// os.ReadDir sorts entries by name
+	n.Children = make([]*FileNode, 0, len(entries))
+	for _, e := range entries {
+		path := filepath.Join(n.Path, e.Name())
+		relPath := ft.RelBaseFile(path)
+		if !IsApprovedPath(path) || !ft.included(relPath) {
+			continue
+		}
+
+		child := &FileNode{Path: path, Entry: e, Parent: n, Children: make([]*FileNode, 0)}
+		child.Pinned = n.Pinned || ft.isPinned(relPath)
+		n.Children = append(n.Children, child)
+		ft.Index[path] = child
+
+		if e.IsDir() {
+			ft.walkChildren(child)
+		}
+	}
+}
+
+// InsertNode walks path, an absolute path below the root, into the tree along with everything below it,
+// replacing the node already at path. Missing parent directories are walked along with it. Returns the
+// node inserted, nil when BuildTree would skip path. A path gone from disk is removed from the tree and
+// its error returned.
+func (ft *FileTree) InsertNode(path string) (*FileNode, error) {
+	path, relPath, err := ft.relPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		ft.RemoveNode(path)
+		return nil, err
+	}
+
+	if !ft.walked(relPath) {
+		return nil, nil
+	}
+
+	parent := ft.parentNode(path)
+	if parent == nil {
+		// Walking the parent walks path too
+		if _, err := ft.InsertNode(filepath.Dir(path)); err != nil {
+			return nil, err
+		}
+		return ft.Index[path], nil
+	}
+
+	ft.RemoveNode(path)
+	n := &FileNode{Path: path, Entry: pathEntry{path: path, typ: info.Mode().Type()}, Children: make([]*FileNode, 0)}
+	n.Pinned = parent.Pinned || ft.isPinned(relPath)
+	ft.Index[path] = n
+	parent.addChild(n)
+
+	if info.IsDir() {
+		ft.walkChildren(n)
+	}
+	return n, nil
+}
+
+// RemoveNode removes the node at path and everything below it from the tree. Returns the node removed,
+// nil when path is not in the tree.
+func (ft *FileTree) RemoveNode(path string) *FileNode {
+	n := ft.Index[filepath.Clean(path)]
+	if n == nil {
+		return nil
+	}
+
+	ft.detach(n)
+	n.Parent = nil
+	return n
+}
+
+// MoveNode moves the node at from and everything below it to to, once it has been renamed on disk. The
+// nodes keep their priority, watch state and hash, they are pinned by the globs matching their new path.
+// When from is not in the tree or the directory holding to is not either, to is walked instead, see
+// InsertNode. Returns the node at to.
+func (ft *FileTree) MoveNode(from, to string) (*FileNode, error) {
+	to, relPath, err := ft.relPath(to)
+	if err != nil {
+		return nil, err
+	}
+
+	n := ft.Index[filepath.Clean(from)]
+	parent := ft.parentNode(to)
+	if n == nil || parent == nil || !ft.walked(relPath) {
+		ft.RemoveNode(from)
+		return ft.InsertNode(to)
+	}
+
+	ft.RemoveNode(from)
+	ft.RemoveNode(to)
+
+	var rebase func(n *FileNode, path string, pinned bool)
+	rebase = func(n *FileNode, path string, pinned bool) {
+		n.Path = path
+		n.Entry = pathEntry{path: path, typ: n.Entry.Type()}
+		n.Pinned = pinned || ft.isPinned(ft.RelBaseFile(path))
+		ft.Index[path] = n
+		for _, c := range n.Children {
+			rebase(c, filepath.Join(path, c.Entry.Name()), n.Pinned)
+		}
+	}
+
+	rebase(n, to, parent.Pinned)
+	parent.addChild(n)
+	return n, nil
+}
+
+// Returns paths cleaned, sorted and without the ones below another one of them
+func topPaths(paths []string) []string {
+	paths = slices.Clone(paths)
+	for i := range paths {
+		paths[i] = filepath.Clean(paths[i])
+	}
+	slices.Sort(paths)
+	paths = slices.Compact(paths)
+
+	// Sorted, a directory comes before the paths below it
+	top := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !slices.ContainsFunc(top, func(dir string) bool { return isBelow(p, dir) }) {
+			top = append(top, p)
+		}
+	}
+	return top
+}
+
+// Patches the tree with paths, absolute paths below the root changed on disk. Paths still on disk are
+// walked again and the others removed, paths below another one of them are left to it.
+func (ft *FileTree) patch(paths []string) {
+	for _, p := range topPaths(paths) {
+		if _, err := ft.InsertNode(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// Clears what the Prioritizer set on the nodes of a long-lived tree, pins from media server collections
+// included, so it is ranked again like a freshly built one
+func (ft *FileTree) unrank() {
+	for _, n := range append(slices.Collect(maps.Values(ft.Index)), ft.Root) {
+		n.Priority = 0
+		n.Watch = WatchState{}
+		n.Pinned = n != ft.Root && ft.pinnedPath(ft.RelBaseFile(n.Path))
+	}
+}
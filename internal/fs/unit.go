@@ -0,0 +1,86 @@
+package fs
+
+// Returns true if n is the root of a unit, a directory matching one of the unit_depth globs
+func (t *FileTree) isUnit(n *FileNode) bool {
+	if n == nil || n == t.Root || n.Entry == nil || !n.Entry.IsDir() {
+		return false
+	}
+
+	return matchAny(t.opts.Units, t.RelBaseFile(n.Path))
+}
+
+// UnitOf returns the unit n belongs to, the top-most directory above n matching one of the unit_depth
+// globs. Units are admitted, sized and evicted as one. Nodes outside of any unit are their own unit.
+func (t *FileTree) UnitOf(n *FileNode) *FileNode {
+	unit := n
+	for p := n; p != nil && p != t.Root; p = p.Parent {
+		if t.isUnit(p) {
+			unit = p
+		}
+	}
+
+	return unit
+}
+
+// Returns the units in tgt that filo manages, that is every unit holding a file that also exists in src.
+// Files in tgt that are not in src belong to someone else and are never evicted on their own.
+func managedUnits(src, tgt *FileTree) []*FileNode {
+	seen := make(map[*FileNode]bool)
+	managed := make([]*FileNode, 0)
+	for _, tgtNode := range tgt.Index {
+		if tgtNode.Entry == nil || tgtNode.Entry.IsDir() || sourceNode(src, tgt, tgtNode) == nil {
+			continue
+		}
+
+		unit := tgt.UnitOf(tgtNode)
+		if !seen[unit] && sourceNode(src, tgt, unit) != nil {
+			seen[unit] = true
+			managed = append(managed, unit)
+		}
+	}
+
+	return managed
+}
+
+// ManagedBytes returns the number of bytes filo holds on tgt, the size of every managed unit
+func ManagedBytes(src, tgt *FileTree) uint64 {
+	var managed uint64
+	for _, unit := range managedUnits(src, tgt) {
+		managed += unit.Size()
+	}
+	return managed
+}
+
+// Returns true if n or anything below it is pinned
+func hasPinned(n *FileNode) bool {
+	if n.Pinned {
+		return true
+	}
+
+	for _, c := range n.Children {
+		if hasPinned(c) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the target unit tgtUnit or its counterpart in src holds a pinned node. Source nodes
+// are also pinned by a Prioritizer, i.e from media server collections, after the trees are built.
+func unitPinned(src, tgt *FileTree, tgtUnit *FileNode) bool {
+	if hasPinned(tgtUnit) {
+		return true
+	}
+
+	srcUnit := sourceNode(src, tgt, tgtUnit)
+	return srcUnit != nil && hasPinned(srcUnit)
+}
+
+// Pin marks n and everything below it as pinned, like a match of the pinned globs
+func (n *FileNode) Pin() {
+	n.Pinned = true
+	for _, c := range n.Children {
+		c.Pin()
+	}
+}
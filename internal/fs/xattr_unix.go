@@ -0,0 +1,97 @@
+//go:build linux || darwin
+
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Returns true when err means the filesystem has no extended attributes
+func xattrUnsupported(err error) bool {
+	return errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// Returns the names of the extended attributes of f
+func listXattrs(f *os.File) ([]string, error) {
+	for {
+		size, err := unix.Flistxattr(int(f.Fd()), nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Flistxattr(int(f.Fd()), buf)
+		if errors.Is(err, unix.ERANGE) {
+			// Grew between the calls
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		names := make([]string, 0)
+		for name := range bytes.SplitSeq(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// Returns the value of the extended attribute name of f
+func getXattr(f *os.File, name string) ([]byte, error) {
+	for {
+		size, err := unix.Fgetxattr(int(f.Fd()), name, nil)
+		if err != nil || size == 0 {
+			return nil, err
+		}
+
+		buf := make([]byte, size)
+		size, err = unix.Fgetxattr(int(f.Fd()), name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+		return buf[:size], err
+	}
+}
+
+// Copies the extended attributes of src to dst. Without root only the user namespace is copied on linux,
+// the other ones are reserved to root. Nothing is copied when either filesystem has no extended attributes.
+func copyXattrs(src, dst *os.File) error {
+	names, err := listXattrs(src)
+	if err != nil {
+		if xattrUnsupported(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %s", src.Name(), err.Error())
+	}
+
+	root := os.Geteuid() == 0
+	for _, name := range names {
+		if runtime.GOOS == "linux" && !root && !strings.HasPrefix(name, "user.") {
+			continue
+		}
+
+		value, err := getXattr(src, name)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", src.Name(), name, err.Error())
+		}
+
+		if err := unix.Fsetxattr(int(dst.Fd()), name, value, 0); err != nil {
+			if xattrUnsupported(err) {
+				return nil
+			}
+			return fmt.Errorf("%s %s: %s", dst.Name(), name, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,8 @@
+package fs
+
+import "os"
+
+// Does nothing, extended attributes are not copied on Windows
+func copyXattrs(src, dst *os.File) error {
+	return nil
+}
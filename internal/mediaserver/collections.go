@@ -0,0 +1,144 @@
+package mediaserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+// CollectionServer is a media server whose playlists and collections can be listed
+type CollectionServer interface {
+	Name() string
+	// CollectionPaths returns the paths of the members of the playlists and collections called names, as
+	// the server sees them. Series and seasons are directories.
+	CollectionPaths(ctx context.Context, names []string) ([]string, error)
+}
+
+// PinnedCollections is a media server and the names of its playlists and collections to pin
+type PinnedCollections struct {
+	Server CollectionServer
+	Names  []string
+}
+
+// Collections pins the members of media server playlists and collections on the source tree, so they are
+// always synced and never evicted, see fs.Prioritizer. Membership is read again every Interval by Run,
+// items that leave a collection are evicted like any other file from the next sync on.
+type Collections struct {
+	Sources  []PinnedCollections
+	PathMap  *PathMap      // rewrites the paths of the servers to source paths, nil leaves them unchanged
+	Interval time.Duration // time between two reads of the membership
+
+	mu      sync.Mutex
+	read    bool
+	members map[string][]string // server paths of the members, by server name
+}
+
+// Refresh reads the members of every collection again and returns the ones that were not members
+// before, as server paths. A server that fails keeps its previous members.
+func (c *Collections) Refresh(ctx context.Context) ([]string, error) {
+	var errs []error
+	members := make(map[string][]string, len(c.Sources))
+	for _, source := range c.Sources {
+		paths, err := source.Server.CollectionPaths(ctx, source.Names)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s collections: %w", source.Server.Name(), err))
+			paths = c.Members(source.Server.Name())
+		}
+		members[source.Server.Name()] = paths
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	added := make([]string, 0)
+	if c.read {
+		for name, paths := range members {
+			for _, p := range paths {
+				if !slices.Contains(c.members[name], p) {
+					added = append(added, p)
+				}
+			}
+		}
+	}
+
+	c.members, c.read = members, true
+	return added, errors.Join(errs...)
+}
+
+// Members returns the paths of the members of the collections of server, as of the last Refresh
+func (c *Collections) Members(server string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.members[server])
+}
+
+// Prioritize pins every node of src that is a member of a collection along with everything below it. The
+// membership is read first when it never was.
+func (c *Collections) Prioritize(src *fs.FileTree) error {
+	c.mu.Lock()
+	read := c.read
+	c.mu.Unlock()
+
+	var err error
+	if !read {
+		ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+		defer cancel()
+		_, err = c.Refresh(ctx)
+	}
+
+	for _, source := range c.Sources {
+		for _, p := range c.Members(source.Server.Name()) {
+			if n := c.PathMap.Resolve(src, p); n != nil {
+				n.Pin()
+			}
+		}
+	}
+
+	return err
+}
+
+// Run reads the membership again every Interval until exit is closed, the local paths of new members
+// are sent on syncNow so they are copied without waiting for a change on the source
+func (c *Collections) Run(syncNow chan<- []string, exit <-chan struct{}) {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+			added, err := c.Refresh(ctx)
+			cancel()
+			if err != nil {
+				slog.Error(err.Error())
+			}
+
+			local := make([]string, 0, len(added))
+			for _, p := range added {
+				if l, ok := c.PathMap.ToLocal(p); ok {
+					local = append(local, l)
+				}
+			}
+
+			if len(local) == 0 || syncNow == nil {
+				continue
+			}
+
+			slog.Info(fmt.Sprintf("%d new collection members, syncing them now", len(local)))
+			select {
+			case syncNow <- local:
+			case <-exit:
+				return
+			}
+
+		case <-exit:
+			return
+		}
+	}
+}
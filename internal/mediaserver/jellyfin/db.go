@@ -0,0 +1,266 @@
+package jellyfin
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// Watch state of every item with a path that was played, favorited or started, per user
+const dbItemsQuery = `
+SELECT u.userId, t.Path, u.played, u.playCount, u.isFavorite, u.playbackPositionTicks,
+	COALESCE(CAST(u.lastPlayedDate AS TEXT), '')
+FROM UserDatas u
+JOIN TypedBaseItems t ON t.UserDataKey = u.key
+WHERE t.Path IS NOT NULL AND t.Path != ''
+	AND (u.played OR u.playCount > 0 OR u.isFavorite OR u.playbackPositionTicks > 0)
+ORDER BY u.userId, t.Path`
+
+// Playback sessions of each item per user, recorded by the Playback Reporting plugin
+const dbActivityQuery = `
+SELECT UserId, ItemId, COUNT(*), COALESCE(CAST(MAX(DateCreated) AS TEXT), '')
+FROM PlaybackActivity
+GROUP BY UserId, ItemId`
+
+// DB reads played state, play counts, favorites, resume points and last played dates straight from the
+// databases of a Jellyfin server, for servers whose API filo cannot reach. Next up episodes are not kept
+// in the databases and are not reported.
+type DB struct {
+	Path              string   // library.db, holding the items and the watch state of the users
+	UsersPath         string   // jellyfin.db, holding the user names
+	PlaybackReporting string   // playback_reporting.db of the Playback Reporting plugin, optional
+	Users             []string // user names to read, every user when empty
+}
+
+// Returns a DB reading the Jellyfin library database at path, with the users of the jellyfin.db next to it
+// and the play history of the Playback Reporting database at playbackReporting unless it is empty
+func NewDB(path, playbackReporting string, users []string) *DB {
+	return &DB{
+		Path:              path,
+		UsersPath:         filepath.Join(filepath.Dir(path), "jellyfin.db"),
+		PlaybackReporting: playbackReporting,
+		Users:             users,
+	}
+}
+
+func (d *DB) Name() string { return "jellyfin" }
+
+// dbUser is a user of jellyfin.db, known as InternalID in library.db and as ID in playback_reporting.db
+type dbUser struct {
+	ID         string
+	Name       string
+	InternalID int64
+}
+
+// Returns the id Jellyfin shows for a Guid as .NET stores it, the first three groups little endian
+func guidID(b []byte) string {
+	if len(b) != 16 {
+		return ""
+	}
+
+	g := slices.Clone(b)
+	slices.Reverse(g[0:4])
+	slices.Reverse(g[4:6])
+	slices.Reverse(g[6:8])
+	return hex.EncodeToString(g)
+}
+
+// Returns id, a Guid in any of its text forms, as the 32 lowercase hex digits Jellyfin shows
+func normalizeID(id string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "{", "", "}", "").Replace(id))
+}
+
+// Returns the users to read, every user of jellyfin.db when d.Users is empty
+func (d *DB) users(ctx context.Context) ([]dbUser, error) {
+	db, err := mediaserver.OpenDB(d.UsersPath)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, "SELECT Id, Username, InternalId FROM Users")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make([]dbUser, 0)
+	for rows.Next() {
+		var u dbUser
+		if err := rows.Scan(&u.ID, &u.Name, &u.InternalID); err != nil {
+			return nil, err
+		}
+		u.ID = normalizeID(u.ID)
+		all = append(all, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(d.Users) == 0 {
+		return all, nil
+	}
+
+	selected := make([]dbUser, 0, len(d.Users))
+	for _, name := range d.Users {
+		i := slices.IndexFunc(all, func(u dbUser) bool { return strings.EqualFold(u.Name, name) })
+		if i < 0 {
+			return nil, fmt.Errorf("no Jellyfin user named '%s'", name)
+		}
+		selected = append(selected, all[i])
+	}
+	return selected, nil
+}
+
+// Items returns the played, favorite and resumable items of every user read by d. Play counts and last
+// played dates are raised to what the Playback Reporting plugin recorded, when its database is set.
+func (d *DB) Items(ctx context.Context) ([]mediaserver.Item, error) {
+	users, err := d.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byInternalID := make(map[int64]string, len(users))
+	byID := make(map[string]string, len(users))
+	for _, u := range users {
+		byInternalID[u.InternalID] = u.Name
+		byID[u.ID] = u.Name
+	}
+
+	db, err := mediaserver.OpenDB(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, dbItemsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]mediaserver.Item, 0)
+	seen := make(map[[2]string]int) // index in result of each user and path
+	for rows.Next() {
+		var item mediaserver.Item
+		var userID, ticks int64
+		var lastPlayed string
+		if err := rows.Scan(&userID, &item.Path, &item.Played, &item.PlayCount, &item.Favorite, &ticks, &lastPlayed); err != nil {
+			return nil, err
+		}
+
+		name, ok := byInternalID[userID]
+		if !ok {
+			continue
+		}
+
+		item.User = name
+		item.Resume = time.Duration(ticks) * tick
+		if item.LastPlayed, err = mediaserver.ParseDBTime(lastPlayed); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.Path, err)
+		}
+
+		seen[[2]string{item.User, item.Path}] = len(result)
+		result = append(result, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if d.PlaybackReporting == "" {
+		return result, nil
+	}
+
+	activity, err := d.activity(ctx, db, byID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range activity {
+		i, ok := seen[[2]string{a.User, a.Path}]
+		if !ok {
+			seen[[2]string{a.User, a.Path}] = len(result)
+			result = append(result, a)
+			continue
+		}
+
+		result[i].PlayCount = max(result[i].PlayCount, a.PlayCount)
+		if a.LastPlayed.After(result[i].LastPlayed) {
+			result[i].LastPlayed = a.LastPlayed
+		}
+	}
+
+	return result, nil
+}
+
+// Returns the play count and last played date of the items the users in byID played according to the
+// Playback Reporting database, with the paths of the items in library, the open library.db
+func (d *DB) activity(ctx context.Context, library *sql.DB, byID map[string]string) ([]mediaserver.Item, error) {
+	db, err := mediaserver.OpenDB(d.PlaybackReporting)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, dbActivityQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	played := make(map[string][]mediaserver.Item) // by item id, Path is set once the ids are resolved
+	for rows.Next() {
+		var userID, itemID, lastPlayed string
+		var item mediaserver.Item
+		if err := rows.Scan(&userID, &itemID, &item.PlayCount, &lastPlayed); err != nil {
+			return nil, err
+		}
+
+		name, ok := byID[normalizeID(userID)]
+		if !ok {
+			continue
+		}
+
+		item.User = name
+		if item.LastPlayed, err = mediaserver.ParseDBTime(lastPlayed); err != nil {
+			return nil, fmt.Errorf("%s: %w", d.PlaybackReporting, err)
+		}
+		played[normalizeID(itemID)] = append(played[normalizeID(itemID)], item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(played) == 0 {
+		return nil, nil
+	}
+
+	items, err := library.QueryContext(ctx, "SELECT guid, Path FROM TypedBaseItems WHERE Path IS NOT NULL AND Path != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer items.Close()
+
+	result := make([]mediaserver.Item, 0, len(played))
+	for items.Next() {
+		var guid []byte
+		var path string
+		if err := items.Scan(&guid, &path); err != nil {
+			return nil, err
+		}
+
+		for _, item := range played[guidID(guid)] {
+			item.Path = path
+			result = append(result, item)
+		}
+	}
+
+	return result, items.Err()
+}
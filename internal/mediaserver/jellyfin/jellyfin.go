@@ -0,0 +1,312 @@
+// Package jellyfin reads the watch state of Jellyfin users through the Jellyfin HTTP API
+package jellyfin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// Number of items requested per page
+const pageSize = 500
+
+// Number of next up episodes requested per user
+const nextUpLimit = 100
+
+// Jellyfin reports playback positions in ticks of 100ns
+const tick = 100 * time.Nanosecond
+
+// Client reads played state, favorites, resume points and next up episodes from a Jellyfin server
+type Client struct {
+	URL    string
+	APIKey string
+	Users  []string // user names to read, every user when empty
+	HTTP   *http.Client
+}
+
+// Returns a Client for the Jellyfin server at serverURL authenticating with apiKey
+func New(serverURL, apiKey string, users []string) *Client {
+	return &Client{URL: strings.TrimRight(serverURL, "/"), APIKey: apiKey, Users: users, HTTP: http.DefaultClient}
+}
+
+func (c *Client) Name() string { return "jellyfin" }
+
+type user struct {
+	ID   string `json:"Id"`
+	Name string `json:"Name"`
+}
+
+type userData struct {
+	Played                bool      `json:"Played"`
+	PlayCount             int       `json:"PlayCount"`
+	IsFavorite            bool      `json:"IsFavorite"`
+	PlaybackPositionTicks int64     `json:"PlaybackPositionTicks"`
+	LastPlayedDate        time.Time `json:"LastPlayedDate"`
+}
+
+type item struct {
+	ID       string   `json:"Id"`
+	Name     string   `json:"Name"`
+	Type     string   `json:"Type"`
+	Path     string   `json:"Path"`
+	UserData userData `json:"UserData"`
+}
+
+type itemsResult struct {
+	Items            []item `json:"Items"`
+	TotalRecordCount int    `json:"TotalRecordCount"`
+}
+
+// Sends a request for path with query and body, encoded as JSON unless nil, to the server and decodes
+// the JSON response into v unless it is nil
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, v any) error {
+	endpoint := c.URL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("MediaBrowser Token=%q", c.APIKey))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("%s %s: %s", method, path, err.Error())
+	}
+	return nil
+}
+
+// Sends a GET for path with query to the server and decodes the JSON response into v
+func (c *Client) get(ctx context.Context, path string, query url.Values, v any) error {
+	return c.do(ctx, http.MethodGet, path, query, nil, v)
+}
+
+// Returns every item of a paged query, requesting pageSize items at a time
+func (c *Client) items(ctx context.Context, path string, query url.Values) ([]item, error) {
+	items := make([]item, 0)
+	for {
+		query.Set("StartIndex", strconv.Itoa(len(items)))
+		query.Set("Limit", strconv.Itoa(pageSize))
+
+		var page itemsResult
+		if err := c.get(ctx, path, query, &page); err != nil {
+			return nil, err
+		}
+
+		items = append(items, page.Items...)
+		if len(page.Items) == 0 || len(items) >= page.TotalRecordCount {
+			return items, nil
+		}
+	}
+}
+
+// Returns the users to read, every user of the server when c.Users is empty
+func (c *Client) users(ctx context.Context) ([]user, error) {
+	var all []user
+	if err := c.get(ctx, "/Users", nil, &all); err != nil {
+		return nil, err
+	}
+
+	if len(c.Users) == 0 {
+		return all, nil
+	}
+
+	selected := make([]user, 0, len(c.Users))
+	for _, name := range c.Users {
+		i := slices.IndexFunc(all, func(u user) bool { return strings.EqualFold(u.Name, name) })
+		if i < 0 {
+			return nil, fmt.Errorf("no Jellyfin user named '%s'", name)
+		}
+		selected = append(selected, all[i])
+	}
+	return selected, nil
+}
+
+// Items returns the played, favorite, resumable and next up items of every user read by c
+func (c *Client) Items(ctx context.Context) ([]mediaserver.Item, error) {
+	users, err := c.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]mediaserver.Item, 0)
+	for _, u := range users {
+		seen := make(map[string]int) // index in result of each item id seen for u
+		add := func(items []item, nextUp bool) {
+			for _, it := range items {
+				if it.Path == "" {
+					continue
+				}
+
+				if i, ok := seen[it.ID]; ok {
+					result[i].NextUp = result[i].NextUp || nextUp
+					continue
+				}
+
+				seen[it.ID] = len(result)
+				result = append(result, mediaserver.Item{
+					Path:       it.Path,
+					User:       u.Name,
+					Played:     it.UserData.Played,
+					PlayCount:  it.UserData.PlayCount,
+					Favorite:   it.UserData.IsFavorite,
+					Resume:     time.Duration(it.UserData.PlaybackPositionTicks) * tick,
+					NextUp:     nextUp,
+					LastPlayed: it.UserData.LastPlayedDate,
+				})
+			}
+		}
+
+		for _, filter := range []string{"IsPlayed", "IsFavorite", "IsResumable"} {
+			items, err := c.items(ctx, "/Users/"+u.ID+"/Items", url.Values{
+				"Recursive": {"true"},
+				"Filters":   {filter},
+				"Fields":    {"Path"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			add(items, false)
+		}
+
+		var nextUp itemsResult
+		if err := c.get(ctx, "/Shows/NextUp", url.Values{
+			"UserId": {u.ID},
+			"Fields": {"Path"},
+			"Limit":  {strconv.Itoa(nextUpLimit)},
+		}, &nextUp); err != nil {
+			return nil, err
+		}
+		add(nextUp.Items, true)
+	}
+
+	return result, nil
+}
+
+// ItemPaths returns the path of the item with the given id, a directory for series and seasons
+func (c *Client) ItemPaths(ctx context.Context, id string) ([]string, error) {
+	var result itemsResult
+	if err := c.get(ctx, "/Items", url.Values{"Ids": {id}, "Fields": {"Path"}}, &result); err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(result.Items))
+	for _, it := range result.Items {
+		if it.Path != "" {
+			paths = append(paths, it.Path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no Jellyfin item with a path for id %s", id)
+	}
+	return paths, nil
+}
+
+// CollectionPaths returns the paths of the items in the collections and playlists called names, as any of
+// the users read by c sees them
+func (c *Client) CollectionPaths(ctx context.Context, names []string) ([]string, error) {
+	users, err := c.users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string]bool, len(names))
+	seen := make(map[string]bool) // ids of the collections already read
+	paths := make([]string, 0)
+	for _, u := range users {
+		collections, err := c.items(ctx, "/Users/"+u.ID+"/Items", url.Values{
+			"Recursive":        {"true"},
+			"IncludeItemTypes": {"BoxSet,Playlist"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, collection := range collections {
+			i := slices.IndexFunc(names, func(name string) bool { return strings.EqualFold(name, collection.Name) })
+			if i < 0 || seen[collection.ID] {
+				continue
+			}
+			found[names[i]], seen[collection.ID] = true, true
+
+			members, err := c.items(ctx, "/Users/"+u.ID+"/Items", url.Values{
+				"ParentId": {collection.ID},
+				"Fields":   {"Path"},
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			for _, m := range members {
+				if m.Path != "" && !slices.Contains(paths, m.Path) {
+					paths = append(paths, m.Path)
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		if !found[name] {
+			return nil, fmt.Errorf("no Jellyfin collection or playlist named '%s'", name)
+		}
+	}
+	return paths, nil
+}
+
+type mediaUpdate struct {
+	Path       string `json:"Path"`
+	UpdateType string `json:"UpdateType"`
+}
+
+type mediaUpdates struct {
+	Updates []mediaUpdate `json:"Updates"`
+}
+
+// Refresh asks the server to rescan dirs, only the libraries holding them are scanned
+func (c *Client) Refresh(ctx context.Context, dirs []string) error {
+	updates := mediaUpdates{Updates: make([]mediaUpdate, 0, len(dirs))}
+	for _, dir := range dirs {
+		updates.Updates = append(updates.Updates, mediaUpdate{Path: dir, UpdateType: "Modified"})
+	}
+
+	return c.do(ctx, http.MethodPost, "/Library/Media/Updated", nil, updates, nil)
+}
@@ -0,0 +1,177 @@
+// Package mediaserver turns the watch state kept by media servers (Jellyfin, Plex) into priorities on
+// the source FileTree, so what is about to be watched is synced first and what was watched goes first.
+package mediaserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+// Priorities given to the files of an item, a file takes the highest one that applies to it
+const (
+	PriorityPlayed   = -100 // watched by every user, evicted before anything unwatched
+	PriorityFavorite = 100  // favorites and watchlist items
+	PriorityResume   = 200  // partially watched
+	PriorityNextUp   = 300  // next episode of a show being watched
+	PriorityPrefetch = 400  // episodes right after the last one watched, minus their distance from it
+	PriorityBehind   = -200 // watched episodes before the last one watched, evicted first
+)
+
+// How long a Prioritizer waits on all of its servers
+const Timeout = 30 * time.Second
+
+// Item is the watch state of a single media server item for one user. Path is the path of the item as
+// the server sees it, a file for movies and episodes or a directory for series, seasons and folders.
+type Item struct {
+	Path       string
+	User       string
+	Played     bool
+	PlayCount  int
+	Favorite   bool
+	Watchlist  bool
+	Resume     time.Duration // playback position, 0 when not started
+	NextUp     bool
+	LastPlayed time.Time
+}
+
+// Server is a media server filo reads watch state from
+type Server interface {
+	Name() string
+	// Items returns every played, favorite, watchlisted, resumable and next up item of the users the server reads
+	Items(ctx context.Context) ([]Item, error)
+}
+
+// Score returns the priority of item, see PriorityPlayed
+func Score(item Item) int {
+	switch {
+	case item.NextUp:
+		return PriorityNextUp
+	case item.Resume > 0:
+		return PriorityResume
+	case item.Favorite, item.Watchlist:
+		return PriorityFavorite
+	case item.Played:
+		return PriorityPlayed
+	}
+	return 0
+}
+
+// Prioritizer sets FileNode.Priority on the source tree from the watch state of Servers, see fs.Prioritizer
+type Prioritizer struct {
+	Servers  []Server
+	PathMap  *PathMap // rewrites the paths of the servers to source paths, nil leaves them unchanged
+	Prefetch int      // episodes kept ahead of the last one each user watched, see prefetch
+
+	reported map[string]string // per server, the unresolved paths last logged, see Validation.key
+}
+
+// Prioritize ranks every file of src covered by an item of one of the servers. Per user a file takes the
+// highest score of the items covering it, a directory item covers every file below it. Across users a
+// file takes the highest score too, users without an item for the file count as 0, so a file is only
+// ranked as played once every user played it. Episodes ahead of and behind what each user last watched
+// are ranked by prefetch. The users ranking a file above 0 own it, see fs.WatchState.Users.
+func (p *Prioritizer) Prioritize(src *fs.FileTree) error {
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	var errs []error
+	byUser := make(map[string]map[*fs.FileNode]int)
+	watchedByUser := make(map[string][]watched)
+	watch := make(map[*fs.FileNode]fs.WatchState) // across users, Rank is set once the users are merged
+	for _, server := range p.Servers {
+		items, err := server.Items(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server.Name(), err))
+			continue
+		}
+
+		paths := make([]string, 0, len(items))
+		for _, item := range items {
+			paths = append(paths, item.Path)
+		}
+		// Logged once, then again only when other paths fail to resolve, Prioritize runs on every sync
+		if v := p.PathMap.Validate(src, paths); v.key() != p.reported[server.Name()] {
+			if p.reported == nil {
+				p.reported = make(map[string]string)
+			}
+			p.reported[server.Name()] = v.key()
+			v.Log(server.Name(), src.Root.Path)
+		}
+
+		for _, item := range items {
+			n := p.PathMap.Resolve(src, item.Path)
+			if n == nil {
+				continue
+			}
+
+			user := server.Name() + "/" + item.User
+			if _, ok := byUser[user]; !ok {
+				byUser[user] = make(map[*fs.FileNode]int)
+			}
+
+			score := Score(item)
+			for _, f := range n.Files() {
+				if current, ok := byUser[user][f]; !ok || score > current {
+					byUser[user][f] = score
+				}
+
+				w := watch[f]
+				w.Favorite = w.Favorite || item.Favorite || item.Watchlist
+				if item.LastPlayed.After(w.LastPlayed) {
+					w.LastPlayed = item.LastPlayed
+				}
+				if !n.Entry.IsDir() {
+					w.PlayCount += item.PlayCount
+					if item.PlayCount == 0 && item.Played {
+						w.PlayCount++
+					}
+				}
+				watch[f] = w
+			}
+
+			if !n.Entry.IsDir() && (item.Played || item.Resume > 0) {
+				watchedByUser[user] = append(watchedByUser[user], watched{node: n, item: item})
+			}
+		}
+	}
+
+	if p.Prefetch > 0 {
+		for user, scores := range byUser {
+			prefetch(src, watchedByUser[user], p.Prefetch, scores)
+		}
+	}
+
+	ranked := make(map[*fs.FileNode]int)
+	for _, scores := range byUser {
+		for f, score := range scores {
+			if current, ok := ranked[f]; !ok || score > current {
+				ranked[f] = score
+			}
+		}
+	}
+
+	for f, score := range ranked {
+		for _, scores := range byUser {
+			if _, ok := scores[f]; !ok {
+				score = max(score, 0)
+				break
+			}
+		}
+		f.Priority = score
+		f.Watch = watch[f]
+		f.Watch.Rank = score
+		for user, scores := range byUser {
+			if scores[f] > 0 {
+				f.Watch.Users = append(f.Watch.Users, user)
+			}
+		}
+		slices.Sort(f.Watch.Users)
+	}
+
+	return errors.Join(errs...)
+}
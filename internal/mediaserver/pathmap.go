@@ -0,0 +1,204 @@
+package mediaserver
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+// PathMap rewrites paths between media servers and filo using the [[path_map]] rules of filo.toml.
+// The longest matching prefix wins. Server paths may use either separator, so a Plex server on
+// Windows can be mapped too. A nil or empty PathMap leaves paths unchanged.
+type PathMap struct {
+	Target string // target_dir, server paths mapped below it resolve to the source node at the same relative path
+	rules  []config.PathMapping
+}
+
+// Returns the PathMap for rules, an error when a rule is incomplete or maps the same prefix twice
+func NewPathMap(rules []config.PathMapping) (*PathMap, error) {
+	m := &PathMap{rules: make([]config.PathMapping, 0, len(rules))}
+	for i, rule := range rules {
+		if rule.Server == "" || rule.Local == "" {
+			return nil, fmt.Errorf("path_map %d: both server and local must be set", i+1)
+		}
+
+		if !filepath.IsAbs(rule.Local) {
+			return nil, fmt.Errorf("path_map %d: local '%s' is not an absolute path", i+1, rule.Local)
+		}
+
+		rule.Server = strings.TrimRight(rule.Server, `/\`)
+		rule.Local = filepath.Clean(rule.Local)
+		if slices.ContainsFunc(m.rules, func(r config.PathMapping) bool { return r.Server == rule.Server }) {
+			return nil, fmt.Errorf("path_map %d: server '%s' is mapped more than once", i+1, rule.Server)
+		}
+		m.rules = append(m.rules, rule)
+	}
+
+	return m, nil
+}
+
+// Returns the rest of p after prefix when p is prefix or a path below it
+func trimPrefix(p, prefix string, separators string) (string, bool) {
+	rest, ok := strings.CutPrefix(p, prefix)
+	if !ok || (rest != "" && !strings.ContainsRune(separators, rune(rest[0]))) {
+		return "", false
+	}
+	return strings.TrimLeft(rest, separators), true
+}
+
+// ToLocal rewrites the media server path p to the path filo sees. Returns p unchanged and false when
+// no rule matches it, or true when there are no rules.
+func (m *PathMap) ToLocal(p string) (string, bool) {
+	if m == nil || len(m.rules) == 0 {
+		return filepath.Clean(p), true
+	}
+
+	var best *config.PathMapping
+	var bestRest string
+	for i, rule := range m.rules {
+		if rest, ok := trimPrefix(p, rule.Server, `/\`); ok && (best == nil || len(rule.Server) > len(best.Server)) {
+			best, bestRest = &m.rules[i], rest
+		}
+	}
+
+	if best == nil {
+		return p, false
+	}
+
+	return filepath.Join(best.Local, filepath.FromSlash(strings.ReplaceAll(bestRest, `\`, "/"))), true
+}
+
+// ToServer rewrites the local path p to the path the media server sees, using the separator of the
+// server prefix. Returns p unchanged and false when no rule matches it, or true when there are no rules.
+func (m *PathMap) ToServer(p string) (string, bool) {
+	if m == nil || len(m.rules) == 0 {
+		return p, true
+	}
+
+	p = filepath.Clean(p)
+	var best *config.PathMapping
+	var bestRest string
+	for i, rule := range m.rules {
+		if rest, ok := trimPrefix(p, rule.Local, string(filepath.Separator)); ok && (best == nil || len(rule.Local) > len(best.Local)) {
+			best, bestRest = &m.rules[i], rest
+		}
+	}
+
+	if best == nil {
+		return p, false
+	}
+
+	if bestRest == "" {
+		return best.Server, true
+	}
+
+	sep := "/"
+	if strings.Contains(best.Server, `\`) {
+		sep = `\`
+	}
+	return best.Server + sep + strings.ReplaceAll(filepath.ToSlash(bestRest), "/", sep), true
+}
+
+// Returns the node of src at local, a path mapped from a media server. Libraries may point at the target,
+// a path below Target is looked up in src by its path relative to Target.
+func (m *PathMap) node(src *fs.FileTree, local string) *fs.FileNode {
+	if n := src.Index[local]; n != nil {
+		return n
+	}
+
+	if m == nil || m.Target == "" {
+		return nil
+	}
+
+	relPath, err := filepath.Rel(m.Target, local)
+	if err != nil || !filepath.IsLocal(relPath) {
+		return nil
+	}
+	return src.Index[filepath.Join(src.Root.Path, relPath)]
+}
+
+// Resolve returns the node of src the media server path p maps to, nil when p is not mapped or not in src.
+// Paths on the target resolve to their source counterpart.
+func (m *PathMap) Resolve(src *fs.FileTree, p string) *fs.FileNode {
+	if p == "" {
+		return nil
+	}
+
+	local, ok := m.ToLocal(p)
+	if !ok {
+		return nil
+	}
+	return m.node(src, local)
+}
+
+// Validation reports the media server paths that do not resolve to a node of the source tree
+type Validation struct {
+	Checked  int
+	Unmapped []string // no [[path_map]] rule matches them
+	Missing  []string // mapped, but there is nothing at the local path in the source tree
+}
+
+// Validate resolves every media server path in paths against src, see Validation
+func (m *PathMap) Validate(src *fs.FileTree, paths []string) Validation {
+	v := Validation{Checked: len(paths), Unmapped: make([]string, 0), Missing: make([]string, 0)}
+	for _, p := range paths {
+		local, ok := m.ToLocal(p)
+		switch {
+		case !ok:
+			v.Unmapped = append(v.Unmapped, p)
+		case m.node(src, local) == nil:
+			v.Missing = append(v.Missing, p)
+		}
+	}
+	return v
+}
+
+// Log warns about the paths of server that did not resolve to a node of the source tree at root
+func (v Validation) Log(server, root string) {
+	if len(v.Unmapped) > 0 {
+		prefixes := Prefixes(v.Unmapped)
+		if len(prefixes) > 5 {
+			prefixes = append(prefixes[:5], "...")
+		}
+		slog.Warn(fmt.Sprintf("%d of %d %s paths match no [[path_map]] rule, unmapped directories: %s",
+			len(v.Unmapped), v.Checked, server, strings.Join(prefixes, ", ")))
+	}
+
+	if len(v.Missing) > 0 {
+		slog.Info(fmt.Sprintf("%d of %d %s paths are not in %s", len(v.Missing), v.Checked, server, root))
+		for _, p := range v.Missing {
+			slog.Debug(fmt.Sprintf("%s path %s is not in %s", server, p, root))
+		}
+	}
+}
+
+// OK returns true when every path resolved
+func (v Validation) OK() bool {
+	return len(v.Unmapped) == 0 && len(v.Missing) == 0
+}
+
+// Returns the unresolved paths of v in a comparable form, empty when every path resolved
+func (v Validation) key() string {
+	if v.OK() {
+		return ""
+	}
+	return strings.Join(slices.Sorted(slices.Values(v.Unmapped)), "\n") + "\x00" + strings.Join(slices.Sorted(slices.Values(v.Missing)), "\n")
+}
+
+// Prefixes returns the distinct parent directories of paths, the prefixes a [[path_map]] rule is missing for
+func Prefixes(paths []string) []string {
+	prefixes := make([]string, 0)
+	for _, p := range paths {
+		dir := p[:max(strings.LastIndexAny(p, `/\`), 0)]
+		if !slices.Contains(prefixes, dir) {
+			prefixes = append(prefixes, dir)
+		}
+	}
+	slices.Sort(prefixes)
+	return prefixes
+}
@@ -0,0 +1,69 @@
+package plex
+
+import (
+	"context"
+	"time"
+
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// Watch state of every movie and episode file with views or a playback position, per account. Plex keys
+// the settings of an item by its guid, so they follow the item across library rescans.
+const dbItemsQuery = `
+SELECT COALESCE(a.name, CAST(s.account_id AS TEXT)), p.file, COALESCE(s.view_count, 0),
+	COALESCE(s.view_offset, 0), COALESCE(CAST(s.last_viewed_at AS INTEGER), 0)
+FROM metadata_item_settings s
+JOIN metadata_items m ON m.guid = s.guid
+JOIN media_items mi ON mi.metadata_item_id = m.id
+JOIN media_parts p ON p.media_item_id = mi.id
+LEFT JOIN accounts a ON a.id = s.account_id
+WHERE m.metadata_type IN (1, 4) AND p.file IS NOT NULL AND p.file != ''
+	AND (s.view_count > 0 OR s.view_offset > 0 OR s.last_viewed_at > 0)
+ORDER BY s.account_id, p.file`
+
+// DB reads view counts, last viewed times and playback positions of every account straight from the
+// database of a Plex Media Server, com.plexapp.plugins.library.db, for servers whose API filo cannot
+// reach. On Deck and the watchlist are not kept in the database and are not reported.
+type DB struct {
+	Path string
+}
+
+// Returns a DB reading the Plex library database at path
+func NewDB(path string) *DB {
+	return &DB{Path: path}
+}
+
+func (d *DB) Name() string { return "plex" }
+
+// Items returns the watched and partially watched movies and episodes of every account
+func (d *DB) Items(ctx context.Context) ([]mediaserver.Item, error) {
+	db, err := mediaserver.OpenDB(d.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.QueryContext(ctx, dbItemsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]mediaserver.Item, 0)
+	for rows.Next() {
+		var item mediaserver.Item
+		var viewOffset, lastViewedAt int64
+		if err := rows.Scan(&item.User, &item.Path, &item.PlayCount, &viewOffset, &lastViewedAt); err != nil {
+			return nil, err
+		}
+
+		if lastViewedAt > 0 {
+			item.LastPlayed = time.Unix(lastViewedAt, 0)
+		}
+		item.Played = item.PlayCount > 0 || !item.LastPlayed.IsZero()
+		item.Resume = time.Duration(viewOffset) * time.Millisecond
+		result = append(result, item)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,478 @@
+// Package plex reads the watch state of a Plex account through the Plex Media Server HTTP API
+package plex
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// Default plex.tv endpoint serving the watchlist of the account
+const DiscoverURL = "https://discover.provider.plex.tv"
+
+// Number of items requested per page
+const pageSize = 500
+
+// Number of history entries read, newest first
+const historySize = 200
+
+// Client reads On Deck, watch history, the watchlist and view counts from a Plex Media Server. Plex
+// tokens belong to a single account, every item is reported for that account.
+type Client struct {
+	URL         string
+	Token       string
+	DiscoverURL string // plex.tv endpoint serving the watchlist, see DiscoverURL
+	HTTP        *http.Client
+}
+
+// Returns a Client for the Plex Media Server at serverURL authenticating with token
+func New(serverURL, token string) *Client {
+	return &Client{URL: strings.TrimRight(serverURL, "/"), Token: token, DiscoverURL: DiscoverURL, HTTP: http.DefaultClient}
+}
+
+func (c *Client) Name() string { return "plex" }
+
+type part struct {
+	File string `json:"file"`
+}
+
+type location struct {
+	Path string `json:"path"`
+}
+
+type media struct {
+	Part []part `json:"Part"`
+}
+
+type metadata struct {
+	RatingKey       string     `json:"ratingKey"`
+	GUID            string     `json:"guid"`
+	GrandparentGUID string     `json:"grandparentGuid"` // show of an episode
+	Type            string     `json:"type"`
+	Title           string     `json:"title"`
+	ViewCount       int        `json:"viewCount"`
+	ViewOffset      int64      `json:"viewOffset"`   // milliseconds
+	LastViewedAt    int64      `json:"lastViewedAt"` // unix seconds
+	ViewedAt        int64      `json:"viewedAt"`     // unix seconds, history entries only
+	Media           []media    `json:"Media"`
+	Location        []location `json:"Location"` // directories of a show
+}
+
+type directory struct {
+	Key      string     `json:"key"`
+	Type     string     `json:"type"`
+	Title    string     `json:"title"`
+	Location []location `json:"Location"` // folders of a library section
+}
+
+type mediaContainer struct {
+	Size      int         `json:"size"`
+	TotalSize int         `json:"totalSize"`
+	Metadata  []metadata  `json:"Metadata"`
+	Directory []directory `json:"Directory"`
+}
+
+type response struct {
+	MediaContainer mediaContainer `json:"MediaContainer"`
+}
+
+// Returns the files of every media part of m
+func (m metadata) files() []string {
+	files := make([]string, 0, 1)
+	for _, md := range m.Media {
+		for _, p := range md.Part {
+			if p.File != "" {
+				files = append(files, p.File)
+			}
+		}
+	}
+	return files
+}
+
+// Sends a GET for path with query to baseURL. The caller closes the body of the response.
+func (c *Client) send(ctx context.Context, baseURL, path string, query url.Values) (*http.Response, error) {
+	endpoint := baseURL + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Plex-Token", c.Token)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Sends a GET for path with query to baseURL and decodes the MediaContainer of the JSON response
+func (c *Client) get(ctx context.Context, baseURL, path string, query url.Values) (*mediaContainer, error) {
+	resp, err := c.send(ctx, baseURL, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("GET %s: %s", path, err.Error())
+	}
+	return &r.MediaContainer, nil
+}
+
+// Returns every item of a paged query, requesting pageSize items at a time
+func (c *Client) all(ctx context.Context, baseURL, path string, query url.Values) ([]metadata, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	items := make([]metadata, 0)
+	for {
+		query.Set("X-Plex-Container-Start", strconv.Itoa(len(items)))
+		query.Set("X-Plex-Container-Size", strconv.Itoa(pageSize))
+
+		page, err := c.get(ctx, baseURL, path, query)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, page.Metadata...)
+		if len(page.Metadata) == 0 || page.TotalSize == 0 || len(items) >= page.TotalSize {
+			return items, nil
+		}
+	}
+}
+
+// Returns the movies and episodes of the movie and show libraries of the server matching filter, a query
+// selecting a subset such as the watched items, the libraries are never listed whole
+func (c *Client) library(ctx context.Context, filter url.Values) ([]metadata, error) {
+	sections, err := c.get(ctx, c.URL, "/library/sections", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]metadata, 0)
+	for _, section := range sections.Directory {
+		query := url.Values{}
+		switch section.Type {
+		case "movie":
+		case "show":
+			query.Set("type", "4") // episodes rather than shows
+		default:
+			continue
+		}
+		for key, values := range filter {
+			query[key] = values
+		}
+
+		sectionItems, err := c.all(ctx, c.URL, "/library/sections/"+section.Key+"/all", query)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, sectionItems...)
+	}
+
+	return items, nil
+}
+
+// Returns the movies and episodes of the server matching the guids on the watchlist, the episodes of
+// the shows on it
+func (c *Client) watchlisted(ctx context.Context, watchlist map[string]bool) ([]metadata, error) {
+	items := make([]metadata, 0)
+	for _, guid := range slices.Sorted(maps.Keys(watchlist)) {
+		matches, err := c.get(ctx, c.URL, "/library/all", url.Values{"guid": {guid}})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range matches.Metadata {
+			if m.Type != "show" {
+				items = append(items, m)
+				continue
+			}
+
+			episodes, err := c.all(ctx, c.URL, "/library/metadata/"+url.PathEscape(m.RatingKey)+"/allLeaves", nil)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, episodes...)
+		}
+	}
+
+	return items, nil
+}
+
+// Returns the guids on the watchlist of the account, nil when there is no DiscoverURL
+func (c *Client) watchlist(ctx context.Context) (map[string]bool, error) {
+	if c.DiscoverURL == "" {
+		return nil, nil
+	}
+
+	items, err := c.all(ctx, strings.TrimRight(c.DiscoverURL, "/"), "/library/sections/watchlist/all", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	guids := make(map[string]bool, len(items))
+	for _, m := range items {
+		guids[m.GUID] = true
+	}
+	return guids, nil
+}
+
+// Returns the items most recently watched, as library items with their viewedAt time
+func (c *Client) history(ctx context.Context) (map[string]time.Time, error) {
+	history, err := c.get(ctx, c.URL, "/status/sessions/history/all", url.Values{
+		"sort":                  {"viewedAt:desc"},
+		"X-Plex-Container-Size": {strconv.Itoa(historySize)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	viewed := make(map[string]time.Time, len(history.Metadata))
+	for _, m := range history.Metadata {
+		if at := time.Unix(m.ViewedAt, 0); at.After(viewed[m.RatingKey]) {
+			viewed[m.RatingKey] = at
+		}
+	}
+	return viewed, nil
+}
+
+// Items returns the On Deck, watched, watchlisted and partially watched items of the account. Only those
+// are read from the server, not the whole library.
+func (c *Client) Items(ctx context.Context) ([]mediaserver.Item, error) {
+	watched, err := c.library(ctx, url.Values{"unwatched": {"0"}})
+	if err != nil {
+		return nil, err
+	}
+
+	inProgress, err := c.library(ctx, url.Values{"inProgress": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+
+	onDeck, err := c.get(ctx, c.URL, "/library/onDeck", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	viewed, err := c.history(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	watchlist, err := c.watchlist(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	listed, err := c.watchlisted(ctx, watchlist)
+	if err != nil {
+		return nil, err
+	}
+
+	onList := make(map[string]bool, len(listed))
+	for _, m := range listed {
+		onList[m.RatingKey] = true
+	}
+
+	// An item may be returned by several of the queries
+	library := make([]metadata, 0)
+	seen := make(map[string]bool)
+	for _, m := range slices.Concat(watched, inProgress, onDeck.Metadata, listed) {
+		if !seen[m.RatingKey] {
+			seen[m.RatingKey] = true
+			library = append(library, m)
+		}
+	}
+
+	deck := make(map[string]bool, len(onDeck.Metadata))
+	for _, m := range onDeck.Metadata {
+		deck[m.RatingKey] = true
+	}
+
+	result := make([]mediaserver.Item, 0)
+	for _, m := range library {
+		lastPlayed := time.Time{}
+		if m.LastViewedAt > 0 {
+			lastPlayed = time.Unix(m.LastViewedAt, 0)
+		}
+		if at, ok := viewed[m.RatingKey]; ok && at.After(lastPlayed) {
+			lastPlayed = at
+		}
+
+		item := mediaserver.Item{
+			Played:     m.ViewCount > 0 || !lastPlayed.IsZero(),
+			PlayCount:  m.ViewCount,
+			Watchlist:  onList[m.RatingKey] || watchlist[m.GUID] || (m.GrandparentGUID != "" && watchlist[m.GrandparentGUID]),
+			Resume:     time.Duration(m.ViewOffset) * time.Millisecond,
+			NextUp:     deck[m.RatingKey],
+			LastPlayed: lastPlayed,
+		}
+
+		if !item.Played && !item.Watchlist && item.Resume == 0 && !item.NextUp {
+			continue
+		}
+
+		for _, file := range m.files() {
+			item.Path = file
+			result = append(result, item)
+		}
+	}
+
+	return result, nil
+}
+
+// ItemPaths returns the files of the item with the given rating key, or its directories for shows
+func (c *Client) ItemPaths(ctx context.Context, ratingKey string) ([]string, error) {
+	items, err := c.get(ctx, c.URL, "/library/metadata/"+url.PathEscape(ratingKey), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	for _, m := range items.Metadata {
+		for _, l := range m.Location {
+			paths = append(paths, l.Path)
+		}
+		paths = append(paths, m.files()...)
+	}
+
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no Plex item with a path for rating key %s", ratingKey)
+	}
+	return paths, nil
+}
+
+// CollectionPaths returns the files of the items in the collections and playlists called names, or their
+// directories for shows and seasons
+func (c *Client) CollectionPaths(ctx context.Context, names []string) ([]string, error) {
+	sections, err := c.get(ctx, c.URL, "/library/sections", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rating keys of the collections and playlists with the path listing their items
+	lists := make(map[string]string)
+	found := make(map[string]bool, len(names))
+	match := func(items []metadata, itemsPath func(ratingKey string) string) {
+		for _, m := range items {
+			i := slices.IndexFunc(names, func(name string) bool { return strings.EqualFold(name, m.Title) })
+			if i >= 0 {
+				found[names[i]] = true
+				lists[m.RatingKey] = itemsPath(m.RatingKey)
+			}
+		}
+	}
+
+	for _, section := range sections.Directory {
+		if section.Type != "movie" && section.Type != "show" {
+			continue
+		}
+
+		collections, err := c.all(ctx, c.URL, "/library/sections/"+section.Key+"/collections", nil)
+		if err != nil {
+			return nil, err
+		}
+		match(collections, func(ratingKey string) string { return "/library/collections/" + ratingKey + "/children" })
+	}
+
+	playlists, err := c.all(ctx, c.URL, "/playlists", url.Values{"playlistType": {"video"}})
+	if err != nil {
+		return nil, err
+	}
+	match(playlists, func(ratingKey string) string { return "/playlists/" + ratingKey + "/items" })
+
+	for _, name := range names {
+		if !found[name] {
+			return nil, fmt.Errorf("no Plex collection or playlist named '%s'", name)
+		}
+	}
+
+	paths := make([]string, 0)
+	for _, ratingKey := range slices.Sorted(maps.Keys(lists)) {
+		members, err := c.all(ctx, c.URL, lists[ratingKey], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range members {
+			memberPaths := m.files()
+			if len(memberPaths) == 0 {
+				// Shows and seasons are listed without their folders
+				if memberPaths, err = c.ItemPaths(ctx, m.RatingKey); err != nil {
+					return nil, err
+				}
+			}
+
+			for _, p := range memberPaths {
+				if !slices.Contains(paths, p) {
+					paths = append(paths, p)
+				}
+			}
+		}
+	}
+
+	return paths, nil
+}
+
+// Returns true when p is the library folder location or a path below it
+func below(p, location string) bool {
+	location = strings.TrimRight(location, `/\`)
+	rest, ok := strings.CutPrefix(p, location)
+	return ok && (rest == "" || rest[0] == '/' || rest[0] == '\\')
+}
+
+// Refresh asks the server to rescan dirs, each in the library section whose folder holds it. Dirs outside
+// every section are skipped with a warning, retrying would not find them a section either.
+func (c *Client) Refresh(ctx context.Context, dirs []string) error {
+	sections, err := c.get(ctx, c.URL, "/library/sections", nil)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		key, longest := "", -1
+		for _, section := range sections.Directory {
+			for _, l := range section.Location {
+				if below(dir, l.Path) && len(l.Path) > longest {
+					key, longest = section.Key, len(l.Path)
+				}
+			}
+		}
+
+		if key == "" {
+			slog.Warn(fmt.Sprintf("no Plex library section holds %s, skipping its refresh", dir))
+			continue
+		}
+
+		resp, err := c.send(ctx, c.URL, "/library/sections/"+key+"/refresh", url.Values{"path": {dir}})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+
+	return nil
+}
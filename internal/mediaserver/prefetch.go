@@ -0,0 +1,146 @@
+package mediaserver
+
+import (
+	"cmp"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+// Episode is the season and episode number parsed from the name of an episode file
+type Episode struct {
+	Season int
+	Number int
+}
+
+func (e Episode) Compare(other Episode) int {
+	if c := cmp.Compare(e.Season, other.Season); c != 0 {
+		return c
+	}
+	return cmp.Compare(e.Number, other.Number)
+}
+
+var (
+	episodeSxE   = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])s(\d{1,3})[ ._-]?e(\d{1,4})`) // S01E02, s1.e2
+	episodeNxN   = regexp.MustCompile(`(?:^|[^0-9])(\d{1,2})x(\d{2,3})(?:[^0-9]|$)`)    // 1x02
+	seasonFolder = regexp.MustCompile(`(?i)^(?:season|series|staffel|saison|s)[ ._-]*\d+$|^specials$`)
+)
+
+// ParseEpisode returns the season and episode number in the file name, false when it has neither
+func ParseEpisode(name string) (Episode, bool) {
+	for _, re := range []*regexp.Regexp{episodeSxE, episodeNxN} {
+		if m := re.FindStringSubmatch(name); m != nil {
+			season, _ := strconv.Atoi(m[1])
+			number, _ := strconv.Atoi(m[2])
+			return Episode{Season: season, Number: number}, true
+		}
+	}
+	return Episode{}, false
+}
+
+// Returns the directory of the show the episode file n belongs to, the parent of its season folder
+// when there is one. Returns nil when there is no show directory, the episodes at the root of the source
+// belong to unrelated shows.
+func showOf(src *fs.FileTree, n *fs.FileNode) *fs.FileNode {
+	show := n.Parent
+	if show != nil && show != src.Root && show.Parent != nil && seasonFolder.MatchString(strings.TrimSpace(show.Entry.Name())) {
+		show = show.Parent
+	}
+
+	if show == nil || show == src.Root {
+		return nil
+	}
+	return show
+}
+
+// Returns the episode files below show ordered by season and episode number, files without numbers are left out
+func showEpisodes(show *fs.FileNode) []*fs.FileNode {
+	type numbered struct {
+		node    *fs.FileNode
+		episode Episode
+	}
+
+	episodes := make([]numbered, 0)
+	for _, f := range show.Files() {
+		if e, ok := ParseEpisode(f.Entry.Name()); ok {
+			episodes = append(episodes, numbered{node: f, episode: e})
+		}
+	}
+
+	slices.SortStableFunc(episodes, func(this, that numbered) int {
+		if c := this.episode.Compare(that.episode); c != 0 {
+			return c
+		}
+		return strings.Compare(this.node.Path, that.node.Path)
+	})
+
+	nodes := make([]*fs.FileNode, 0, len(episodes))
+	for _, e := range episodes {
+		nodes = append(nodes, e.node)
+	}
+	return nodes
+}
+
+// watched is a file of the source tree a user played or started
+type watched struct {
+	node *fs.FileNode
+	item Item
+}
+
+// prefetch ranks the episodes around the cursor of each show a user is watching, the episode they
+// watched last. The n episodes after the cursor get PriorityPrefetch minus their distance from it, so
+// they are on the target ahead of everything ranked by recency. The cursor itself counts as the first
+// of them while it is only partially watched. Fully watched episodes before the cursor get PriorityBehind.
+// scores holds the scores of the user by file and is updated in place.
+func prefetch(src *fs.FileTree, history []watched, n int, scores map[*fs.FileNode]int) {
+	byShow := make(map[*fs.FileNode][]watched)
+	for _, w := range history {
+		if _, ok := ParseEpisode(w.node.Entry.Name()); !ok {
+			continue
+		}
+
+		show := showOf(src, w.node)
+		if show == nil {
+			continue
+		}
+		byShow[show] = append(byShow[show], w)
+	}
+
+	for show, history := range byShow {
+		episodes := showEpisodes(show)
+		position := make(map[*fs.FileNode]int, len(episodes))
+		for i, e := range episodes {
+			position[e] = i
+		}
+
+		// The cursor is the episode played last, the furthest one when play dates are missing
+		cursor := slices.MaxFunc(history, func(this, that watched) int {
+			if c := this.item.LastPlayed.Compare(that.item.LastPlayed); c != 0 {
+				return c
+			}
+			return cmp.Compare(position[this.node], position[that.node])
+		})
+
+		at := position[cursor.node]
+		start := at + 1
+		if cursor.item.Resume > 0 {
+			start = at
+		}
+
+		for i := start; i < min(start+n, len(episodes)); i++ {
+			score := PriorityPrefetch - (i - start)
+			if current, ok := scores[episodes[i]]; !ok || score > current {
+				scores[episodes[i]] = score
+			}
+		}
+
+		for _, w := range history {
+			if position[w.node] < start && w.item.Played && w.item.Resume == 0 && scores[w.node] <= PriorityPlayed {
+				scores[w.node] = PriorityBehind
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package mediaserver
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Longest wait between two attempts of a failed refresh
+const maxRefreshBackoff = 30 * time.Minute
+
+// Refresher is a media server whose libraries can be rescanned one directory at a time
+type Refresher interface {
+	Name() string
+	// Refresh rescans dirs, directories as the server sees them
+	Refresh(ctx context.Context, dirs []string) error
+}
+
+// LibraryRefresh asks media servers whose libraries point at the target to rescan the target directories
+// filo changed, so they do not show stale entries until their next scheduled scan
+type LibraryRefresh struct {
+	Servers []Refresher
+	PathMap *PathMap      // rewrites target paths to the paths of the servers, nil leaves them unchanged
+	Delay   time.Duration // quiet period merging the changes of back to back syncs into one refresh
+	Retries int           // attempts after a failed refresh, the wait between them doubles from Delay
+}
+
+// pendingRefresh is the directories a server has yet to rescan
+type pendingRefresh struct {
+	dirs    map[string]bool
+	due     time.Time
+	attempt int
+}
+
+// Run refreshes the directories received on changed, target paths, until exit is closed. The directories
+// are rescanned once no change arrived for Delay, a server that fails is retried Retries times.
+func (r *LibraryRefresh) Run(changed <-chan []string, exit <-chan struct{}) {
+	pending := make([]pendingRefresh, len(r.Servers))
+	for {
+		var next time.Time
+		for _, p := range pending {
+			if len(p.dirs) > 0 && (next.IsZero() || p.due.Before(next)) {
+				next = p.due
+			}
+		}
+
+		// A nil channel never fires, nothing is pending
+		var wait <-chan time.Time
+		if !next.IsZero() {
+			wait = time.After(time.Until(next))
+		}
+
+		select {
+		case dirs := <-changed:
+			due := time.Now().Add(r.Delay)
+			for i := range pending {
+				if pending[i].dirs == nil {
+					pending[i].dirs = make(map[string]bool)
+				}
+				for _, dir := range dirs {
+					pending[i].dirs[dir] = true
+				}
+				if due.After(pending[i].due) {
+					pending[i].due = due
+				}
+			}
+
+		case <-wait:
+			for i, server := range r.Servers {
+				p := &pending[i]
+				if len(p.dirs) == 0 || time.Now().Before(p.due) {
+					continue
+				}
+
+				err := r.refresh(server, slices.Sorted(maps.Keys(p.dirs)))
+				if err == nil {
+					*p = pendingRefresh{}
+					continue
+				}
+
+				p.attempt++
+				if p.attempt > r.Retries {
+					slog.Error(fmt.Sprintf("%s library refresh failed, giving up after %d attempts: %s", server.Name(), p.attempt, err.Error()))
+					*p = pendingRefresh{}
+					continue
+				}
+
+				backoff := min(r.Delay<<p.attempt, maxRefreshBackoff)
+				slog.Warn(fmt.Sprintf("%s library refresh failed, retrying in %v: %s", server.Name(), backoff, err.Error()))
+				p.due = time.Now().Add(backoff)
+			}
+
+		case <-exit:
+			return
+		}
+	}
+}
+
+// Rescans dirs, target paths, on server
+func (r *LibraryRefresh) refresh(server Refresher, dirs []string) error {
+	serverDirs := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		serverDir, ok := r.PathMap.ToServer(dir)
+		if !ok {
+			slog.Warn(fmt.Sprintf("%s is not mapped to a %s path, skipping its refresh, check [[path_map]]", dir, server.Name()))
+			continue
+		}
+		serverDirs = append(serverDirs, serverDir)
+	}
+
+	if len(serverDirs) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), Timeout)
+	defer cancel()
+
+	if err := server.Refresh(ctx, serverDirs); err != nil {
+		return err
+	}
+
+	slog.Info(fmt.Sprintf("%s refreshing %d directories: %v", server.Name(), len(serverDirs), serverDirs))
+	return nil
+}
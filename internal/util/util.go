@@ -62,7 +62,9 @@ func BytesToString(bytes uint64) string {
 	}
 }
 
-func PrintConfig(cfg *config.Config, srcUsage *disk.UsageStat, targetUsage *disk.UsageStat) {
+// PrintConfig prints the configuration along with the disk usage of both dirs.
+// managed is the number of bytes filo holds on the target, used to show the effective budget.
+func PrintConfig(cfg *config.Config, srcUsage *disk.UsageStat, targetUsage *disk.UsageStat, managed uint64) {
 	// Define some reusable colors
 	header := color.New(color.FgCyan, color.Bold).SprintFunc()
 	label := color.New(color.FgWhite, color.Bold).SprintFunc()
@@ -81,14 +83,24 @@ func PrintConfig(cfg *config.Config, srcUsage *disk.UsageStat, targetUsage *disk
 	fmt.Printf("%s %s\n", label(" Total Size :"), value(BytesToString(srcUsage.Free+srcUsage.Used)))
 	fmt.Println(header("---------------------------------------------"))
 	fmt.Printf("%s %.2f\n", label(" Max Fill   :"), cfg.MaxFill)
+	if cfg.HighFill > 0 || cfg.LowFill > 0 {
+		fmt.Printf("%s %.2f / %.2f\n", label(" High / Low :"), cfg.HighFill, cfg.LowFill)
+	}
+	if cfg.MaxBytes > 0 {
+		fmt.Printf("%s %s\n", label(" Max Bytes  :"), BytesToString(uint64(cfg.MaxBytes)))
+	}
+	if cfg.ReserveFree > 0 {
+		fmt.Printf("%s %s\n", label(" Reserve    :"), BytesToString(uint64(cfg.ReserveFree)))
+	}
+	budget := cfg.Budget(targetUsage.Total, targetUsage.Used, targetUsage.Free, managed)
+	fmt.Printf("%s %s %s\n", label(" Budget     :"), value(BytesToString(budget)),
+		fmt.Sprintf("(%s managed)", BytesToString(managed)))
 	fmt.Printf("%s %s\n", label(" Sync Delay :"), cfg.SyncDelay)
 	fmt.Printf("%s %s\n", label(" Log Level  :"), value(cfg.LogLevel))
 	fmt.Println(header("============================================="))
 }
 
-func PrintIntro(cfg *config.Config) {
-	PrintBanner()
-
+func PrintIntro(cfg *config.Config, managed uint64) {
 	targetUsage, err := disk.Usage(cfg.TargetDir)
 	if err != nil {
 		slog.Error(err.Error() + " " + cfg.TargetDir)
@@ -101,7 +113,7 @@ func PrintIntro(cfg *config.Config) {
 		return
 	}
 
-	PrintConfig(cfg, srcUsage, targetUsage)
+	PrintConfig(cfg, srcUsage, targetUsage, managed)
 	slog.Info(fmt.Sprintf("Starting FILO watch on '%s'...", cfg.SourceDir))
 
 }
@@ -0,0 +1,290 @@
+// Package webhook receives Jellyfin, Plex and Sonarr/Radarr webhooks and turns the items they reference
+// into source paths to sync right away, see fs.SyncChanges
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// ErrIgnored is returned for events that do not call for a sync, i.e a Sonarr test or a playback stop
+var ErrIgnored = errors.New("event ignored")
+
+// Largest request body read, Plex sends the poster along with the payload
+const maxBody = 8 << 20
+
+// Event is a webhook referencing the paths or the media server items to sync. Paths and Items are as
+// the sender sees them, Items are resolved to paths by the Resolver of Source.
+type Event struct {
+	Source string
+	Type   string
+	User   string
+	Paths  []string
+	Items  []string
+}
+
+// Resolver returns the paths of a media server item, see jellyfin.Client and plex.Client
+type Resolver interface {
+	ItemPaths(ctx context.Context, id string) ([]string, error)
+}
+
+type jellyfinPayload struct {
+	NotificationType     string `json:"NotificationType"`
+	NotificationUsername string `json:"NotificationUsername"`
+	ItemID               string `json:"ItemId"`
+	ItemType             string `json:"ItemType"`
+	SeriesID             string `json:"SeriesId"`
+}
+
+// ParseJellyfin parses a payload of the Jellyfin Webhook plugin. Starting an episode syncs its series,
+// starting anything else or adding an item syncs the item.
+func ParseJellyfin(body []byte) (*Event, error) {
+	var p jellyfinPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("jellyfin payload: %s", err.Error())
+	}
+
+	e := &Event{Source: "jellyfin", Type: p.NotificationType, User: p.NotificationUsername}
+	switch p.NotificationType {
+	case "PlaybackStart":
+		if p.ItemType == "Episode" && p.SeriesID != "" {
+			e.Items = []string{p.SeriesID}
+		} else {
+			e.Items = []string{p.ItemID}
+		}
+	case "ItemAdded":
+		e.Items = []string{p.ItemID}
+	default:
+		return nil, fmt.Errorf("jellyfin %s: %w", p.NotificationType, ErrIgnored)
+	}
+
+	if e.Items[0] == "" {
+		return nil, fmt.Errorf("jellyfin %s: no ItemId", p.NotificationType)
+	}
+	return e, nil
+}
+
+type plexPayload struct {
+	Event   string `json:"event"`
+	Account struct {
+		Title string `json:"title"`
+	} `json:"Account"`
+	Metadata struct {
+		RatingKey            string `json:"ratingKey"`
+		GrandparentRatingKey string `json:"grandparentRatingKey"` // show of an episode
+		Type                 string `json:"type"`
+	} `json:"Metadata"`
+}
+
+// ParsePlex parses the JSON payload of a Plex webhook. Playing an episode syncs its show, playing
+// anything else or adding an item to a library syncs the item.
+func ParsePlex(payload []byte) (*Event, error) {
+	var p plexPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, fmt.Errorf("plex payload: %s", err.Error())
+	}
+
+	e := &Event{Source: "plex", Type: p.Event, User: p.Account.Title}
+	switch p.Event {
+	case "media.play", "media.resume":
+		if p.Metadata.Type == "episode" && p.Metadata.GrandparentRatingKey != "" {
+			e.Items = []string{p.Metadata.GrandparentRatingKey}
+		} else {
+			e.Items = []string{p.Metadata.RatingKey}
+		}
+	case "library.new":
+		e.Items = []string{p.Metadata.RatingKey}
+	default:
+		return nil, fmt.Errorf("plex %s: %w", p.Event, ErrIgnored)
+	}
+
+	if e.Items[0] == "" {
+		return nil, fmt.Errorf("plex %s: no ratingKey", p.Event)
+	}
+	return e, nil
+}
+
+type arrFile struct {
+	Path         string `json:"path"`
+	RelativePath string `json:"relativePath"`
+}
+
+type arrPayload struct {
+	EventType string `json:"eventType"`
+	Series    struct {
+		Path string `json:"path"`
+	} `json:"series"`
+	Movie struct {
+		FolderPath string `json:"folderPath"`
+	} `json:"movie"`
+	EpisodeFile  *arrFile  `json:"episodeFile"`
+	EpisodeFiles []arrFile `json:"episodeFiles"` // season packs
+	MovieFile    *arrFile  `json:"movieFile"`
+}
+
+// ParseArr parses the payload of a Sonarr or Radarr webhook, source is "sonarr" or "radarr". Only the
+// "On Import" (Download) event syncs, its imported files.
+func ParseArr(source string, body []byte) (*Event, error) {
+	var p arrPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, fmt.Errorf("%s payload: %s", source, err.Error())
+	}
+
+	if p.EventType != "Download" {
+		return nil, fmt.Errorf("%s %s: %w", source, p.EventType, ErrIgnored)
+	}
+
+	e := &Event{Source: source, Type: p.EventType, Paths: make([]string, 0)}
+	add := func(f arrFile, dir string) {
+		switch {
+		case f.Path != "":
+			e.Paths = append(e.Paths, f.Path)
+		case f.RelativePath != "" && dir != "":
+			e.Paths = append(e.Paths, path.Join(dir, f.RelativePath))
+		}
+	}
+
+	if p.EpisodeFile != nil {
+		add(*p.EpisodeFile, p.Series.Path)
+	}
+	for _, f := range p.EpisodeFiles {
+		if p.EpisodeFile == nil || f.Path != p.EpisodeFile.Path {
+			add(f, p.Series.Path)
+		}
+	}
+	if p.MovieFile != nil {
+		add(*p.MovieFile, p.Movie.FolderPath)
+	}
+
+	if len(e.Paths) == 0 {
+		return nil, fmt.Errorf("%s %s: no imported file", source, p.EventType)
+	}
+	return e, nil
+}
+
+// Handler serves the webhook endpoints, POST /jellyfin, /plex, /sonarr and /radarr, and sends the local
+// paths of every accepted event on Sync
+type Handler struct {
+	Token     string               // required in the token query parameter when set
+	Resolvers map[string]Resolver  // by Event.Source, resolves Event.Items
+	PathMap   *mediaserver.PathMap // rewrites the paths of the senders to source paths
+	Sync      chan<- []string
+}
+
+// Returns the event in the request r to the endpoint of source
+func parse(source string, r *http.Request) (*Event, error) {
+	if source == "plex" {
+		if err := r.ParseMultipartForm(maxBody); err != nil {
+			return nil, fmt.Errorf("plex payload: %s", err.Error())
+		}
+		return ParsePlex([]byte(r.FormValue("payload")))
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch source {
+	case "jellyfin":
+		return ParseJellyfin(body)
+	case "sonarr", "radarr":
+		return ParseArr(source, body)
+	}
+	return nil, fmt.Errorf("no webhook endpoint for %s", source)
+}
+
+// Paths returns the source paths of e, resolving its items through the Resolver of e.Source
+func (h *Handler) Paths(ctx context.Context, e *Event) ([]string, error) {
+	remote := append(make([]string, 0, len(e.Paths)), e.Paths...)
+	if len(e.Items) > 0 {
+		resolver, ok := h.Resolvers[e.Source]
+		if !ok {
+			return nil, fmt.Errorf("no %s server configured to look up items", e.Source)
+		}
+
+		for _, id := range e.Items {
+			paths, err := resolver.ItemPaths(ctx, id)
+			if err != nil {
+				return nil, err
+			}
+			remote = append(remote, paths...)
+		}
+	}
+
+	local := make([]string, 0, len(remote))
+	for _, p := range remote {
+		l, ok := h.PathMap.ToLocal(p)
+		if !ok {
+			slog.Warn(fmt.Sprintf("%s path %s matches no [[path_map]] rule", e.Source, p))
+			continue
+		}
+		local = append(local, l)
+	}
+	return local, nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	source := strings.Trim(r.URL.Path, "/")
+	switch source {
+	case "jellyfin", "plex", "sonarr", "radarr":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if h.Token != "" && r.URL.Query().Get("token") != h.Token {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+	e, err := parse(source, r)
+	if errors.Is(err, ErrIgnored) {
+		slog.Debug(fmt.Sprintf("webhook: %s", err.Error()))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err != nil {
+		slog.Warn(fmt.Sprintf("webhook: %s", err.Error()))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), mediaserver.Timeout)
+	defer cancel()
+
+	paths, err := h.Paths(ctx, e)
+	if err != nil {
+		slog.Warn(fmt.Sprintf("webhook %s %s: %s", e.Source, e.Type, err.Error()))
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if len(paths) == 0 {
+		http.Error(w, "no path of the event is mapped to source_dir", http.StatusUnprocessableEntity)
+		return
+	}
+
+	slog.Info(fmt.Sprintf("webhook %s %s: syncing %v", e.Source, e.Type, paths))
+	select {
+	case h.Sync <- paths:
+		w.WriteHeader(http.StatusAccepted)
+	case <-ctx.Done():
+		http.Error(w, "sync busy", http.StatusServiceUnavailable)
+	}
+}
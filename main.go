@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
@@ -11,7 +13,11 @@ import (
 
 	"bebop831.com/filo/internal/config"
 	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/jellyfin"
+	"bebop831.com/filo/internal/mediaserver/plex"
 	"bebop831.com/filo/internal/util"
+	"bebop831.com/filo/internal/webhook"
 
 	"github.com/fsnotify/fsnotify"
 )
@@ -25,50 +31,253 @@ func init() {
 	maxFileSemaphore = make(chan struct{}, Cfg.MaxOpenFile)
 }
 
+// Returns the media servers set in cfg to read watch history from, through their database when one is set
+func mediaServers(cfg *config.Config) []mediaserver.Server {
+	servers := make([]mediaserver.Server, 0)
+	if cfg.Jellyfin.Database != "" {
+		servers = append(servers, jellyfin.NewDB(cfg.Jellyfin.Database, cfg.Jellyfin.PlaybackReporting, cfg.Jellyfin.Users))
+	} else if cfg.Jellyfin.URL != "" {
+		servers = append(servers, jellyfin.New(cfg.Jellyfin.URL, cfg.Jellyfin.APIKey, cfg.Jellyfin.Users))
+	}
+
+	if cfg.Plex.Database != "" {
+		servers = append(servers, plex.NewDB(cfg.Plex.Database))
+	} else if cfg.Plex.URL != "" {
+		servers = append(servers, plex.New(cfg.Plex.URL, cfg.Plex.Token))
+	}
+
+	return servers
+}
+
+// Returns the media servers set in cfg whose libraries point at the target and are rescanned after each sync
+func refreshers(cfg *config.Config) []mediaserver.Refresher {
+	servers := make([]mediaserver.Refresher, 0)
+	if cfg.Jellyfin.URL != "" && cfg.Jellyfin.Refresh {
+		servers = append(servers, jellyfin.New(cfg.Jellyfin.URL, cfg.Jellyfin.APIKey, cfg.Jellyfin.Users))
+	}
+
+	if cfg.Plex.URL != "" && cfg.Plex.Refresh {
+		servers = append(servers, plex.New(cfg.Plex.URL, cfg.Plex.Token))
+	}
+
+	return servers
+}
+
+// Returns the media servers set in cfg along with the names of their collections and playlists to pin
+func pinnedCollections(cfg *config.Config) []mediaserver.PinnedCollections {
+	collections := make([]mediaserver.PinnedCollections, 0)
+	if cfg.Jellyfin.URL != "" && len(cfg.Jellyfin.Collections) > 0 {
+		server := jellyfin.New(cfg.Jellyfin.URL, cfg.Jellyfin.APIKey, cfg.Jellyfin.Users)
+		collections = append(collections, mediaserver.PinnedCollections{Server: server, Names: cfg.Jellyfin.Collections})
+	}
+
+	if cfg.Plex.URL != "" && len(cfg.Plex.Collections) > 0 {
+		server := plex.New(cfg.Plex.URL, cfg.Plex.Token)
+		collections = append(collections, mediaserver.PinnedCollections{Server: server, Names: cfg.Plex.Collections})
+	}
+
+	return collections
+}
+
+// Returns the PathMap of the [[path_map]] rules of cfg, resolving the server paths on target_dir too
+func newPathMap(cfg *config.Config) (*mediaserver.PathMap, error) {
+	pathMap, err := mediaserver.NewPathMap(cfg.PathMap)
+	if err != nil {
+		return nil, err
+	}
+
+	pathMap.Target = cfg.TargetDir
+	return pathMap, nil
+}
+
+// Returns the Evictor for cfg, ranking the source by the watch history of the media servers set in cfg and
+// pinning the members of their collections. The collections are nil when none are set.
+func newEvictor(cfg *config.Config) (*fs.Evictor, *mediaserver.Collections, error) {
+	evictor, err := fs.NewEvictor(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pathMap, err := newPathMap(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prioritizers := make(fs.Prioritizers, 0)
+	if servers := mediaServers(cfg); len(servers) > 0 {
+		prioritizers = append(prioritizers, &mediaserver.Prioritizer{Servers: servers, PathMap: pathMap, Prefetch: cfg.PrefetchEpisodes})
+	}
+
+	var collections *mediaserver.Collections
+	if sources := pinnedCollections(cfg); len(sources) > 0 {
+		collections = &mediaserver.Collections{Sources: sources, PathMap: pathMap, Interval: cfg.CollectionRefresh}
+		prioritizers = append(prioritizers, collections)
+	}
+
+	if len(prioritizers) > 0 {
+		evictor.Prioritizer = prioritizers
+	}
+
+	return evictor, collections, nil
+}
+
+// Returns the webhook listener set in cfg sending the paths to sync on syncNow, nil when there is none
+func newWebhookServer(cfg *config.Config, syncNow chan<- []string) (*http.Server, error) {
+	if cfg.Webhook.Listen == "" {
+		return nil, nil
+	}
+
+	pathMap, err := newPathMap(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Items are resolved through the API even when watch history is read from a database
+	resolvers := make(map[string]webhook.Resolver)
+	if cfg.Jellyfin.URL != "" {
+		resolvers["jellyfin"] = jellyfin.New(cfg.Jellyfin.URL, cfg.Jellyfin.APIKey, cfg.Jellyfin.Users)
+	}
+
+	if cfg.Plex.URL != "" {
+		resolvers["plex"] = plex.New(cfg.Plex.URL, cfg.Plex.Token)
+	}
+
+	handler := &webhook.Handler{Token: cfg.Webhook.Token, Resolvers: resolvers, PathMap: pathMap, Sync: syncNow}
+	return &http.Server{Addr: cfg.Webhook.Listen, Handler: handler, ReadHeaderTimeout: 10 * time.Second}, nil
+}
+
 func main() {
 
-	util.PrintIntro(Cfg)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "plan":
+			runPlan(os.Args[2:])
+			return
+		case "restore":
+			runRestore(os.Args[2:])
+			return
+		case "paths":
+			runPaths(os.Args[2:])
+			return
+		case "explain":
+			runExplain(os.Args[2:])
+			return
+		case "status":
+			runStatus(os.Args[2:])
+			return
+		}
+	}
+
+	util.PrintBanner()
+
+	// Copies interrupted by a crash leave their temp files behind
+	if _, err := fs.RemoveTempFiles(Cfg.TargetDir); err != nil {
+		slog.Error(err.Error())
+	}
+
+	exitChan := make(chan struct{})
+
+	eventChan := make(chan fsnotify.Event)
+	defer close(eventChan)
+
+	// Watched before the walk, changes made while the trees are walked and synced are synced afterwards
+	wg.Go(func() {
+		fs.WatchChanges(eventChan, exitChan, Cfg)
+	})
 
 	slog.Debug("building initial FiloTrees...")
-	srcTree, err := fs.BuildTree(Cfg.SourceDir)
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	targetTree, err := fs.BuildTree(Cfg.TargetDir)
+	targetTree, err := fs.BuildTree(Cfg.TargetDir, fs.NewTreeOptions(Cfg))
 	if err != nil {
 		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
+	evictor, collections, err := newEvictor(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	evictor.Prioritize(srcTree)
+	util.PrintIntro(Cfg, fs.ManagedBytes(srcTree, targetTree))
+	evictor.CheckPinned(srcTree, targetTree)
+
+	fs.ApplyRetention(srcTree, targetTree, Cfg.Retention, time.Now(), evictor.Journal)
+
 	rightNow := time.Now()
 	slog.Debug(fmt.Sprintf("srcTree.Missingin(%v) ", targetTree.Root.Path))
 	var missing map[string][]*fs.FileNode = srcTree.MissingIn(targetTree, maxFileSemaphore, func() {
 		slog.Debug(fmt.Sprint("srcTree.Missingin(targetTree) Elapsed time: ", time.Since(rightNow)))
 	})
 
-	//Perform Initial Sync
+	//Perform Initial Sync, files still being written are left to SyncChanges
+	var held []string
 	if len(missing) != 0 {
 		slog.Info("Performing initial file sync...")
 		rightNow = time.Now()
-		targetTree.CopyFrom(srcTree, missing, maxFileSemaphore, func() {
-			slog.Debug(fmt.Sprintln(missing))
-			slog.Info(fmt.Sprint("Initial file sync complete, Elapsed time: ", time.Since(rightNow)))
-		})
+		var queue []*fs.Admission
+		queue, held, _ = fs.NewWriteGate(Cfg.WriteQuiet).Hold(fs.NewAdmissionQueue(srcTree, missing), rightNow)
+		if len(queue) > 0 {
+			evictor.Admit(srcTree, targetTree, queue, maxFileSemaphore, func() {
+				slog.Debug(fmt.Sprintln(missing))
+				slog.Info(fmt.Sprint("Initial file sync complete, Elapsed time: ", time.Since(rightNow)))
+			})
+		}
+	}
 
+	syncNow := make(chan []string, 16)
+	if len(held) > 0 {
+		// SyncChanges copies them once they settle, holding them back again until then
+		syncNow <- held
+	}
+	webhookServer, err := newWebhookServer(Cfg, syncNow)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
 	}
 
-	exitChan := make(chan struct{})
+	if webhookServer != nil {
+		wg.Go(func() {
+			slog.Info(fmt.Sprintf("Listening for webhooks on %s", webhookServer.Addr))
+			if err := webhookServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error(err.Error())
+			}
+		})
+		wg.Go(func() {
+			<-exitChan
+			webhookServer.Close()
+		})
+	}
 
-	eventChan := make(chan fsnotify.Event)
-	defer close(eventChan)
+	// A nil channel is never sent on, no media server is refreshed
+	var changed chan []string
+	if servers := refreshers(Cfg); len(servers) > 0 {
+		pathMap, err := newPathMap(Cfg)
+		if err != nil {
+			slog.Error(err.Error())
+			os.Exit(2)
+		}
+
+		changed = make(chan []string)
+		refresh := &mediaserver.LibraryRefresh{Servers: servers, PathMap: pathMap, Delay: Cfg.RefreshDelay, Retries: Cfg.RefreshRetries}
+		wg.Go(func() {
+			refresh.Run(changed, exitChan)
+		})
+	}
+
+	if collections != nil && Cfg.CollectionRefresh > 0 {
+		wg.Go(func() {
+			collections.Run(syncNow, exitChan)
+		})
+	}
 
 	wg.Go(func() {
-		fs.WatchChanges(eventChan, exitChan, Cfg)
-	})
-	wg.Go(func() {
-		fs.SyncChanges(eventChan, exitChan, maxFileSemaphore, Cfg)
+		fs.SyncChanges(srcTree, targetTree, eventChan, syncNow, changed, exitChan, maxFileSemaphore, evictor, Cfg)
 	})
 
 	ctx, _ := signal.NotifyContext(context.Background(), os.Interrupt)
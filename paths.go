@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// runPaths checks that every path reported by the media servers resolves to a file in source_dir
+// through the [[path_map]] rules. Exits with 1 when a path does not resolve.
+func runPaths(args []string) {
+	flags := flag.NewFlagSet("paths", flag.ExitOnError)
+	verbose := flags.Bool("v", false, "list every path that does not resolve")
+	flags.Parse(args)
+
+	pathMap, err := newPathMap(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	servers := mediaServers(Cfg)
+	if len(servers) == 0 {
+		slog.Error("no media server set in filo.toml")
+		os.Exit(2)
+	}
+
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mediaserver.Timeout)
+	defer cancel()
+
+	ok := true
+	for _, server := range servers {
+		items, err := server.Items(ctx)
+		if err != nil {
+			slog.Error(fmt.Sprintf("%s: %s", server.Name(), err.Error()))
+			ok = false
+			continue
+		}
+
+		paths := make([]string, 0, len(items))
+		for _, item := range items {
+			paths = append(paths, item.Path)
+		}
+
+		v := pathMap.Validate(srcTree, paths)
+		fmt.Printf("%s: %d paths, %d unmapped, %d not in %s\n", server.Name(), v.Checked, len(v.Unmapped), len(v.Missing), Cfg.SourceDir)
+		for _, dir := range mediaserver.Prefixes(v.Unmapped) {
+			fmt.Printf("  no [[path_map]] rule for %s\n", dir)
+		}
+
+		if *verbose {
+			for _, p := range v.Unmapped {
+				fmt.Printf("  unmapped %s\n", p)
+			}
+			for _, p := range v.Missing {
+				local, _ := pathMap.ToLocal(p)
+				fmt.Printf("  missing  %s -> %s\n", p, local)
+			}
+		}
+
+		ok = ok && v.OK()
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+// runPlan prints what a sync would copy, evict and delete without modifying the target
+func runPlan(args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the plan as JSON")
+	flags.Parse(args)
+
+	if *asJSON {
+		// keep stdout clean for the JSON document
+		config.SetLogOutput(Cfg, os.Stderr)
+	}
+
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	targetTree, err := fs.BuildTree(Cfg.TargetDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	evictor, _, err := newEvictor(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	evictor.Prioritize(srcTree)
+
+	plan, err := evictor.DryRun(srcTree, targetTree, maxFileSemaphore)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if !*asJSON {
+		plan.WriteText(os.Stdout)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(plan); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/util"
+)
+
+// Parses a -since/-until value, either a point in time or an age such as 7d or 36h counted back from now
+func parseJournalTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	age, err := config.ParseAge(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339, %q, %q or an age such as 7d", value, time.DateTime, time.DateOnly)
+	}
+	return now.Add(-age), nil
+}
+
+// runRestore copies files recorded in the journal back from the source into the target.
+// Positional arguments are globs selecting the paths to restore.
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	journalPath := flags.String("journal", Cfg.JournalFile, "journal file to read")
+	since := flags.String("since", "", "only restore files removed at or after this time or age (i.e 2d)")
+	until := flags.String("until", "", "only restore files removed before this time or age")
+	list := flags.Bool("n", false, "list the selected entries without restoring them")
+	flags.Parse(args)
+
+	now := time.Now()
+	filter := fs.JournalFilter{Paths: flags.Args()}
+	var err error
+	if filter.Since, err = parseJournalTime(*since, now); err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	if filter.Until, err = parseJournalTime(*until, now); err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+
+	entries, err := fs.ReadJournal(*journalPath)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	selected := filter.Filter(entries)
+	if len(selected) == 0 {
+		slog.Info(fmt.Sprintf("no entries in %s match", *journalPath))
+		return
+	}
+
+	if *list {
+		for _, entry := range selected {
+			fmt.Printf("%s  %-10s %s (%s)\n", entry.Time.Format(time.DateTime), util.BytesToString(entry.Size), entry.Path, entry.Reason)
+		}
+		return
+	}
+
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	targetTree, err := fs.BuildTree(Cfg.TargetDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	evictor, _, err := newEvictor(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	evictor.Prioritize(srcTree)
+
+	plan, err := evictor.Restore(srcTree, targetTree, selected, maxFileSemaphore)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	// Admitted files whose copy failed are not restored
+	copied := make(map[string]bool, len(plan.Copied))
+	for _, p := range plan.Copied {
+		copied[p] = true
+	}
+
+	var restored uint64
+	failed := 0
+	for _, a := range plan.Admitted {
+		for _, f := range a.Files {
+			if copied[filepath.Join(targetTree.Root.Path, srcTree.RelBaseFile(f.Path))] {
+				restored += f.Size()
+			} else {
+				failed++
+			}
+		}
+	}
+
+	slog.Info(fmt.Sprintf("Restored %d files (%s) into %s, %d units skipped", len(plan.Copied), util.BytesToString(restored), Cfg.TargetDir, len(plan.Skipped)))
+	if failed > 0 {
+		slog.Error(fmt.Sprintf("Failed to restore %d files, see the errors above", failed))
+		os.Exit(1)
+	}
+}
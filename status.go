@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log/slog"
+	"os"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+// runStatus prints how much of the target each media server user owns against their allowance
+func runStatus(args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the status as JSON")
+	flags.Parse(args)
+
+	if *asJSON {
+		// keep stdout clean for the JSON document
+		config.SetLogOutput(Cfg, os.Stderr)
+	}
+
+	srcTree, err := fs.BuildTree(Cfg.SourceDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	targetTree, err := fs.BuildTree(Cfg.TargetDir, fs.NewTreeOptions(Cfg))
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	evictor, _, err := newEvictor(Cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(2)
+	}
+	evictor.Prioritize(srcTree)
+
+	status, err := evictor.Status(srcTree, targetTree)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+
+	if !*asJSON {
+		status.WriteText(os.Stdout)
+		return
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(status); err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+package testing
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// owner is the media server user ranking a file and the priority they give it
+type owner struct {
+	user     string
+	priority int
+}
+
+// owners ranks the files at its paths, relative to the source root, for their media server user
+type owners map[string]owner
+
+func (o owners) Prioritize(src *fs.FileTree) error {
+	for relPath, owner := range o {
+		n := src.Index[filepath.Join(src.Root.Path, relPath)]
+		n.Priority = owner.priority
+		n.Watch.Users = []string{owner.user}
+	}
+	return nil
+}
+
+func TestAllowances(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	// A binge-watcher holds most of the target with prefetched episodes
+	ranks := owners{}
+	for i, name := range []string{"b1.mkv", "b2.mkv", "b3.mkv", "b4.mkv"} {
+		for _, dir := range []string{srcDir, tgtDir} {
+			writeFile(t, filepath.Join(dir, "binge", name), 200, now.Add(-time.Duration(10-i)*time.Hour))
+		}
+		ranks[filepath.Join("binge", name)] = owner{user: "jellyfin/binge", priority: mediaserver.PriorityPrefetch}
+	}
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "u1.mkv"), 100, now.Add(-20*time.Hour))
+	}
+
+	writeFile(t, filepath.Join(srcDir, "binge", "b5.mkv"), 200, now.Add(-time.Hour))
+	ranks[filepath.Join("binge", "b5.mkv")] = owner{user: "jellyfin/binge", priority: mediaserver.PriorityPrefetch}
+	writeFile(t, filepath.Join(srcDir, "guest", "g1.mkv"), 300, now.Add(-2*time.Hour))
+	ranks[filepath.Join("guest", "g1.mkv")] = owner{user: "jellyfin/guest", priority: mediaserver.PriorityResume}
+
+	tests := []struct {
+		name       string
+		allowances []config.Allowance
+		admitted   []string
+		skipped    []string
+		evicted    []string
+	}{
+		{
+			name:     "none",
+			admitted: []string{filepath.Join("binge", "b5.mkv")},
+			skipped:  []string{filepath.Join("guest", "g1.mkv")},
+			evicted:  []string{},
+		},
+		{
+			// Past their allowance the episodes of binge are unranked, so the one of guest replaces them
+			name:       "binge capped",
+			allowances: []config.Allowance{{User: "binge", Share: 0.5}, {User: "plex/binge", MaxBytes: 1}},
+			admitted:   []string{filepath.Join("binge", "b5.mkv"), filepath.Join("guest", "g1.mkv")},
+			skipped:    []string{},
+			evicted:    []string{"u1.mkv", "b1.mkv"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 1, Allowances: tt.allowances}, 1100, 900)
+			evictor.Prioritizer = ranks
+
+			srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+			evictor.Prioritize(srcTree)
+			queue := fs.NewAdmissionQueue(srcTree, srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil))
+
+			plan, err := evictor.Plan(srcTree, tgtTree, queue)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := relPaths(plan.Admitted); !slices.Equal(got, tt.admitted) {
+				t.Errorf("expected %v admitted, got %v", tt.admitted, got)
+			}
+			if got := relPaths(plan.Skipped); !slices.Equal(got, tt.skipped) {
+				t.Errorf("expected %v skipped, got %v", tt.skipped, got)
+			}
+			if got := candidateNames(plan.Evict); !slices.Equal(got, tt.evicted) {
+				t.Errorf("expected %v evicted, got %v", tt.evicted, got)
+			}
+		})
+	}
+
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 1, Allowances: tests[1].allowances}, 1100, 900)
+	evictor.Prioritizer = ranks
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+	evictor.Prioritize(srcTree)
+
+	status, err := evictor.Status(srcTree, tgtTree)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Users with an allowance on their server are listed whether they own anything or not
+	want := []fs.UserShare{
+		{User: "jellyfin/binge", Owned: 800, Units: 4, Allowance: 550},
+		{User: "plex/binge", Allowance: 1},
+	}
+	if status.Budget != 1100 || status.Managed != 900 || status.Unowned != 100 || !slices.Equal(status.Users, want) {
+		t.Errorf("expected binge to own 800 of 1100 with an allowance of 550, got %+v", status)
+	}
+}
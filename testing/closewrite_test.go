@@ -0,0 +1,62 @@
+//go:build linux
+
+package testing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestSyncChangesWaitsForCloseWrite(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	download := filepath.Join(srcDir, "movies", "Heat.mkv")
+	writeFile(t, download, 100, time.Now())
+
+	// Quiet for longer than the test runs, only IN_CLOSE_WRITE lets the download through
+	cfg := &config.Config{SourceDir: srcDir, TargetDir: tgtDir, MaxFill: 1, SyncDelay: 10 * time.Millisecond, WriteQuiet: time.Hour}
+	evictor := fakeUsageEvictor(t, cfg, 10000, 0)
+
+	eventChan, changed, exit := make(chan fsnotify.Event), make(chan []string), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		fs.SyncChanges(nil, nil, eventChan, nil, changed, exit, make(chan struct{}, 1), evictor, cfg)
+		close(stopped)
+	}()
+	defer func() {
+		close(exit)
+		<-stopped
+	}()
+
+	eventChan <- fsnotify.Event{Name: download, Op: fsnotify.Create}
+
+	// The download keeps being written, its directory is only watched once it has been held back. A copy of
+	// anything but the last write means it was not held.
+	timeout := time.After(5 * time.Second)
+	for size := 200; ; size += 100 {
+		if err := os.WriteFile(download, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-changed:
+			info, err := os.Stat(filepath.Join(tgtDir, "movies", "Heat.mkv"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(size) {
+				t.Errorf("expected the last %d bytes written copied, got %d", size, info.Size())
+			}
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("expected the download copied once closed")
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package testing
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/jellyfin"
+	"bebop831.com/filo/internal/mediaserver/plex"
+)
+
+// fakeCollections is a media server whose collection members are set by the test, it fails while err is set
+type fakeCollections struct {
+	mu      sync.Mutex
+	members []string
+	err     error
+}
+
+func (f *fakeCollections) Name() string { return "fake" }
+
+func (f *fakeCollections) CollectionPaths(ctx context.Context, names []string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return slices.Clone(f.members), nil
+}
+
+func (f *fakeCollections) set(members []string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.members, f.err = members, err
+}
+
+func TestCollections(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	files := []string{
+		filepath.Join("movies", "Up (2009)", "Up (2009).mkv"),
+		filepath.Join("movies", "Heat (1995)", "Heat (1995).mkv"),
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E01 - The Weekend.mkv"),
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E02 - Hospital.mkv"),
+	}
+	for i, rel := range files {
+		for _, dir := range []string{srcDir, tgtDir} {
+			writeFile(t, filepath.Join(dir, rel), 100, now.Add(-time.Duration(i)*time.Hour))
+		}
+	}
+
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &fakeCollections{members: []string{"/media/movies/Up (2009)/Up (2009).mkv", "/media/tv/Bluey"}}
+	collections := &mediaserver.Collections{
+		Sources: []mediaserver.PinnedCollections{{Server: server, Names: []string{"Family Movie Night"}}},
+		PathMap: pathMap,
+	}
+
+	// Returns the eviction candidates once the source is pinned from the current membership
+	candidates := func(t *testing.T) []string {
+		t.Helper()
+
+		srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+		if err := collections.Prioritize(srcTree); err != nil {
+			t.Fatal(err)
+		}
+		return candidateNames(fs.FILOPolicy{}.Candidates(srcTree, tgtTree))
+	}
+
+	// Members are read on the first sync and never evicted, a series pins every episode
+	if got, want := candidates(t), []string{"Heat (1995).mkv"}; !slices.Equal(got, want) {
+		t.Errorf("expected only %v evictable, got %v", want, got)
+	}
+
+	// Up leaves the collection and Heat joins it
+	server.set([]string{"/media/movies/Heat (1995)/Heat (1995).mkv", "/media/tv/Bluey"}, nil)
+	added, err := collections.Refresh(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"/media/movies/Heat (1995)/Heat (1995).mkv"}; !slices.Equal(added, want) {
+		t.Errorf("expected %v added, got %v", want, added)
+	}
+
+	if got, want := candidates(t), []string{"Up (2009).mkv"}; !slices.Equal(got, want) {
+		t.Errorf("expected only %v evictable, got %v", want, got)
+	}
+
+	// A server that fails keeps its members
+	server.set(nil, errors.New("connection refused"))
+	if _, err := collections.Refresh(t.Context()); err == nil {
+		t.Error("expected the failed read reported")
+	}
+
+	if got, want := candidates(t), []string{"Up (2009).mkv"}; !slices.Equal(got, want) {
+		t.Errorf("expected only %v evictable, got %v", want, got)
+	}
+
+	// New members are synced right away
+	server.set([]string{"/media/movies/Up (2009)/Up (2009).mkv", "/media/tv/Bluey"}, nil)
+	collections.Interval = 10 * time.Millisecond
+	syncNow, exit := make(chan []string), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		collections.Run(syncNow, exit)
+		close(stopped)
+	}()
+
+	select {
+	case paths := <-syncNow:
+		if want := []string{filepath.Join(srcDir, "movies", "Up (2009)", "Up (2009).mkv")}; !slices.Equal(paths, want) {
+			t.Errorf("expected %v synced, got %v", want, paths)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the new member synced")
+	}
+	close(exit)
+	<-stopped
+}
+
+func TestMediaServerCollections(t *testing.T) {
+	tests := []struct {
+		name   string
+		server mediaserver.CollectionServer
+		names  []string
+		want   []string
+	}{
+		{
+			name:   "jellyfin",
+			server: jellyfin.New(jellyfinServer(t).URL, jellyfinAPIKey, []string{"bebop831", "guest"}),
+			names:  []string{"family movie night", "Guest Picks"},
+			want:   []string{"/media/movies/Up (2009)/Up (2009).mkv", "/media/tv/Bluey", "/media/movies/Heat (1995)/Heat (1995).mkv"},
+		},
+		{
+			name:   "plex",
+			server: plex.New(plexServer(t).URL, plexToken),
+			names:  []string{"Family Movie Night", "Kids Shows"},
+			want: []string{
+				"/data/movies/Up (2009)/Up (2009).mkv",
+				"/data/movies/Heat (1995)/Heat (1995).mkv",
+				"/data/tv/Bluey",
+				"/data/tv/Bluey/Season 01/Bluey - S01E08 - Fairies.mkv",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths, err := tt.server.CollectionPaths(t.Context(), tt.names)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(paths, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, paths)
+			}
+
+			if _, err := tt.server.CollectionPaths(t.Context(), []string{"Road Trip", "Nope"}); err == nil {
+				t.Error("expected an error for an unknown collection")
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package testing
+
+import (
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    config.ByteSize
+		wantErr bool
+	}{
+		{in: "1024", want: 1024},
+		{in: "500GiB", want: 500 << 30},
+		{in: "500 GiB", want: 500 << 30},
+		{in: "1.5TiB", want: 3 << 39},
+		{in: "750M", want: 750 << 20},
+		{in: "2GB", want: 2e9},
+		{in: "10 XB", wantErr: true},
+		{in: "GiB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := config.ParseByteSize(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error state %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestUsageLimit(t *testing.T) {
+	const total, used, free, managed = 1000, 600, 400, 200
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want uint64
+	}{
+		{name: "unbounded", cfg: config.Config{}, want: 1000},
+		{name: "max_fill", cfg: config.Config{MaxFill: 0.9}, want: 900},
+		{name: "max_bytes", cfg: config.Config{MaxFill: 0.9, MaxBytes: 300}, want: 700},
+		{name: "reserve_free", cfg: config.Config{MaxFill: 0.9, MaxBytes: 300, ReserveFree: 350}, want: 650},
+		{name: "max_bytes below managed", cfg: config.Config{MaxBytes: 100}, want: 500},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.UsageLimit(total, used, free, managed); got != tt.want {
+				t.Errorf("expected a limit of %d, got %d", tt.want, got)
+			}
+		})
+	}
+
+	cfg := config.Config{MaxFill: 0.9, MaxBytes: 300}
+	if got := cfg.Budget(total, used, free, managed); got != 300 {
+		t.Errorf("expected a budget of 300, got %d", got)
+	}
+}
+
+func TestLowUsageLimit(t *testing.T) {
+	const total, used, free, managed = 1000, 600, 400, 200
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want uint64
+	}{
+		{name: "no low_fill", cfg: config.Config{MaxFill: 0.9}, want: 900},
+		{name: "high_fill", cfg: config.Config{HighFill: 0.9, LowFill: 0.8}, want: 800},
+		{name: "high_fill past what filo manages", cfg: config.Config{HighFill: 0.9, LowFill: 0.3}, want: 400},
+		{name: "max_bytes", cfg: config.Config{HighFill: 0.9, LowFill: 0.6, MaxBytes: 300}, want: 600},
+		{name: "reserve_free", cfg: config.Config{HighFill: 0.9, LowFill: 0.45, ReserveFree: 450}, want: 475},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.LowUsageLimit(total, used, free, managed); got != tt.want {
+				t.Errorf("expected a low limit of %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "36h", want: 36 * time.Hour},
+		{in: "7d", want: 7 * 24 * time.Hour},
+		{in: "1d12h", want: 36 * time.Hour},
+		{in: "d", wantErr: true},
+		{in: "7days", wantErr: true},
+		{in: "-3d", wantErr: true},
+		{in: "-36h", wantErr: true},
+		{in: "1d-36h", wantErr: true},
+		{in: "-1d30h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := config.ParseAge(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error state %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package testing
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+func TestCopyReplacesTarget(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	content := []byte("the new copy")
+	if err := os.MkdirAll(filepath.Join(srcDir, "movies"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "movies", "Heat.mkv"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A larger stale copy must not leave its tail behind
+	writeFile(t, filepath.Join(tgtDir, "movies", "Heat.mkv"), 1000, now)
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgtTree, err := fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := tgtTree.CopyFrom(srcTree, map[string][]*fs.FileNode{
+		filepath.Join(tgtDir, "movies"): {srcTree.Index[filepath.Join(srcDir, "movies", "Heat.mkv")]},
+	}, make(chan struct{}, 1), nil)
+
+	if want := []string{filepath.Join(tgtDir, "movies", "Heat.mkv")}; !slices.Equal(copied, want) {
+		t.Errorf("expected %v copied, got %v", want, copied)
+	}
+
+	got, err := os.ReadFile(filepath.Join(tgtDir, "movies", "Heat.mkv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("expected %q on the target, got %d bytes", content, len(got))
+	}
+
+	entries, err := os.ReadDir(filepath.Join(tgtDir, "movies"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected no temp file left, got %v", entries)
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	tgtDir := t.TempDir()
+	now := time.Now()
+
+	leftovers := []string{
+		filepath.Join(tgtDir, ".filo-ABCDEF.tmp"),
+		filepath.Join(tgtDir, "tv", "Bluey", "Season 01", ".filo-GHIJKL.tmp"),
+	}
+	kept := []string{
+		filepath.Join(tgtDir, ".filo-notes"),
+		filepath.Join(tgtDir, "tv", "Bluey", "Season 01", "Bluey - S01E01.mkv"),
+	}
+	for _, path := range slices.Concat(leftovers, kept) {
+		writeFile(t, path, 10, now)
+	}
+
+	removed, err := fs.RemoveTempFiles(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	slices.Sort(removed)
+	if !slices.Equal(removed, leftovers) {
+		t.Errorf("expected %v removed, got %v", leftovers, removed)
+	}
+
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("expected %s kept, got %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package testing
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/jellyfin"
+	"bebop831.com/filo/internal/mediaserver/plex"
+)
+
+// Copies the databases in testdata/dir to a temporary directory, so the test can check they are only read
+func copyDatabases(t *testing.T, dir string, names ...string) string {
+	t.Helper()
+
+	tmp := t.TempDir()
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join("testdata", dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tmp
+}
+
+// Fails when dir holds anything but names, unchanged from testdata/from
+func assertUntouched(t *testing.T, dir, from string, names ...string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range entries {
+		if !slices.Contains(names, e.Name()) {
+			t.Errorf("expected the databases opened read-only, found %s", e.Name())
+			continue
+		}
+
+		got, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join("testdata", from, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("expected %s unchanged", e.Name())
+		}
+	}
+}
+
+// Returns the item of user for the server path p, failing when there is not exactly one
+func findItem(t *testing.T, items []mediaserver.Item, user, p string) mediaserver.Item {
+	t.Helper()
+
+	var found []mediaserver.Item
+	for _, item := range items {
+		if item.User == user && item.Path == p {
+			found = append(found, item)
+		}
+	}
+
+	if len(found) != 1 {
+		t.Fatalf("expected one item of %s for %s, got %v", user, p, found)
+	}
+	return found[0]
+}
+
+func TestJellyfinDB(t *testing.T) {
+	names := []string{"library.db", "jellyfin.db", "playback_reporting.db"}
+	dir := copyDatabases(t, "jellyfin", names...)
+
+	t.Run("unknown user", func(t *testing.T) {
+		db := jellyfin.NewDB(filepath.Join(dir, "library.db"), "", []string{"nobody"})
+		if _, err := db.Items(t.Context()); err == nil {
+			t.Error("expected an error for an unknown user")
+		}
+	})
+
+	t.Run("missing database", func(t *testing.T) {
+		db := jellyfin.NewDB(filepath.Join(dir, "missing.db"), "", nil)
+		if _, err := db.Items(t.Context()); err == nil {
+			t.Error("expected an error for a missing database")
+		}
+	})
+
+	db := jellyfin.NewDB(filepath.Join(dir, "library.db"), filepath.Join(dir, "playback_reporting.db"), []string{"bebop831", "guest"})
+	items, err := db.Items(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(items) != 7 {
+		t.Errorf("expected 7 items, got %d: %+v", len(items), items)
+	}
+
+	// Heat was played twice according to library.db and three times according to Playback Reporting
+	heat := findItem(t, items, "bebop831", "/media/movies/Heat (1995)/Heat (1995).mkv")
+	if !heat.Played || heat.PlayCount != 3 || !heat.LastPlayed.Equal(time.Date(2025, 5, 20, 21, 14, 3, 123456700, time.UTC)) {
+		t.Errorf("expected Heat played 3 times, last on 2025-05-20 21:14:03.1234567Z, got %+v", heat)
+	}
+
+	hospital := findItem(t, items, "bebop831", "/media/tv/Bluey/Season 01/Bluey - S01E02 - Hospital.mkv")
+	if hospital.Played || hospital.Resume != 3*time.Minute {
+		t.Errorf("expected Hospital resumed at 3m, got %+v", hospital)
+	}
+
+	// The Weekend is only known to Playback Reporting, which stores local times
+	weekend := findItem(t, items, "bebop831", "/media/tv/Bluey/Season 01/Bluey - S01E01 - The Weekend.mkv")
+	if weekend.Played || weekend.PlayCount != 2 || !weekend.LastPlayed.Equal(time.Date(2025, 6, 4, 7, 45, 12, 500000000, time.Local)) {
+		t.Errorf("expected The Weekend started twice, last on 2025-06-04 07:45:12.5, got %+v", weekend)
+	}
+
+	if severance := findItem(t, items, "guest", "/media/tv/Severance"); !severance.Favorite {
+		t.Errorf("expected Severance a favorite of guest, got %+v", severance)
+	}
+
+	for _, item := range items {
+		if item.User == "kids" {
+			t.Errorf("expected kids left out, got %+v", item)
+		}
+	}
+
+	// The history ranks the source like the API does
+	srcDir := t.TempDir()
+	files := map[string]int{
+		filepath.Join("movies", "Heat (1995)", "Heat (1995).mkv"):                                      mediaserver.PriorityPlayed,
+		filepath.Join("movies", "Alien (1979)", "Alien (1979).mkv"):                                    0, // played by bebop831 only
+		filepath.Join("movies", "Up (2009)", "Up (2009).mkv"):                                          mediaserver.PriorityFavorite,
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E02 - Hospital.mkv"):                     mediaserver.PriorityResume,
+		filepath.Join("tv", "Severance", "Season 01", "Severance - S01E01 - Good News About Hell.mkv"): mediaserver.PriorityFavorite,
+	}
+	for rel := range files {
+		writeFile(t, filepath.Join(srcDir, rel), 100, time.Now())
+	}
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prioritizer := &mediaserver.Prioritizer{Servers: []mediaserver.Server{db}, PathMap: pathMap}
+	if err := prioritizer.Prioritize(srcTree); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, want := range files {
+		if got := srcTree.Index[filepath.Join(srcDir, rel)].Priority; got != want {
+			t.Errorf("expected %s ranked %d, got %d", rel, want, got)
+		}
+	}
+
+	if got := srcTree.Index[filepath.Join(srcDir, "movies", "Heat (1995)", "Heat (1995).mkv")].Watch.PlayCount; got != 4 {
+		t.Errorf("expected Heat played 4 times across users, got %d", got)
+	}
+
+	// Files are owned by the users ranking them above 0, see config.Allowance
+	if got := srcTree.Index[filepath.Join(srcDir, "movies", "Up (2009)", "Up (2009).mkv")].Watch.Users; !slices.Equal(got, []string{"jellyfin/guest"}) {
+		t.Errorf("expected Up owned by jellyfin/guest, got %v", got)
+	}
+
+	assertUntouched(t, dir, "jellyfin", names...)
+}
+
+func TestPlexDB(t *testing.T) {
+	name := "com.plexapp.plugins.library.db"
+	dir := copyDatabases(t, "plex", name)
+
+	items, err := plex.NewDB(filepath.Join(dir, name)).Items(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Heat has two files, Up was never viewed and shows are not files
+	if len(items) != 6 {
+		t.Errorf("expected 6 items, got %d: %+v", len(items), items)
+	}
+
+	for _, p := range []string{"/data/movies/Heat (1995)/Heat (1995).mkv", "/data/movies/Heat (1995)/Heat (1995) - 4K.mkv"} {
+		heat := findItem(t, items, "bebop831", p)
+		if !heat.Played || heat.PlayCount != 2 || !heat.LastPlayed.Equal(time.Unix(1747775643, 0)) {
+			t.Errorf("expected %s played twice, got %+v", p, heat)
+		}
+	}
+
+	if alien := findItem(t, items, "guest", "/data/movies/Alien (1979)/Alien (1979).mkv"); alien.PlayCount != 1 {
+		t.Errorf("expected Alien played once by guest, got %+v", alien)
+	}
+
+	hospital := findItem(t, items, "bebop831", "/data/tv/Bluey/Season 01/Bluey - S01E02 - Hospital.mkv")
+	if hospital.Resume != 3*time.Minute || mediaserver.Score(hospital) != mediaserver.PriorityResume {
+		t.Errorf("expected Hospital resumed at 3m, got %+v", hospital)
+	}
+
+	assertUntouched(t, dir, "plex", name)
+
+	if _, err := plex.NewDB(filepath.Join(dir, "missing.db")).Items(t.Context()); err == nil {
+		t.Error("expected an error for a missing database")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); !os.IsNotExist(err) {
+		t.Error("expected a missing database not to be created")
+	}
+}
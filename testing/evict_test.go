@@ -0,0 +1,417 @@
+package testing
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+
+	"github.com/shirou/gopsutil/v4/disk"
+)
+
+// Writes a file of size bytes at path with its mtime set to modTime, creating parent dirs as needed
+func writeFile(t *testing.T, path string, size int, modTime time.Time) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Returns an Evictor whose target filesystem is total bytes large and has used bytes in use
+func fakeUsageEvictor(t *testing.T, cfg *config.Config, total, used uint64) *fs.Evictor {
+	t.Helper()
+
+	evictor, err := fs.NewEvictor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evictor.Usage = func(path string) (*disk.UsageStat, error) {
+		return &disk.UsageStat{Path: path, Total: total, Used: used, Free: total - used}, nil
+	}
+	return evictor
+}
+
+// Builds both trees and returns the admission queue for the files missing from tgtDir
+func admissionQueue(t *testing.T, srcDir, tgtDir string) (*fs.FileTree, *fs.FileTree, []*fs.Admission) {
+	t.Helper()
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgtTree, err := fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	missing := srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil)
+	return srcTree, tgtTree, fs.NewAdmissionQueue(srcTree, missing)
+}
+
+func relPaths(queue []*fs.Admission) []string {
+	paths := make([]string, 0, len(queue))
+	for _, a := range queue {
+		paths = append(paths, a.RelPath)
+	}
+	return paths
+}
+
+func TestAdmissionQueueOrder(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	writeFile(t, filepath.Join(srcDir, "tv", "show", "s01e01.mkv"), 10, now.Add(-3*time.Hour))
+	writeFile(t, filepath.Join(srcDir, "tv", "show", "s01e02.mkv"), 10, now.Add(-1*time.Hour))
+	writeFile(t, filepath.Join(srcDir, "movie.mkv"), 10, now.Add(-2*time.Hour))
+
+	_, _, queue := admissionQueue(t, srcDir, tgtDir)
+	want := []string{filepath.Join("tv", "show", "s01e02.mkv"), "movie.mkv", filepath.Join("tv", "show", "s01e01.mkv")}
+	got := relPaths(queue)
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestAdmissionPlan(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "old.mkv"), 100, now.Add(-72*time.Hour))
+		writeFile(t, filepath.Join(dir, "mid.mkv"), 100, now.Add(-48*time.Hour))
+	}
+	writeFile(t, filepath.Join(srcDir, "new.mkv"), 100, now)
+	writeFile(t, filepath.Join(srcDir, "older.mkv"), 100, now.Add(-96*time.Hour))
+	writeFile(t, filepath.Join(srcDir, "huge.mkv"), 600, now)
+
+	tests := []struct {
+		name         string
+		maxFill      float64
+		wantEvicted  []string
+		wantAdmitted []string
+		wantSkipped  []string
+	}{
+		{name: "fits", maxFill: 0.5, wantEvicted: []string{}, wantAdmitted: []string{"new.mkv", "older.mkv"}, wantSkipped: []string{"huge.mkv"}},
+		{name: "evict oldest", maxFill: 0.25, wantEvicted: []string{"old.mkv"}, wantAdmitted: []string{"new.mkv"}, wantSkipped: []string{"huge.mkv", "older.mkv"}},
+		{name: "evict both", maxFill: 0.1, wantEvicted: []string{"old.mkv", "mid.mkv"}, wantAdmitted: []string{"new.mkv"}, wantSkipped: []string{"huge.mkv", "older.mkv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcTree, tgtTree, queue := admissionQueue(t, srcDir, tgtDir)
+			evictor := fakeUsageEvictor(t, &config.Config{MaxFill: tt.maxFill}, 1000, 200)
+
+			plan, err := evictor.Plan(srcTree, tgtTree, queue)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			checkNames := func(kind string, got, want []string) {
+				if len(got) != len(want) {
+					t.Fatalf("expected %s %v, got %v", kind, want, got)
+				}
+				for i := range want {
+					if got[i] != want[i] {
+						t.Fatalf("expected %s %v, got %v", kind, want, got)
+					}
+				}
+			}
+
+			checkNames("admitted", relPaths(plan.Admitted), tt.wantAdmitted)
+			checkNames("skipped", relPaths(plan.Skipped), tt.wantSkipped)
+			checkNames("evicted", candidateNames(plan.Evict), tt.wantEvicted)
+
+			pass := evictor.Evict(srcTree, tgtTree, plan)
+			if pass == nil {
+				return
+			}
+
+			for _, n := range pass.Evicted {
+				if _, err := os.Lstat(n.Path); !os.IsNotExist(err) {
+					t.Errorf("expected %s removed from target", n.Path)
+				}
+
+				// put it back for the next case
+				writeFile(t, n.Path, 100, now)
+			}
+		})
+	}
+}
+
+func TestPinned(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	writeFile(t, filepath.Join(srcDir, "kids", "old.mkv"), 100, now.Add(-96*time.Hour))
+	writeFile(t, filepath.Join(srcDir, "mid.mkv"), 100, now.Add(-48*time.Hour))
+	writeFile(t, filepath.Join(srcDir, "new.mkv"), 100, now)
+	writeFile(t, filepath.Join(tgtDir, "mid.mkv"), 100, now)
+
+	srcTree, err := fs.BuildTree(srcDir, fs.TreeOptions{Pinned: []string{"kids"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgtTree, err := fs.BuildTree(tgtDir, fs.TreeOptions{Pinned: []string{"kids"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"kids", filepath.Join("kids", "old.mkv")} {
+		if n := srcTree.Index[filepath.Join(srcDir, p)]; n == nil || !n.Pinned {
+			t.Errorf("expected %s to be pinned", p)
+		}
+	}
+
+	if srcTree.Index[filepath.Join(srcDir, "new.mkv")].Pinned {
+		t.Error("expected new.mkv to not be pinned")
+	}
+
+	// Room for a single file, the pinned file goes first and new.mkv takes the place of mid.mkv
+	missing := srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil)
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 0.2}, 1000, 100)
+	plan, err := evictor.Plan(srcTree, tgtTree, fs.NewAdmissionQueue(srcTree, missing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := relPaths(plan.Admitted)
+	if len(admitted) != 2 || admitted[0] != filepath.Join("kids", "old.mkv") || admitted[1] != "new.mkv" {
+		t.Fatalf("expected the pinned file admitted first, got %v", admitted)
+	}
+
+	if evicted := candidateNames(plan.Evict); len(evicted) != 1 || evicted[0] != "mid.mkv" {
+		t.Fatalf("expected mid.mkv evicted, got %v", evicted)
+	}
+
+	// Once on the target the pinned file is never an eviction candidate
+	writeFile(t, filepath.Join(tgtDir, "kids", "old.mkv"), 100, now)
+	tgtTree, err = fs.BuildTree(tgtDir, fs.TreeOptions{Pinned: []string{"kids"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range evictor.Policy.Candidates(srcTree, tgtTree) {
+		if c.Pinned {
+			t.Errorf("pinned file %s returned as an eviction candidate", c.Path)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	opts := fs.TreeOptions{Units: []string{"tv/*/*"}}
+	s01, s02 := filepath.Join("tv", "show", "S01"), filepath.Join("tv", "show", "S02")
+
+	writeFile(t, filepath.Join(srcDir, s01, "e01.mkv"), 100, now.Add(-72*time.Hour))
+	writeFile(t, filepath.Join(srcDir, s01, "e02.mkv"), 100, now.Add(-70*time.Hour))
+	writeFile(t, filepath.Join(srcDir, s02, "e01.mkv"), 100, now.Add(-2*time.Hour))
+	writeFile(t, filepath.Join(srcDir, s02, "e02.mkv"), 100, now)
+	writeFile(t, filepath.Join(tgtDir, s01, "e01.mkv"), 100, now)
+	writeFile(t, filepath.Join(tgtDir, s01, "e02.mkv"), 100, now)
+	writeFile(t, filepath.Join(tgtDir, s02, "e01.mkv"), 100, now)
+
+	srcTree, err := fs.BuildTree(srcDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgtTree, err := fs.BuildTree(tgtDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size := srcTree.Index[filepath.Join(srcDir, "tv")].Size(); size != 400 {
+		t.Errorf("expected tv to roll up to 400 bytes, got %d", size)
+	}
+
+	// The missing episode is admitted as part of its season, which is sized as a whole
+	missing := srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil)
+	queue := fs.NewAdmissionQueue(srcTree, missing)
+	if len(queue) != 1 || queue[0].RelPath != s02 || queue[0].Size != 200 || len(queue[0].Files) != 1 {
+		t.Fatalf("expected a single 200 byte admission for %s with one file, got %v", s02, relPaths(queue))
+	}
+
+	// Only S02/e02 needs room, S01 goes as a whole season
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 0.3}, 1000, 300)
+	plan, err := evictor.Plan(srcTree, tgtTree, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Admitted) != 1 || len(plan.Evict) != 1 || plan.Evict[0].Path != filepath.Join(tgtDir, s01) {
+		t.Fatalf("expected %s evicted for %s, got admitted %v evicted %v", s01, s02, relPaths(plan.Admitted), candidateNames(plan.Evict))
+	}
+
+	if plan.Projected != 200 {
+		t.Errorf("expected a projected usage of 200 bytes, got %d", plan.Projected)
+	}
+
+	evictor.Evict(srcTree, tgtTree, plan)
+	if _, err := os.Lstat(filepath.Join(tgtDir, s01)); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed from target", s01)
+	}
+
+	if _, ok := tgtTree.Index[filepath.Join(tgtDir, s01, "e01.mkv")]; ok {
+		t.Errorf("expected %s removed from the target index", filepath.Join(s01, "e01.mkv"))
+	}
+}
+
+func TestWatermarks(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+
+	for i, name := range []string{"a.mkv", "b.mkv", "c.mkv", "d.mkv"} {
+		modTime := now.Add(time.Duration(i-10) * time.Hour)
+		writeFile(t, filepath.Join(srcDir, name), 100, modTime)
+		writeFile(t, filepath.Join(tgtDir, name), 100, modTime)
+	}
+	writeFile(t, filepath.Join(srcDir, "new.mkv"), 100, now)
+
+	// Crossing the high mark at 450 frees down to the low mark at 250 in a single pass
+	cfg := &config.Config{HighFill: 0.45, LowFill: 0.25}
+	srcTree, tgtTree, queue := admissionQueue(t, srcDir, tgtDir)
+	evictor := fakeUsageEvictor(t, cfg, 1000, 400)
+	plan, err := evictor.Plan(srcTree, tgtTree, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if evicted := candidateNames(plan.Evict); len(evicted) != 3 || evicted[0] != "a.mkv" || evicted[2] != "c.mkv" {
+		t.Fatalf("expected a, b and c evicted in one pass, got %v", evicted)
+	}
+
+	if plan.Projected != 200 || plan.LowLimit != 250 || plan.Limit != 450 {
+		t.Errorf("expected usage 200 under the 250/450 watermarks, got %d (%d/%d)", plan.Projected, plan.LowLimit, plan.Limit)
+	}
+
+	pass := evictor.Evict(srcTree, tgtTree, plan)
+	if pass == nil || len(pass.Evicted) != 3 || pass.Freed != 300 {
+		t.Fatalf("expected a single pass freeing 300 bytes, got %v", pass)
+	}
+
+	// Evicted files only come back once they fit under the low mark
+	writeFile(t, filepath.Join(tgtDir, "new.mkv"), 100, now)
+	tests := []struct {
+		used uint64
+		want int
+	}{
+		{used: 200, want: 0},
+		{used: 100, want: 1},
+	}
+
+	for _, tt := range tests {
+		srcTree, tgtTree, queue := admissionQueue(t, srcDir, tgtDir)
+		evictor.Usage = fakeUsageEvictor(t, cfg, 1000, tt.used).Usage
+		plan, err := evictor.Plan(srcTree, tgtTree, queue)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(plan.Admitted) != tt.want || len(plan.Evict) != 0 {
+			t.Errorf("with %d bytes used expected %d readmitted and nothing evicted, got %v evicted %v",
+				tt.used, tt.want, relPaths(plan.Admitted), candidateNames(plan.Evict))
+		}
+	}
+}
+
+func TestRetention(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	day := 24 * time.Hour
+	now := time.Now()
+	rules := []config.RetentionRule{{Path: "news/*", MaxAge: 7 * day}}
+
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "news", "daily", "old.mkv"), 100, now.Add(-10*day))
+		writeFile(t, filepath.Join(dir, "news", "daily", "new.mkv"), 100, now.Add(-1*day))
+		writeFile(t, filepath.Join(dir, "movies", "old.mkv"), 100, now.Add(-30*day))
+	}
+	writeFile(t, filepath.Join(srcDir, "news", "daily", "older.mkv"), 100, now.Add(-20*day))
+
+	srcTree, tgtTree, queue := admissionQueue(t, srcDir, tgtDir)
+	removed := fs.ApplyRetention(srcTree, tgtTree, rules, now, nil)
+	if len(removed) != 1 || removed[0].Path != filepath.Join(tgtDir, "news", "daily", "old.mkv") {
+		t.Fatalf("expected only news/daily/old.mkv to expire, got %v", candidateNames(removed))
+	}
+
+	if _, err := os.Lstat(removed[0].Path); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed from target", removed[0].Path)
+	}
+
+	// Expired files are not admitted again, however much room there is
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 1, Retention: rules}, 1000, 200)
+	plan, err := evictor.Plan(srcTree, tgtTree, queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Admitted) != 0 || len(plan.Skipped) != 1 {
+		t.Errorf("expected news/daily/older.mkv skipped, got admitted %v skipped %v", relPaths(plan.Admitted), relPaths(plan.Skipped))
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	day := 24 * time.Hour
+	now := time.Now()
+	rules := []config.RetentionRule{{Path: "news/*", MaxAge: 7 * day}}
+
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "news", "old.mkv"), 100, now.Add(-10*day))
+		writeFile(t, filepath.Join(dir, "movies", "old.mkv"), 300, now.Add(-30*day))
+	}
+	writeFile(t, filepath.Join(srcDir, "movies", "new.mkv"), 300, now.Add(-1*day))
+
+	// The retention delete frees 100 bytes, old.mkv still has to go to fit new.mkv under 500
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 0.5, Retention: rules}, 1000, 400)
+	plan, err := evictor.DryRun(srcTree, tgtTree, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, entries []fs.PlanEntry, want string, wantBytes uint64) {
+		if len(entries) != 1 || entries[0].Path != want || entries[0].Size != wantBytes {
+			t.Errorf("expected %s to %s, got %v", want, name, entries)
+		}
+	}
+	check("copy", plan.Copy, filepath.Join("movies", "new.mkv"), 300)
+	check("evict", plan.Evict, filepath.Join("movies", "old.mkv"), 300)
+	check("delete", plan.Delete, filepath.Join("news", "old.mkv"), 100)
+
+	if plan.Projected != 300 || plan.ProjectedFill != 0.3 {
+		t.Errorf("expected 300 bytes projected at 0.3 fill, got %d at %.2f", plan.Projected, plan.ProjectedFill)
+	}
+
+	// Nothing on the target is touched
+	for _, rel := range []string{filepath.Join("news", "old.mkv"), filepath.Join("movies", "old.mkv")} {
+		if _, err := os.Lstat(filepath.Join(tgtDir, rel)); err != nil {
+			t.Errorf("expected %s left on target: %s", rel, err)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(tgtDir, "movies", "new.mkv")); !os.IsNotExist(err) {
+		t.Error("expected movies/new.mkv not copied")
+	}
+}
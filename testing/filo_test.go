@@ -219,14 +219,17 @@ func contentsCheck(targetRoot string, treeIndex map[string]*fs.FileNode) int {
 func TestFiloSync(t *testing.T) {
 	cfg := config.Load()
 	maxFileSemaphore := make(chan struct{}, cfg.MaxOpenFile)
+	evictor, err := fs.NewEvictor(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
 	eventChan := make(chan fsnotify.Event)
 	exitChan := make(chan struct{})
-	syncChan := make(chan struct{})
 
 	slog.Info(fmt.Sprintf("Starting FILO TEST watch on '%s'...", cfg.SourceDir))
 
-	go fs.WatchChanges(eventChan, exitChan, syncChan, cfg)
-	go fs.SyncChanges(eventChan, exitChan, syncChan, maxFileSemaphore, cfg)
+	go fs.WatchChanges(eventChan, exitChan, cfg)
+	go fs.SyncChanges(nil, nil, eventChan, nil, nil, exitChan, maxFileSemaphore, evictor, cfg)
 
 	for _, tt := range syncTreeTests {
 		if tt.root == "" && !tt.wantErr {
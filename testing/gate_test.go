@@ -0,0 +1,120 @@
+package testing
+
+import (
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+func TestWriteGate(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	quiet := time.Minute
+
+	writeFile(t, filepath.Join(srcDir, "movies", "Heat.mkv"), 100, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(srcDir, "movies", "Ronin.mkv"), 100, now)
+	writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S01E01.mkv"), 100, now)
+	writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S01E02.mkv"), 100, now)
+
+	gate := fs.NewWriteGate(quiet)
+	tests := []struct {
+		name      string
+		change    func(t *testing.T) // applied before looking at at, on top of the steps before it
+		at        time.Time
+		wantFiles []string
+		wantHeld  []string
+		wantRetry time.Time
+	}{
+		{
+			name: "files written just now are held",
+			change: func(t *testing.T) {
+				gate.Closed(filepath.Join(srcDir, "tv", "Bluey", "S01E01.mkv"), now)
+			},
+			at:        now,
+			wantFiles: []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Bluey", "S01E01.mkv")},
+			wantHeld:  []string{filepath.Join("movies", "Ronin.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv")},
+			wantRetry: now.Add(quiet),
+		},
+		{
+			name: "a file still growing is held again",
+			change: func(t *testing.T) {
+				writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S01E02.mkv"), 200, now.Add(quiet))
+			},
+			at:        now.Add(quiet),
+			wantFiles: []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("movies", "Ronin.mkv"), filepath.Join("tv", "Bluey", "S01E01.mkv")},
+			wantHeld:  []string{filepath.Join("tv", "Bluey", "S01E02.mkv")},
+			wantRetry: now.Add(2 * quiet),
+		},
+		{
+			name: "a close before the last write does not count",
+			change: func(t *testing.T) {
+				gate.Closed(filepath.Join(srcDir, "tv", "Bluey", "S01E02.mkv"), now.Add(quiet-time.Second))
+			},
+			at:        now.Add(quiet + time.Second),
+			wantFiles: []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("movies", "Ronin.mkv"), filepath.Join("tv", "Bluey", "S01E01.mkv")},
+			wantHeld:  []string{filepath.Join("tv", "Bluey", "S01E02.mkv")},
+			wantRetry: now.Add(2 * quiet),
+		},
+		{
+			name: "a close after the last write lets it pass",
+			change: func(t *testing.T) {
+				gate.Closed(filepath.Join(srcDir, "tv", "Bluey", "S01E02.mkv"), now.Add(quiet+time.Second))
+			},
+			at:        now.Add(quiet + 2*time.Second),
+			wantFiles: []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("movies", "Ronin.mkv"), filepath.Join("tv", "Bluey", "S01E01.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+
+			srcTree, _, queue := admissionQueue(t, srcDir, tgtDir)
+			queue, held, retry := gate.Hold(queue, tt.at)
+
+			files := make([]string, 0)
+			for _, a := range queue {
+				if len(a.Files) == 0 {
+					t.Errorf("expected %s dropped without files", a.RelPath)
+				}
+				for _, f := range a.Files {
+					files = append(files, srcTree.RelBaseFile(f.Path))
+				}
+			}
+			slices.Sort(files)
+			if !slices.Equal(files, tt.wantFiles) {
+				t.Errorf("expected %v admitted, got %v", tt.wantFiles, files)
+			}
+
+			for i := range held {
+				held[i] = srcTree.RelBaseFile(held[i])
+			}
+			slices.Sort(held)
+			if !slices.Equal(held, tt.wantHeld) {
+				t.Errorf("expected %v held, got %v", tt.wantHeld, held)
+			}
+
+			// What is released when IN_CLOSE_WRITE events were dropped
+			holding := gate.Holding()
+			for i := range holding {
+				holding[i] = srcTree.RelBaseFile(holding[i])
+			}
+			if !slices.Equal(holding, held) {
+				t.Errorf("expected the gate to report %v held, got %v", held, holding)
+			}
+
+			if !retry.Equal(tt.wantRetry) {
+				t.Errorf("expected a retry at %v, got %v", tt.wantRetry, retry)
+			}
+		})
+	}
+
+	// Without a quiet period nothing is held
+	_, _, queue := admissionQueue(t, srcDir, tgtDir)
+	if got, held, _ := fs.NewWriteGate(0).Hold(queue, now); len(got) != len(queue) || len(held) != 0 {
+		t.Errorf("expected a nil gate to hold nothing, got %d held", len(held))
+	}
+}
@@ -0,0 +1,156 @@
+package testing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/jellyfin"
+)
+
+const jellyfinAPIKey = "0123456789abcdef"
+
+// Returns a stand-in Jellyfin server serving the responses recorded in testdata/jellyfin
+func jellyfinServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	fixture := func(name string) []byte {
+		body, err := os.ReadFile(filepath.Join("testdata", "jellyfin", name))
+		if os.IsNotExist(err) {
+			return []byte(`{"Items":[],"TotalRecordCount":0,"StartIndex":0}`)
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		return body
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != `MediaBrowser Token="`+jellyfinAPIKey+`"` {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var body []byte
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case r.URL.Path == "/Users":
+			body = fixture("users.json")
+		case len(parts) == 3 && parts[0] == "Users" && parts[2] == "Items" && r.URL.Query().Has("IncludeItemTypes"):
+			body = fixture(parts[1] + "_collections.json")
+		case len(parts) == 3 && parts[0] == "Users" && parts[2] == "Items" && r.URL.Query().Has("ParentId"):
+			body = fixture("collection_" + r.URL.Query().Get("ParentId") + ".json")
+		case len(parts) == 3 && parts[0] == "Users" && parts[2] == "Items":
+			body = fixture(parts[1] + "_" + r.URL.Query().Get("Filters") + ".json")
+		case r.URL.Path == "/Shows/NextUp":
+			body = fixture(r.URL.Query().Get("UserId") + "_NextUp.json")
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestJellyfinPriorities(t *testing.T) {
+	srcDir := t.TempDir()
+	now := time.Now()
+
+	files := map[string]int{
+		filepath.Join("movies", "Heat (1995)", "Heat (1995).mkv"):                                      mediaserver.PriorityPlayed,
+		filepath.Join("movies", "Alien (1979)", "Alien (1979).mkv"):                                    0, // played by bebop831 only
+		filepath.Join("movies", "Up (2009)", "Up (2009).mkv"):                                          mediaserver.PriorityFavorite,
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E01 - The Weekend.mkv"):                  0,
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E02 - Hospital.mkv"):                     mediaserver.PriorityNextUp,
+		filepath.Join("tv", "Severance", "Season 01", "Severance - S01E01 - Good News About Hell.mkv"): mediaserver.PriorityNextUp,
+		filepath.Join("tv", "Severance", "Season 01", "Severance - S01E02 - Half Loop.mkv"):            mediaserver.PriorityFavorite,
+	}
+
+	for rel := range files {
+		writeFile(t, filepath.Join(srcDir, rel), 100, now)
+	}
+
+	server := jellyfinServer(t)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		client := jellyfin.New(server.URL, "wrong", nil)
+		if _, err := client.Items(t.Context()); err == nil {
+			t.Error("expected an error for a wrong api key")
+		}
+	})
+
+	t.Run("unknown user", func(t *testing.T) {
+		client := jellyfin.New(server.URL, jellyfinAPIKey, []string{"nobody"})
+		if _, err := client.Items(t.Context()); err == nil {
+			t.Error("expected an error for an unknown user")
+		}
+	})
+
+	client := jellyfin.New(server.URL+"/", jellyfinAPIKey, []string{"bebop831", "guest"})
+	items, err := client.Items(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hospital is both resumable and next up, it is reported once
+	for _, item := range items {
+		if strings.HasSuffix(item.Path, "Hospital.mkv") && (!item.NextUp || item.Resume != 3*time.Minute) {
+			t.Errorf("expected Hospital next up and resumed at 3m, got %+v", item)
+		}
+	}
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded library lives in /media
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prioritizer := &mediaserver.Prioritizer{Servers: []mediaserver.Server{client}, PathMap: pathMap}
+	if err := prioritizer.Prioritize(srcTree); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, want := range files {
+		if got := srcTree.Index[filepath.Join(srcDir, rel)].Priority; got != want {
+			t.Errorf("expected %s ranked %d, got %d", rel, want, got)
+		}
+	}
+
+	// Heat was watched by everyone so it is evicted first, then the unranked files
+	tgtDir := t.TempDir()
+	for rel := range files {
+		writeFile(t, filepath.Join(tgtDir, rel), 100, now)
+	}
+
+	tgtTree, err := fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 1}, 1000, 700)
+	candidates := evictor.Policy.Candidates(srcTree, tgtTree)
+	if got := candidates[0].Entry.Name(); got != "Heat (1995).mkv" {
+		t.Errorf("expected Heat evicted first, got %v", candidateNames(candidates))
+	}
+
+	if got := candidates[len(candidates)-1].Entry.Name(); !strings.HasSuffix(got, "Good News About Hell.mkv") {
+		t.Errorf("expected the next up Severance episode evicted last, got %v", candidateNames(candidates))
+	}
+}
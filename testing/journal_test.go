@@ -0,0 +1,110 @@
+package testing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+func TestJournalRestore(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	journalPath := filepath.Join(t.TempDir(), "filo.journal")
+	day := 24 * time.Hour
+	now := time.Now()
+	rules := []config.RetentionRule{{Path: "news/*", MaxAge: 7 * day}}
+
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "news", "old.mkv"), 100, now.Add(-10*day))
+		writeFile(t, filepath.Join(dir, "movies", "old.mkv"), 300, now.Add(-30*day))
+	}
+	writeFile(t, filepath.Join(srcDir, "movies", "new.mkv"), 300, now.Add(-1*day))
+
+	// news/old.mkv expires and movies/old.mkv is evicted for movies/new.mkv
+	cfg := &config.Config{MaxFill: 0.5, Retention: rules}
+	evictor := fakeUsageEvictor(t, cfg, 1000, 400)
+	evictor.Journal = fs.NewJournal(journalPath)
+
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+	fs.ApplyRetention(srcTree, tgtTree, rules, now, evictor.Journal)
+	evictor.Usage = fakeUsageEvictor(t, cfg, 1000, 300).Usage
+
+	missing := srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil)
+	evictor.Admit(srcTree, tgtTree, fs.NewAdmissionQueue(srcTree, missing), make(chan struct{}, 1), nil)
+
+	entries, err := fs.ReadJournal(journalPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 journal entries, got %v", entries)
+	}
+
+	tests := []struct {
+		entry   fs.JournalEntry
+		path    string
+		reason  string
+		size    uint64
+		modTime time.Time
+	}{
+		{entry: entries[0], path: filepath.Join("news", "old.mkv"), reason: fs.ReasonExpired, size: 100, modTime: now.Add(-10 * day)},
+		{entry: entries[1], path: filepath.Join("movies", "old.mkv"), reason: fs.ReasonEvicted, size: 300, modTime: now.Add(-30 * day)},
+	}
+
+	for _, tt := range tests {
+		if tt.entry.Path != tt.path || tt.entry.Reason != tt.reason || tt.entry.Size != tt.size || !tt.entry.ModTime.Equal(tt.modTime) {
+			t.Errorf("expected %s %s (%d bytes) with the source mtime, got %+v", tt.reason, tt.path, tt.size, tt.entry)
+		}
+		if tt.entry.Hash != "" {
+			t.Errorf("expected %s, never copied by filo, recorded without a hash, got %s", tt.path, tt.entry.Hash)
+		}
+	}
+
+	// movies/new.mkv was hashed while it was copied, its eviction records the hash
+	newPath := filepath.Join("movies", "new.mkv")
+	sum := sha256.Sum256(make([]byte, 300))
+	tgtTree, err = fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copied := evictor.Journal.Entries(srcTree, tgtTree, tgtTree.Index[filepath.Join(tgtDir, newPath)], fs.ReasonEvicted, "filo")
+	if len(copied) != 1 || copied[0].Hash != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected %s recorded with the hash taken while copying it, got %+v", newPath, copied)
+	}
+
+	// Select by glob and by time range
+	if got := (fs.JournalFilter{Paths: []string{"movies"}}).Filter(entries); len(got) != 1 || got[0].Path != tests[1].path {
+		t.Errorf("expected only %s selected by glob, got %v", tests[1].path, got)
+	}
+
+	if got := (fs.JournalFilter{Until: entries[0].Time}).Filter(entries); len(got) != 0 {
+		t.Errorf("expected nothing removed before %v, got %v", entries[0].Time, got)
+	}
+
+	// Restore movies/old.mkv once max_fill leaves room for it again
+	srcTree, tgtTree, _ = admissionQueue(t, srcDir, tgtDir)
+	evictor = fakeUsageEvictor(t, &config.Config{MaxFill: 1, Retention: rules}, 1000, 300)
+	plan, err := evictor.Restore(srcTree, tgtTree, (fs.JournalFilter{Paths: []string{"movies/*"}}).Filter(entries), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(plan.Admitted) != 1 {
+		t.Fatalf("expected movies/old.mkv restored, got admitted %v skipped %v", relPaths(plan.Admitted), relPaths(plan.Skipped))
+	}
+
+	if info, err := os.Stat(filepath.Join(tgtDir, "movies", "old.mkv")); err != nil || info.Size() != 300 {
+		t.Errorf("expected movies/old.mkv back on target: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(tgtDir, "news", "old.mkv")); !os.IsNotExist(err) {
+		t.Error("expected news/old.mkv left off target")
+	}
+}
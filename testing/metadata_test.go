@@ -0,0 +1,125 @@
+//go:build linux || darwin
+
+package testing
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestCopyPreservesMetadata(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	mtime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	atime := time.Date(2021, 6, 2, 12, 0, 0, 0, time.UTC)
+	dirMtime := time.Date(2019, 4, 3, 12, 0, 0, 0, time.UTC)
+
+	movieDir := filepath.Join(srcDir, "movies", "Heat (1995)")
+	movie := filepath.Join(movieDir, "Heat (1995).mkv")
+	writeFile(t, movie, 100, mtime)
+	if err := os.Chtimes(movie, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(movie, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	xattrs := unix.Setxattr(movie, "user.filo.test", []byte("heat"), 0) == nil
+	if !xattrs {
+		t.Log("extended attributes unsupported, not checked")
+	}
+
+	root := os.Geteuid() == 0
+	if root {
+		if err := os.Chown(movie, 1234, 5678); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Directories without files are created on the target too and keep their metadata
+	extrasDir := filepath.Join(srcDir, "movies", "Extras", "Trailers")
+	if err := os.MkdirAll(extrasDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Set last and deepest first, writing below a directory moves it
+	for _, dir := range []string{extrasDir, filepath.Dir(extrasDir), movieDir, filepath.Dir(movieDir)} {
+		if err := os.Chmod(dir, 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(dir, dirMtime, dirMtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgtTree, err := fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tgtTree.CopyFrom(srcTree, map[string][]*fs.FileNode{
+		tgtDir: {srcTree.Index[filepath.Join(srcDir, "movies")]},
+	}, make(chan struct{}, 1), nil)
+
+	tests := []struct {
+		path    string
+		mode    os.FileMode
+		modTime time.Time
+	}{
+		{path: filepath.Join("movies", "Heat (1995)", "Heat (1995).mkv"), mode: 0640, modTime: mtime},
+		{path: filepath.Join("movies", "Heat (1995)"), mode: os.ModeDir | 0750, modTime: dirMtime},
+		{path: filepath.Join("movies", "Extras", "Trailers"), mode: os.ModeDir | 0750, modTime: dirMtime},
+		{path: filepath.Join("movies", "Extras"), mode: os.ModeDir | 0750, modTime: dirMtime},
+		{path: "movies", mode: os.ModeDir | 0750, modTime: dirMtime},
+	}
+
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(tgtDir, tt.path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if info.Mode() != tt.mode {
+			t.Errorf("expected %s mode %v, got %v", tt.path, tt.mode, info.Mode())
+		}
+		if !info.ModTime().Equal(tt.modTime) {
+			t.Errorf("expected %s mtime %v, got %v", tt.path, tt.modTime, info.ModTime())
+		}
+	}
+
+	tgtMovie := filepath.Join(tgtDir, "movies", "Heat (1995)", "Heat (1995).mkv")
+	info, err := os.Stat(tgtMovie)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fs.AccessTime(info); !got.Equal(atime) {
+		t.Errorf("expected atime %v, got %v", atime, got)
+	}
+
+	if st := info.Sys().(*syscall.Stat_t); root && (st.Uid != 1234 || st.Gid != 5678) {
+		t.Errorf("expected owner 1234:5678, got %d:%d", st.Uid, st.Gid)
+	}
+
+	if xattrs {
+		value := make([]byte, 16)
+		size, err := unix.Getxattr(tgtMovie, "user.filo.test", value)
+		if err != nil && !errors.Is(err, unix.ENODATA) {
+			t.Fatal(err)
+		}
+		if string(value[:max(size, 0)]) != "heat" {
+			t.Errorf("expected user.filo.test copied, got %q", value[:max(size, 0)])
+		}
+	}
+}
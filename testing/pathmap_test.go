@@ -0,0 +1,170 @@
+package testing
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+func TestPathMap(t *testing.T) {
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{
+		{Server: "/data/media", Local: "/mnt/pool"},
+		{Server: "/data/media/kids/", Local: "/mnt/kids"},
+		{Server: `D:\Media`, Local: "/mnt/windows"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		server string
+		local  string
+		mapped bool
+	}{
+		{server: "/data/media/movies/Heat.mkv", local: "/mnt/pool/movies/Heat.mkv", mapped: true},
+		{server: "/data/media", local: "/mnt/pool", mapped: true},
+		{server: "/data/media/kids/Bluey/S01E01.mkv", local: "/mnt/kids/Bluey/S01E01.mkv", mapped: true},
+		{server: `D:\Media\movies\Up.mkv`, local: "/mnt/windows/movies/Up.mkv", mapped: true},
+		{server: "/data/mediaserver/Heat.mkv", mapped: false},
+		{server: "/srv/movies/Heat.mkv", mapped: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.server, func(t *testing.T) {
+			local, ok := pathMap.ToLocal(tt.server)
+			if ok != tt.mapped || (ok && local != filepath.FromSlash(tt.local)) {
+				t.Fatalf("expected %s (%v), got %s (%v)", tt.local, tt.mapped, local, ok)
+			}
+
+			if !ok {
+				return
+			}
+
+			if server, ok := pathMap.ToServer(local); !ok || server != tt.server {
+				t.Errorf("expected %s mapped back to %s, got %s (%v)", local, tt.server, server, ok)
+			}
+		})
+	}
+
+	if _, ok := pathMap.ToServer("/home/movies/Heat.mkv"); ok {
+		t.Error("expected a path outside every local prefix not to map")
+	}
+
+	invalid := [][]config.PathMapping{
+		{{Server: "/data/media"}},
+		{{Server: "/data/media", Local: "pool"}},
+		{{Server: "/data/media", Local: "/mnt/a"}, {Server: "/data/media/", Local: "/mnt/b"}},
+	}
+	for _, rules := range invalid {
+		if _, err := mediaserver.NewPathMap(rules); err == nil {
+			t.Errorf("expected %v to be rejected", rules)
+		}
+	}
+}
+
+func TestPathMapValidate(t *testing.T) {
+	srcDir := t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "movies", "Heat.mkv"), 100, time.Now())
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/data/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v := pathMap.Validate(srcTree, []string{
+		"/data/media/movies/Heat.mkv",
+		"/data/media/movies/Gone.mkv",
+		"/srv/tv/Bluey/S01E01.mkv",
+		"/srv/tv/Bluey/S01E02.mkv",
+	})
+
+	if v.OK() || v.Checked != 4 {
+		t.Fatalf("expected 4 paths checked and some unresolved, got %+v", v)
+	}
+
+	if !slices.Equal(v.Missing, []string{"/data/media/movies/Gone.mkv"}) {
+		t.Errorf("expected only Gone.mkv missing, got %v", v.Missing)
+	}
+
+	if got := mediaserver.Prefixes(v.Unmapped); !slices.Equal(got, []string{"/srv/tv/Bluey"}) {
+		t.Errorf("expected /srv/tv/Bluey reported unmapped, got %v", got)
+	}
+
+	if n := pathMap.Resolve(srcTree, "/data/media/movies/Heat.mkv"); n == nil || n.Entry.Name() != "Heat.mkv" {
+		t.Errorf("expected /data/media/movies/Heat.mkv to resolve to Heat.mkv, got %v", n)
+	}
+
+	// A library on the target resolves to the source counterparts of its files
+	tgtDir := t.TempDir()
+	pathMap, err = mediaserver.NewPathMap([]config.PathMapping{{Server: "/ssd/media", Local: tgtDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := pathMap.Resolve(srcTree, "/ssd/media/movies/Heat.mkv"); n != nil {
+		t.Errorf("expected a target path unresolved without a target, got %v", n)
+	}
+
+	pathMap.Target = tgtDir
+	if n := pathMap.Resolve(srcTree, "/ssd/media/movies/Heat.mkv"); n != srcTree.Index[filepath.Join(srcDir, "movies", "Heat.mkv")] {
+		t.Errorf("expected /ssd/media/movies/Heat.mkv to resolve to the source Heat.mkv, got %v", n)
+	}
+
+	if v := pathMap.Validate(srcTree, []string{"/ssd/media/movies/Heat.mkv"}); !v.OK() {
+		t.Errorf("expected the target path valid, got %+v", v)
+	}
+}
+
+func TestPrioritizeLogsUnresolvedOnce(t *testing.T) {
+	srcDir := t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "movies", "Heat.mkv"), 100, time.Now())
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/data/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	unmapped := mediaserver.Item{Path: "/srv/tv/Bluey/S01E01.mkv", User: "bebop831", Played: true}
+	prioritizer := &mediaserver.Prioritizer{Servers: []mediaserver.Server{fakeServer{unmapped}}, PathMap: pathMap}
+	for range 3 {
+		if err := prioritizer.Prioritize(srcTree); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := strings.Count(logs.String(), "/srv/tv/Bluey"); n != 1 {
+		t.Errorf("expected the unmapped directory logged once over 3 syncs, got %d times", n)
+	}
+
+	// A new unresolved path is logged again
+	prioritizer.Servers = []mediaserver.Server{fakeServer{unmapped, {Path: "/srv/movies/Up.mkv", User: "bebop831"}}}
+	if err := prioritizer.Prioritize(srcTree); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := strings.Count(logs.String(), "/srv/tv/Bluey"); n != 2 {
+		t.Errorf("expected the unresolved paths logged again once they changed, got %d times", n)
+	}
+}
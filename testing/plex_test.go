@@ -0,0 +1,211 @@
+package testing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/plex"
+)
+
+const plexToken = "xxxxxxxxxxxxxxxxxxxx"
+
+// Returns a fake Plex Media Server, also serving the plex.tv watchlist, that answers with the responses
+// recorded in testdata/plex.
+func plexServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	fixture := func(name string) []byte {
+		body, err := os.ReadFile(filepath.Join("testdata", "plex", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return body
+	}
+
+	// Returns the recorded items of the fixtures matching match, in a MediaContainer
+	items := func(match func(m map[string]any) bool, names ...string) []byte {
+		selected := make([]map[string]any, 0)
+		for _, name := range names {
+			var recorded struct {
+				MediaContainer struct {
+					Metadata []map[string]any
+				}
+			}
+			if err := json.Unmarshal(fixture(name), &recorded); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, m := range recorded.MediaContainer.Metadata {
+				if match(m) {
+					selected = append(selected, m)
+				}
+			}
+		}
+
+		body, err := json.Marshal(map[string]any{"MediaContainer": map[string]any{"size": len(selected), "totalSize": len(selected), "Metadata": selected}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Plex-Token") != plexToken {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var body []byte
+		switch r.URL.Path {
+		case "/library/sections":
+			body = fixture("sections.json")
+		case "/library/sections/1/all", "/library/sections/2/all":
+			section := strings.Split(r.URL.Path, "/")[3]
+			if section == "2" && r.URL.Query().Get("type") != "4" {
+				http.Error(w, "expected episodes", http.StatusBadRequest)
+				return
+			}
+
+			// Sections are only listed filtered, by watched or in progress
+			query := r.URL.Query()
+			switch {
+			case query.Get("unwatched") == "0":
+				body = items(func(m map[string]any) bool { return m["viewCount"] != nil }, "section_"+section+".json")
+			case query.Get("inProgress") == "1":
+				body = items(func(m map[string]any) bool { return m["viewOffset"] != nil }, "section_"+section+".json")
+			default:
+				http.Error(w, "expected a filtered section", http.StatusBadRequest)
+				return
+			}
+		case "/library/all":
+			guid := r.URL.Query().Get("guid")
+			body = items(func(m map[string]any) bool { return m["guid"] == guid }, "section_1.json", "shows.json")
+		case "/library/metadata/600/allLeaves":
+			body = fixture("leaves_600.json")
+		case "/library/onDeck":
+			body = fixture("onDeck.json")
+		case "/status/sessions/history/all":
+			body = fixture("history.json")
+		case "/library/sections/watchlist/all":
+			body = fixture("watchlist.json")
+		case "/library/sections/1/collections", "/library/sections/2/collections":
+			body = fixture("collections_" + strings.Split(r.URL.Path, "/")[3] + ".json")
+		case "/playlists":
+			body = fixture("playlists.json")
+		default:
+			parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+			switch {
+			case len(parts) == 4 && parts[1] == "collections" && parts[3] == "children":
+				body = fixture("collection_" + parts[2] + ".json")
+			case len(parts) == 3 && parts[0] == "playlists" && parts[2] == "items":
+				body = fixture("playlist_" + parts[1] + ".json")
+			case len(parts) == 3 && parts[1] == "metadata":
+				body = fixture("metadata_" + parts[2] + ".json")
+			default:
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPlexPriorities(t *testing.T) {
+	srcDir := t.TempDir()
+	now := time.Now()
+
+	files := map[string]int{
+		filepath.Join("movies", "Heat (1995)", "Heat (1995).mkv"):                                      mediaserver.PriorityPlayed,
+		filepath.Join("movies", "Up (2009)", "Up (2009).mkv"):                                          mediaserver.PriorityFavorite, // on the watchlist
+		filepath.Join("movies", "Alien (1979)", "Alien (1979).mkv"):                                    mediaserver.PriorityNextUp,   // on deck
+		filepath.Join("movies", "Arrival (2016)", "Arrival (2016).mkv"):                                0,
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E01 - The Weekend.mkv"):                  mediaserver.PriorityPlayed,
+		filepath.Join("tv", "Bluey", "Season 01", "Bluey - S01E02 - Hospital.mkv"):                     mediaserver.PriorityNextUp,
+		filepath.Join("tv", "Severance", "Season 01", "Severance - S01E01 - Good News About Hell.mkv"): mediaserver.PriorityFavorite, // show on the watchlist
+	}
+
+	for rel := range files {
+		writeFile(t, filepath.Join(srcDir, rel), 100, now)
+	}
+
+	server := plexServer(t)
+
+	t.Run("unauthorized", func(t *testing.T) {
+		client := plex.New(server.URL, "wrong")
+		client.DiscoverURL = server.URL
+		if _, err := client.Items(t.Context()); err == nil {
+			t.Error("expected an error for a wrong token")
+		}
+	})
+
+	client := plex.New(server.URL+"/", plexToken)
+	client.DiscoverURL = server.URL
+	items, err := client.Items(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range items {
+		if strings.HasSuffix(item.Path, "Alien (1979).mkv") && item.Resume != time.Hour {
+			t.Errorf("expected Alien resumed at 1h, got %+v", item)
+		}
+
+		if strings.HasSuffix(item.Path, "The Weekend.mkv") && !item.LastPlayed.Equal(time.Unix(1717226122, 0)) {
+			t.Errorf("expected The Weekend last played at its history entry, got %+v", item)
+		}
+	}
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The recorded library lives in /data
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/data", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prioritizer := &mediaserver.Prioritizer{Servers: []mediaserver.Server{client}, PathMap: pathMap}
+	if err := prioritizer.Prioritize(srcTree); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, want := range files {
+		if got := srcTree.Index[filepath.Join(srcDir, rel)].Priority; got != want {
+			t.Errorf("expected %s ranked %d, got %d", rel, want, got)
+		}
+	}
+
+	// Fully watched items are the first eviction candidates
+	tgtDir := t.TempDir()
+	for rel := range files {
+		writeFile(t, filepath.Join(tgtDir, rel), 100, now)
+	}
+
+	tgtTree, err := fs.BuildTree(tgtDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 1}, 1000, 700)
+	got := candidateNames(evictor.Policy.Candidates(srcTree, tgtTree))
+	if len(got) != len(files) || got[0] != "Heat (1995).mkv" || got[1] != "Bluey - S01E01 - The Weekend.mkv" {
+		t.Errorf("expected Heat and The Weekend evicted first, got %v", got)
+	}
+}
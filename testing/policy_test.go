@@ -0,0 +1,151 @@
+package testing
+
+import (
+	iofs "io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+// fakeInfo is an in-memory fs.FileInfo so trees can be built without touching disk
+type fakeInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (f fakeInfo) Name() string       { return f.name }
+func (f fakeInfo) Size() int64        { return f.size }
+func (f fakeInfo) ModTime() time.Time { return f.modTime }
+func (f fakeInfo) IsDir() bool        { return f.dir }
+func (f fakeInfo) Sys() any           { return nil }
+func (f fakeInfo) Mode() iofs.FileMode {
+	if f.dir {
+		return iofs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// fakeFile describes a file in a fake tree, atime is reported through the mtime of the target copy
+type fakeFile struct {
+	name    string
+	size    int64
+	srcTime time.Time
+	tgtTime time.Time
+}
+
+// Returns a source and target tree that both contain files at their roots
+func fakeTrees(files []fakeFile) (*fs.FileTree, *fs.FileTree) {
+	build := func(root string, modTime func(f fakeFile) time.Time) *fs.FileTree {
+		rootNode := &fs.FileNode{Path: root, Entry: iofs.FileInfoToDirEntry(fakeInfo{name: filepath.Base(root), dir: true})}
+		tree := &fs.FileTree{Root: rootNode, Index: make(map[string]*fs.FileNode)}
+		for _, f := range files {
+			n := &fs.FileNode{
+				Path:   filepath.Join(root, f.name),
+				Entry:  iofs.FileInfoToDirEntry(fakeInfo{name: f.name, size: f.size, modTime: modTime(f)}),
+				Parent: rootNode,
+			}
+			rootNode.Children = append(rootNode.Children, n)
+			tree.Index[n.Path] = n
+		}
+		return tree
+	}
+
+	return build("/src", func(f fakeFile) time.Time { return f.srcTime }),
+		build("/tgt", func(f fakeFile) time.Time { return f.tgtTime })
+}
+
+func candidateNames(candidates []*fs.FileNode) []string {
+	names := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		names = append(names, c.Entry.Name())
+	}
+	return names
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	day := 24 * time.Hour
+	now := time.Now()
+
+	// a is the oldest on the source, b was watched longest ago and c is the largest
+	files := []fakeFile{
+		{name: "a.mkv", size: 200, srcTime: now.Add(-3 * day), tgtTime: now.Add(-1 * day)},
+		{name: "b.mkv", size: 100, srcTime: now.Add(-2 * day), tgtTime: now.Add(-3 * day)},
+		{name: "c.mkv", size: 300, srcTime: now.Add(-1 * day), tgtTime: now.Add(-2 * day)},
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{policy: "filo", want: []string{"a.mkv", "b.mkv", "c.mkv"}},
+		{policy: "lru", want: []string{"b.mkv", "c.mkv", "a.mkv"}},
+		{policy: "lfu", want: []string{"b.mkv", "c.mkv", "a.mkv"}},
+		{policy: "largest", want: []string{"c.mkv", "a.mkv", "b.mkv"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			policy, err := fs.NewEvictionPolicy(tt.policy, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			src, tgt := fakeTrees(files)
+			got := candidateNames(policy.Candidates(src, tgt))
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %v, got %v", tt.want, got)
+			}
+
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Fatalf("expected %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+
+	if _, err := fs.NewEvictionPolicy("fifo", nil); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestLFUCountsAccesses(t *testing.T) {
+	now := time.Now()
+	tracker := fs.NewAccessTracker()
+	policy, err := fs.NewEvictionPolicy("lfu", tracker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := []fakeFile{
+		{name: "a.mkv", size: 100, srcTime: now, tgtTime: now.Add(-2 * time.Hour)},
+		{name: "b.mkv", size: 100, srcTime: now, tgtTime: now.Add(-1 * time.Hour)},
+	}
+
+	// a is accessed twice and b once, so b goes first even though it was accessed last
+	for i := range 3 {
+		if i > 0 {
+			files[0].tgtTime = files[0].tgtTime.Add(time.Hour)
+		}
+		if i == 1 {
+			files[1].tgtTime = files[1].tgtTime.Add(2 * time.Hour)
+		}
+
+		src, tgt := fakeTrees(files)
+		policy.Candidates(src, tgt)
+	}
+
+	src, tgt := fakeTrees(files)
+	got := candidateNames(policy.Candidates(src, tgt))
+	if got[0] != "b.mkv" {
+		t.Errorf("expected b.mkv evicted first, got %v", got)
+	}
+
+	if tracker.Count("a.mkv") != 2 || tracker.Count("b.mkv") != 1 {
+		t.Errorf("expected counts a=2 b=1, got a=%d b=%d", tracker.Count("a.mkv"), tracker.Count("b.mkv"))
+	}
+}
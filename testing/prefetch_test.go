@@ -0,0 +1,137 @@
+package testing
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+)
+
+// fakeServer is a media server reporting a fixed set of items
+type fakeServer []mediaserver.Item
+
+func (fakeServer) Name() string { return "fake" }
+
+func (s fakeServer) Items(ctx context.Context) ([]mediaserver.Item, error) { return s, nil }
+
+func TestParseEpisode(t *testing.T) {
+	tests := []struct {
+		name string
+		want mediaserver.Episode
+		ok   bool
+	}{
+		{name: "Bluey - S01E02 - Hospital.mkv", want: mediaserver.Episode{Season: 1, Number: 2}, ok: true},
+		{name: "bluey.s2.e10.mkv", want: mediaserver.Episode{Season: 2, Number: 10}, ok: true},
+		{name: "The Office 3x07.mkv", want: mediaserver.Episode{Season: 3, Number: 7}, ok: true},
+		{name: "Severance S01 E03.mkv", want: mediaserver.Episode{Season: 1, Number: 3}, ok: true},
+		{name: "Heat (1995) 1080p x264.mkv", ok: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := mediaserver.ParseEpisode(tt.name)
+			if ok != tt.ok || got != tt.want {
+				t.Errorf("expected %v (%v), got %v (%v)", tt.want, tt.ok, got, ok)
+			}
+		})
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	srcDir := t.TempDir()
+	now := time.Now()
+
+	bluey := func(season, episode int) string {
+		return filepath.Join("tv", "Bluey", fmt.Sprintf("Season %d", season), fmt.Sprintf("Bluey S%dE%d.mkv", season, episode))
+	}
+	severance := func(episode int) string {
+		return filepath.Join("tv", "Severance", fmt.Sprintf("Severance S01E%02d.mkv", episode))
+	}
+
+	for e := 1; e <= 10; e++ {
+		writeFile(t, filepath.Join(srcDir, bluey(1, e)), 100, now)
+	}
+	for e := 1; e <= 2; e++ {
+		writeFile(t, filepath.Join(srcDir, bluey(2, e)), 100, now)
+	}
+	for e := 1; e <= 4; e++ {
+		writeFile(t, filepath.Join(srcDir, severance(e)), 100, now)
+	}
+	// Episodes of unrelated shows without a show directory
+	loose := []string{"Lost S01E01.mkv", "Dark S01E02.mkv", filepath.Join("Season 1", "Fargo S01E03.mkv")}
+	for _, rel := range loose {
+		writeFile(t, filepath.Join(srcDir, rel), 100, now)
+	}
+
+	played := func(rel string, ago time.Duration) mediaserver.Item {
+		return mediaserver.Item{Path: "/media/" + filepath.ToSlash(rel), User: "bebop831", Played: true, LastPlayed: now.Add(-ago)}
+	}
+
+	resumed := played(severance(2), time.Hour)
+	resumed.Played, resumed.Resume = false, 20*time.Minute
+
+	server := fakeServer{
+		played(bluey(1, 3), 72*time.Hour),
+		played(bluey(1, 9), time.Hour), // the cursor, even though S1E8 is before it and was played later than S1E3
+		played(bluey(1, 8), 2*time.Hour),
+		played(severance(1), 2*time.Hour),
+		resumed,
+		played(loose[0], time.Hour),
+	}
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/media", Local: srcDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prioritizer := &mediaserver.Prioritizer{Servers: []mediaserver.Server{server}, PathMap: pathMap, Prefetch: 3}
+	if err := prioritizer.Prioritize(srcTree); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel  string
+		want int
+	}{
+		{rel: bluey(1, 1), want: 0},
+		{rel: bluey(1, 3), want: mediaserver.PriorityBehind},
+		{rel: bluey(1, 8), want: mediaserver.PriorityBehind},
+		{rel: bluey(1, 9), want: mediaserver.PriorityBehind},
+		{rel: bluey(1, 10), want: mediaserver.PriorityPrefetch}, // sorted numerically, not S1E10 before S1E2
+		{rel: bluey(2, 1), want: mediaserver.PriorityPrefetch - 1},
+		{rel: bluey(2, 2), want: mediaserver.PriorityPrefetch - 2},
+		{rel: severance(1), want: mediaserver.PriorityBehind},
+		{rel: severance(2), want: mediaserver.PriorityPrefetch}, // partially watched, the cursor is prefetched too
+		{rel: severance(3), want: mediaserver.PriorityPrefetch - 1},
+		{rel: severance(4), want: mediaserver.PriorityPrefetch - 2},
+		{rel: loose[1], want: 0}, // not the next episode of Lost
+		{rel: loose[2], want: 0},
+	}
+
+	for _, tt := range tests {
+		if got := srcTree.Index[filepath.Join(srcDir, tt.rel)].Priority; got != tt.want {
+			t.Errorf("expected %s ranked %d, got %d", tt.rel, tt.want, got)
+		}
+	}
+
+	// Prefetched episodes are admitted before newer files, watched ones are evicted first
+	tgtTree, err := fs.BuildTree(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue := fs.NewAdmissionQueue(srcTree, srcTree.MissingIn(tgtTree, make(chan struct{}, 1), nil))
+	if len(queue) == 0 || queue[0].RelPath != bluey(1, 10) && queue[0].RelPath != severance(2) {
+		t.Errorf("expected a prefetched episode admitted first, got %v", relPaths(queue))
+	}
+}
@@ -0,0 +1,217 @@
+package testing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/mediaserver/jellyfin"
+	"bebop831.com/filo/internal/mediaserver/plex"
+)
+
+func TestChangedDirs(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{name: "none", paths: nil, want: []string{}},
+		{
+			name:  "same directory",
+			paths: []string{"/ssd/tv/Bluey/S01E01.mkv", "/ssd/tv/Bluey/S01E02.mkv"},
+			want:  []string{"/ssd/tv/Bluey"},
+		},
+		{
+			name:  "nested",
+			paths: []string{"/ssd/tv/Bluey/Season 1/S01E01.mkv", "/ssd/tv/Bluey", "/ssd/tv/Bluey 2/S01E01.mkv", "/ssd/movies/Heat/Heat.mkv"},
+			want:  []string{"/ssd/movies/Heat", "/ssd/tv"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			paths := make([]string, 0, len(tt.paths))
+			for _, p := range tt.paths {
+				paths = append(paths, filepath.FromSlash(p))
+			}
+			want := make([]string, 0, len(tt.want))
+			for _, p := range tt.want {
+				want = append(want, filepath.FromSlash(p))
+			}
+
+			if got := fs.ChangedDirs(paths); !slices.Equal(got, want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+// fakeRefresher records the directories it is asked to rescan and fails the first failures times
+type fakeRefresher struct {
+	mu        sync.Mutex
+	failures  int
+	attempts  int
+	refreshed [][]string
+	done      chan struct{}
+}
+
+func (r *fakeRefresher) Name() string { return "fake" }
+
+func (r *fakeRefresher) Refresh(ctx context.Context, dirs []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.attempts++
+	if r.attempts <= r.failures {
+		return errors.New("library scan already running")
+	}
+
+	r.refreshed = append(r.refreshed, dirs)
+	close(r.done)
+	return nil
+}
+
+func TestLibraryRefresh(t *testing.T) {
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/media", Local: "/mnt/ssd"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		failures int
+		retries  int
+		attempts int
+		want     []string
+	}{
+		{name: "merged", failures: 0, retries: 0, attempts: 1, want: []string{"/media/movies/Heat", "/media/tv/Bluey"}},
+		{name: "retried", failures: 2, retries: 2, attempts: 3, want: []string{"/media/movies/Heat", "/media/tv/Bluey"}},
+		{name: "given up", failures: 2, retries: 1, attempts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &fakeRefresher{failures: tt.failures, done: make(chan struct{})}
+			refresh := &mediaserver.LibraryRefresh{
+				Servers: []mediaserver.Refresher{server},
+				PathMap: pathMap,
+				Delay:   10 * time.Millisecond,
+				Retries: tt.retries,
+			}
+
+			changed, exit := make(chan []string), make(chan struct{})
+			stopped := make(chan struct{})
+			go func() {
+				refresh.Run(changed, exit)
+				close(stopped)
+			}()
+
+			// Back to back batches are merged into a single refresh, unmapped directories are left out
+			changed <- []string{filepath.FromSlash("/mnt/ssd/tv/Bluey")}
+			changed <- []string{filepath.FromSlash("/mnt/ssd/movies/Heat"), filepath.FromSlash("/mnt/ssd/tv/Bluey"), filepath.FromSlash("/mnt/hdd/tv")}
+
+			select {
+			case <-server.done:
+			case <-time.After(time.Second):
+			}
+			close(exit)
+			<-stopped
+
+			server.mu.Lock()
+			defer server.mu.Unlock()
+			if server.attempts != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, server.attempts)
+			}
+
+			if tt.want == nil {
+				if len(server.refreshed) != 0 {
+					t.Errorf("expected no refresh, got %v", server.refreshed)
+				}
+				return
+			}
+
+			if len(server.refreshed) != 1 || !slices.Equal(server.refreshed[0], tt.want) {
+				t.Errorf("expected a single refresh of %v, got %v", tt.want, server.refreshed)
+			}
+		})
+	}
+}
+
+func TestMediaServerRefresh(t *testing.T) {
+	var mu sync.Mutex
+	requests := make([]string, 0)
+	var updates struct {
+		Updates []struct {
+			Path       string `json:"Path"`
+			UpdateType string `json:"UpdateType"`
+		} `json:"Updates"`
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.URL.Query().Get("path"))
+
+		switch r.URL.Path {
+		case "/Library/Media/Updated":
+			if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case "/library/sections":
+			body, err := os.ReadFile(filepath.Join("testdata", "plex", "sections.json"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(body)
+		case "/library/sections/1/refresh", "/library/sections/2/refresh":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	if err := jellyfin.New(server.URL, "0123456789abcdef", nil).Refresh(ctx, []string{"/media/tv/Bluey"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(updates.Updates) != 1 || updates.Updates[0].Path != "/media/tv/Bluey" || updates.Updates[0].UpdateType != "Modified" {
+		t.Errorf("expected a Modified update of /media/tv/Bluey, got %+v", updates)
+	}
+
+	if err := plex.New(server.URL, plexToken).Refresh(ctx, []string{"/data/tv/Bluey", "/data/movies"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory outside every library section is skipped, the others are still refreshed
+	if err := plex.New(server.URL, plexToken).Refresh(ctx, []string{"/data/tvshows/Bluey", "/data/tv/Bluey"}); err != nil {
+		t.Errorf("expected a directory outside every library section skipped, got %v", err)
+	}
+
+	want := []string{
+		"POST /Library/Media/Updated ",
+		"GET /library/sections ",
+		"GET /library/sections/2/refresh /data/tv/Bluey",
+		"GET /library/sections/1/refresh /data/movies",
+		"GET /library/sections ",
+		"GET /library/sections/2/refresh /data/tv/Bluey",
+	}
+	if !slices.Equal(requests, want) {
+		t.Errorf("expected requests %v, got %v", want, requests)
+	}
+}
@@ -0,0 +1,152 @@
+package testing
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/fs"
+)
+
+func TestSyncRenames(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("renames are confirmed by inode, unavailable on windows")
+	}
+
+	now := time.Now()
+	rename := func(t *testing.T, srcDir, from, to string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(srcDir, to)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(srcDir, from), filepath.Join(srcDir, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		move      func(t *testing.T, srcDir string) (renamed, created []string) // relative to the source
+		want      []string                                                      // relative paths on the target afterwards
+		unmatched []string
+	}{
+		{
+			name: "directory",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				rename(t, srcDir, filepath.Join("tv", "Blue"), filepath.Join("tv", "Bluey"))
+				// The watch on the directory reports its rename along with the one on its parent
+				return []string{filepath.Join("tv", "Blue"), filepath.Join("tv", "Blue")}, []string{filepath.Join("tv", "Bluey")}
+			},
+			want:      []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Bluey", "S01E01.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv")},
+			unmatched: []string{},
+		},
+		{
+			name: "file into a new directory",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				rename(t, srcDir, filepath.Join("movies", "Heat.mkv"), filepath.Join("movies", "Heat (1995)", "Heat.mkv"))
+				return []string{filepath.Join("movies", "Heat.mkv")}, []string{filepath.Join("movies", "Heat (1995)"), filepath.Join("movies", "Heat (1995)", "Heat.mkv")}
+			},
+			want:      []string{filepath.Join("movies", "Heat (1995)", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")},
+			unmatched: []string{},
+		},
+		{
+			name: "modified after the rename",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				rename(t, srcDir, filepath.Join("movies", "Heat.mkv"), filepath.Join("movies", "Heat2.mkv"))
+				writeFile(t, filepath.Join(srcDir, "movies", "Heat2.mkv"), 100, now)
+				return []string{filepath.Join("movies", "Heat.mkv")}, []string{filepath.Join("movies", "Heat2.mkv")}
+			},
+			want:      []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")},
+			unmatched: []string{filepath.Join("movies", "Heat.mkv")},
+		},
+		{
+			name: "replaced by another file",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				// Same size and mtime, only the inode differs
+				writeFile(t, filepath.Join(srcDir, "movies", "Heat2.mkv"), 100, now.Add(-time.Hour))
+				if err := os.Remove(filepath.Join(srcDir, "movies", "Heat.mkv")); err != nil {
+					t.Fatal(err)
+				}
+				return []string{filepath.Join("movies", "Heat.mkv")}, []string{filepath.Join("movies", "Heat2.mkv")}
+			},
+			want:      []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")},
+			unmatched: []string{filepath.Join("movies", "Heat.mkv")},
+		},
+		{
+			name: "moved out of the source",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				if err := os.Rename(filepath.Join(srcDir, "tv", "Blue"), filepath.Join(t.TempDir(), "Blue")); err != nil {
+					t.Fatal(err)
+				}
+				return []string{filepath.Join("tv", "Blue")}, []string{}
+			},
+			want:      []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")},
+			unmatched: []string{filepath.Join("tv", "Blue")},
+		},
+		{
+			name: "not on the target",
+			move: func(t *testing.T, srcDir string) ([]string, []string) {
+				rename(t, srcDir, filepath.Join("movies", "Up.mkv"), filepath.Join("movies", "Up (2009).mkv"))
+				return []string{filepath.Join("movies", "Up.mkv")}, []string{filepath.Join("movies", "Up (2009).mkv")}
+			},
+			want:      []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")},
+			unmatched: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srcDir, tgtDir := t.TempDir(), t.TempDir()
+			for _, rel := range []string{filepath.Join("movies", "Heat.mkv"), filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")} {
+				for _, dir := range []string{srcDir, tgtDir} {
+					writeFile(t, filepath.Join(dir, rel), 100, now.Add(-time.Hour))
+				}
+			}
+			writeFile(t, filepath.Join(srcDir, "movies", "Up.mkv"), 100, now.Add(-time.Hour))
+
+			srcTree, err := fs.BuildTree(srcDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := srcTree.Snapshot()
+
+			renamed, created := tt.move(t, srcDir)
+			abs := func(paths []string) []string {
+				result := make([]string, 0, len(paths))
+				for _, p := range paths {
+					result = append(result, filepath.Join(srcDir, p))
+				}
+				return result
+			}
+
+			srcTree, err = fs.BuildTree(srcDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tgtTree, err := fs.BuildTree(tgtDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, unmatched := fs.SyncRenames(abs(renamed), abs(created), before, srcTree, tgtTree)
+			if want := abs(tt.unmatched); !slices.Equal(unmatched, want) {
+				t.Errorf("expected %v unmatched, got %v", want, unmatched)
+			}
+
+			got := make([]string, 0)
+			filepath.WalkDir(tgtDir, func(path string, d os.DirEntry, err error) error {
+				if err == nil && !d.IsDir() {
+					rel, _ := filepath.Rel(tgtDir, path)
+					got = append(got, rel)
+				}
+				return err
+			})
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %v on the target, got %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+package testing
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+)
+
+func TestScorer(t *testing.T) {
+	srcDir := t.TempDir()
+	day := 24 * time.Hour
+	now := time.Now()
+	writeFile(t, filepath.Join(srcDir, "movies", "Heat.mkv"), 1<<20, now.Add(-14*day))
+
+	srcTree, err := fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := srcTree.Index[filepath.Join(srcDir, "movies", "Heat.mkv")]
+	n.Pinned = true
+	n.Watch = fs.WatchState{Rank: 200, Favorite: true, PlayCount: 3, LastPlayed: now.Add(-7 * day)}
+
+	scorer := &fs.Scorer{
+		Weights: config.ScoreWeights{Recency: 100, Pinned: 1000, Favorite: 50, WatchCount: 10, Size: -1024, Age: -0.5, Rank: 100},
+		Now:     now,
+	}
+	score := scorer.Score(n)
+
+	want := map[string]float64{
+		"recency":     50, // watched a half-life ago
+		"pinned":      1000,
+		"favorite":    50,
+		"watch_count": 30,
+		"size":        -1, // 1 MiB
+		"age":         -7, // 14 days
+		"rank":        200,
+	}
+
+	if len(score.Factors) != len(want) {
+		t.Fatalf("expected %d factors, got %v", len(want), score.Factors)
+	}
+
+	var total float64
+	for _, f := range score.Factors {
+		if math.Abs(f.Contribution()-want[f.Name]) > 0.01 {
+			t.Errorf("expected %s to contribute %.2f, got %.2f", f.Name, want[f.Name], f.Contribution())
+		}
+		total += want[f.Name]
+	}
+
+	if math.Abs(score.Total()-total) > 0.01 {
+		t.Errorf("expected a score of %.2f, got %.2f", total, score.Total())
+	}
+
+	scorer.Prioritize(srcTree)
+	if n.Priority != int(math.Round(total)) {
+		t.Errorf("expected priority %d, got %d", int(math.Round(total)), n.Priority)
+	}
+
+	// Never played, recency comes from the target copy and not the source filo just read
+	tgtDir := t.TempDir()
+	writeFile(t, filepath.Join(srcDir, "movies", "Up.mkv"), 1<<20, now)
+	writeFile(t, filepath.Join(tgtDir, "movies", "Up.mkv"), 1<<20, now.Add(-7*day))
+
+	srcTree, err = fs.BuildTree(srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := srcTree.Index[filepath.Join(srcDir, "movies", "Up.mkv")]
+	recency := func() float64 {
+		return scorer.Score(up).Factors[0].Contribution()
+	}
+
+	if got := recency(); got != 0 {
+		t.Errorf("expected no recency without a target copy, got %.2f", got)
+	}
+
+	scorer.Target = tgtDir
+	if got := recency(); math.Abs(got-50) > 0.01 {
+		t.Errorf("expected recency 50 from the target copy accessed a half-life ago, got %.2f", got)
+	}
+}
+
+// favorites marks the files at its paths, relative to the source root, as media server favorites
+type favorites []string
+
+func (f favorites) Prioritize(src *fs.FileTree) error {
+	for _, relPath := range f {
+		src.Index[filepath.Join(src.Root.Path, relPath)].Watch.Favorite = true
+	}
+	return nil
+}
+
+func TestExplain(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	day := 24 * time.Hour
+	now := time.Now()
+
+	for _, dir := range []string{srcDir, tgtDir} {
+		writeFile(t, filepath.Join(dir, "movies", "Up.mkv"), 200, now.Add(-30*day))
+		writeFile(t, filepath.Join(dir, "movies", "Heat.mkv"), 200, now.Add(-10*day))
+	}
+	writeFile(t, filepath.Join(srcDir, "movies", "Arrival.mkv"), 200, now.Add(-1*day))
+
+	// Up is the oldest, but as a favorite it outscores Heat, which has to go to fit Arrival under 500
+	cfg := &config.Config{
+		MaxFill:        0.5,
+		EvictionPolicy: "score",
+		Score:          config.ScoreWeights{Favorite: 100, Age: -1},
+	}
+
+	tests := []struct {
+		path     string
+		action   string
+		position int
+	}{
+		{path: filepath.Join("movies", "Heat.mkv"), action: "evict", position: 1},
+		{path: filepath.Join("movies", "Up.mkv"), action: "keep", position: 2},
+		{path: filepath.Join("movies", "Arrival.mkv"), action: "copy", position: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			evictor := fakeUsageEvictor(t, cfg, 1000, 400)
+			evictor.Prioritizer = favorites{filepath.Join("movies", "Up.mkv")}
+
+			srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+			evictor.Prioritize(srcTree)
+
+			ex, err := evictor.Explain(srcTree, tgtTree, tt.path, make(chan struct{}, 1))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ex.Action != tt.action || ex.Position != tt.position || ex.Candidates != 2 || ex.Policy != "score" {
+				t.Errorf("expected %s at eviction position %d of 2, got %+v", tt.action, tt.position, ex)
+			}
+		})
+	}
+
+	// The filo policy evicts the oldest file, favorite or not
+	evictor := fakeUsageEvictor(t, &config.Config{MaxFill: 0.5, Score: cfg.Score}, 1000, 400)
+	evictor.Prioritizer = favorites{filepath.Join("movies", "Up.mkv")}
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+	evictor.Prioritize(srcTree)
+
+	ex, err := evictor.Explain(srcTree, tgtTree, filepath.Join("movies", "Up.mkv"), make(chan struct{}, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ex.Action != "evict" || ex.Score.Total() <= 0 {
+		t.Errorf("expected Up.mkv evicted by the filo policy despite a positive score, got %+v", ex)
+	}
+
+	if _, err := evictor.Explain(srcTree, tgtTree, filepath.Join("movies", "Alien.mkv"), make(chan struct{}, 1)); err == nil {
+		t.Error("expected a path missing from the source to fail")
+	}
+}
@@ -0,0 +1,7 @@
+-- Subset of the Jellyfin jellyfin.db schema filo reads, build with: sqlite3 jellyfin.db < jellyfin.sql
+CREATE TABLE Users (Id TEXT NOT NULL PRIMARY KEY, Username TEXT NOT NULL, InternalId INTEGER NOT NULL, Password TEXT NULL);
+
+INSERT INTO Users (Id, Username, InternalId) VALUES
+	('5B2F9D0C-8E7A-4C1F-8A3B-6D9E0F1C2A3B', 'bebop831', 1),
+	('9E1D4C7B-2A5F-4E8D-9C0B-3A6F7E8D1C2B', 'guest', 2),
+	('0C8B7A6F-5E4D-4C3B-2A1F-0E9D8C7B6A59', 'kids', 3);
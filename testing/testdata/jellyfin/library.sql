@@ -0,0 +1,24 @@
+-- Subset of the Jellyfin library.db schema filo reads, build with: sqlite3 library.db < library.sql
+-- Ids match the recorded API responses, guids are stored as .NET writes them.
+CREATE TABLE TypedBaseItems (guid GUID PRIMARY KEY NOT NULL, type TEXT NOT NULL, data BLOB NULL, ParentId GUID NULL, Path TEXT NULL, Name TEXT, UserDataKey TEXT);
+CREATE TABLE UserDatas (key nvarchar NOT NULL, userId INT NOT NULL, rating float NULL, played bit NOT NULL, playCount int NOT NULL, isFavorite bit NOT NULL, playbackPositionTicks bigint NOT NULL, lastPlayedDate datetime NULL, AudioStreamIndex INT, SubtitleStreamIndex INT);
+
+INSERT INTO TypedBaseItems (guid, type, Path, Name, UserDataKey) VALUES
+	(X'7E5C3A1F2D9B604F81A3C5E7F9B1D3E5', 'MediaBrowser.Controller.Entities.Movies.Movie', '/media/movies/Heat (1995)/Heat (1995).mkv', 'Heat', 'tt0113277'),
+	(X'8F6E4C2A1D0B3A4F5C7E9B0D2F4A6C8E', 'MediaBrowser.Controller.Entities.Movies.Movie', '/media/movies/Alien (1979)/Alien (1979).mkv', 'Alien', 'tt0078748'),
+	(X'9A7F5D3B3E1C5B4A7D9F1A3C5E7B9D1F', 'MediaBrowser.Controller.Entities.Movies.Movie', '/media/movies/Up (2009)/Up (2009).mkv', 'Up', 'tt1049413'),
+	(X'0B8A6E4C4F2D6C4B8E0A2C4E6A8C0E2A', 'MediaBrowser.Controller.Entities.TV.Episode', '/media/tv/Bluey/Season 01/Bluey - S01E01 - The Weekend.mkv', 'The Weekend', '3534770001001'),
+	(X'1C9B7F5D5A3E7D4C9F1B3D5F7B9D1F3B', 'MediaBrowser.Controller.Entities.TV.Episode', '/media/tv/Bluey/Season 01/Bluey - S01E02 - Hospital.mkv', 'Hospital', '3534770001002'),
+	(X'2D0C8A6E6B4F8E4D0A2C4E6A8C0E2A4C', 'MediaBrowser.Controller.Entities.TV.Series', '/media/tv/Severance', 'Severance', '371980'),
+	(X'3E1D9B7F7C5A9F4E1B3D5F7B9D1F3B5D', 'MediaBrowser.Controller.Entities.CollectionFolder', NULL, 'Movies', 'movies');
+
+-- userId is the InternalId of jellyfin.db Users: 1 bebop831, 2 guest, 3 kids
+INSERT INTO UserDatas (key, userId, played, playCount, isFavorite, playbackPositionTicks, lastPlayedDate) VALUES
+	('tt0113277', 1, 1, 2, 0, 0, '2025-05-20 21:14:03.1234567Z'),
+	('tt0113277', 2, 1, 1, 0, 0, '2025-05-10 19:00:00Z'),
+	('tt0078748', 1, 1, 1, 0, 0, '2025-04-02 22:45:10Z'),
+	('tt0078748', 3, 0, 0, 0, 0, NULL),
+	('tt1049413', 2, 0, 0, 1, 0, NULL),
+	('3534770001002', 1, 0, 0, 0, 1800000000, '2025-06-01 18:30:00Z'),
+	('371980', 2, 0, 0, 1, 0, NULL),
+	('movies', 1, 1, 0, 0, 0, NULL);
@@ -0,0 +1,11 @@
+-- Schema of the Playback Reporting plugin database, build with: sqlite3 playback_reporting.db < playback_reporting.sql
+CREATE TABLE PlaybackActivity (DateCreated DATETIME NOT NULL, UserId TEXT, ItemId TEXT, ItemType TEXT, ItemName TEXT, PlaybackMethod TEXT, ClientName TEXT, DeviceName TEXT, PlayDuration INT);
+
+INSERT INTO PlaybackActivity VALUES
+	('2025-05-01 20:00:00.0000000', '5b2f9d0c8e7a4c1f8a3b6d9e0f1c2a3b', '1f3a5c7e9b2d4f6081a3c5e7f9b1d3e5', 'Movie', 'Heat', 'DirectPlay', 'Jellyfin Web', 'Firefox', 6120),
+	('2025-05-12 20:00:00.0000000', '5b2f9d0c8e7a4c1f8a3b6d9e0f1c2a3b', '1f3a5c7e9b2d4f6081a3c5e7f9b1d3e5', 'Movie', 'Heat', 'DirectPlay', 'Jellyfin Web', 'Firefox', 3010),
+	('2025-05-19 21:00:00.0000000', '5b2f9d0c8e7a4c1f8a3b6d9e0f1c2a3b', '1f3a5c7e9b2d4f6081a3c5e7f9b1d3e5', 'Movie', 'Heat', 'DirectPlay', 'Jellyfin Web', 'Firefox', 5400),
+	('2025-06-03 07:45:12.5000000', '5b2f9d0c8e7a4c1f8a3b6d9e0f1c2a3b', '4c6e8a0b2d4f4b6c8e0a2c4e6a8c0e2a', 'Episode', 'The Weekend', 'DirectPlay', 'Android TV', 'Shield', 420),
+	('2025-06-04 07:45:12.5000000', '5b2f9d0c8e7a4c1f8a3b6d9e0f1c2a3b', '4c6e8a0b2d4f4b6c8e0a2c4e6a8c0e2a', 'Episode', 'The Weekend', 'DirectPlay', 'Android TV', 'Shield', 420),
+	('2025-06-02 08:00:00.0000000', '0c8b7a6f5e4d4c3b2a1f0e9d8c7b6a59', '4c6e8a0b2d4f4b6c8e0a2c4e6a8c0e2a', 'Episode', 'The Weekend', 'DirectPlay', 'Android TV', 'Shield', 420),
+	('2025-06-02 09:00:00.0000000', '9e1d4c7b2a5f4e8d9c0b3a6f7e8d1c2b', 'ffffffffffffffffffffffffffffffff', 'Episode', 'Deleted', 'Transcode', 'Jellyfin Web', 'Chrome', 1200);
@@ -0,0 +1,39 @@
+-- Subset of the Plex com.plexapp.plugins.library.db schema filo reads, build with:
+-- sqlite3 com.plexapp.plugins.library.db < library.sql
+CREATE TABLE accounts (id INTEGER PRIMARY KEY, name varchar(255), hashed_password varchar(255), salt varchar(255), created_at datetime, updated_at datetime);
+CREATE TABLE metadata_items (id INTEGER PRIMARY KEY, library_section_id integer, parent_id integer, metadata_type integer, guid varchar(255), title varchar(255), "index" integer);
+CREATE TABLE media_items (id INTEGER PRIMARY KEY, library_section_id integer, metadata_item_id integer, size integer, duration integer);
+CREATE TABLE media_parts (id INTEGER PRIMARY KEY, media_item_id integer, directory_id integer, file varchar(255), size integer, duration integer);
+CREATE TABLE metadata_item_settings (id INTEGER PRIMARY KEY, account_id integer, guid varchar(255), rating float, view_offset integer, view_count integer, last_viewed_at datetime, created_at datetime, updated_at datetime);
+
+INSERT INTO accounts (id, name) VALUES (1, 'bebop831'), (2, 'guest');
+
+-- metadata_type 1 is a movie, 2 a show, 3 a season and 4 an episode
+INSERT INTO metadata_items (id, library_section_id, parent_id, metadata_type, guid, title, "index") VALUES
+	(101, 1, NULL, 1, 'plex://movie/5d7768265af944001f1f6e7c', 'Heat', NULL),
+	(102, 1, NULL, 1, 'plex://movie/5d776825880197001ec90f37', 'Up', NULL),
+	(103, 1, NULL, 1, 'plex://movie/5d7768244de0ee001fcc7fed', 'Alien', NULL),
+	(200, 2, NULL, 2, 'plex://show/5d9c08e4e9d5a1001f4bc31e', 'Bluey', NULL),
+	(201, 2, 200, 3, 'plex://season/602e6a5d88ce88002c2d3a59', 'Season 1', 1),
+	(202, 2, 201, 4, 'plex://episode/5d9c13c07ee0c6001f24fa39', 'The Weekend', 1),
+	(203, 2, 201, 4, 'plex://episode/5d9c13c07ee0c6001f24fa3b', 'Hospital', 2);
+
+INSERT INTO media_items (id, library_section_id, metadata_item_id) VALUES (1, 1, 101), (2, 1, 102), (3, 1, 103), (4, 2, 202), (5, 2, 203), (6, 1, 101);
+
+-- Heat has two versions
+INSERT INTO media_parts (id, media_item_id, file) VALUES
+	(1, 1, '/data/movies/Heat (1995)/Heat (1995).mkv'),
+	(2, 2, '/data/movies/Up (2009)/Up (2009).mkv'),
+	(3, 3, '/data/movies/Alien (1979)/Alien (1979).mkv'),
+	(4, 4, '/data/tv/Bluey/Season 01/Bluey - S01E01 - The Weekend.mkv'),
+	(5, 5, '/data/tv/Bluey/Season 01/Bluey - S01E02 - Hospital.mkv'),
+	(6, 6, '/data/movies/Heat (1995)/Heat (1995) - 4K.mkv');
+
+-- last_viewed_at is in unix seconds
+INSERT INTO metadata_item_settings (account_id, guid, view_offset, view_count, last_viewed_at) VALUES
+	(1, 'plex://movie/5d7768265af944001f1f6e7c', 0, 2, 1747775643),
+	(2, 'plex://movie/5d7768265af944001f1f6e7c', 0, 1, 1746903600),
+	(1, 'plex://movie/5d776825880197001ec90f37', 0, 0, NULL),
+	(2, 'plex://movie/5d7768244de0ee001fcc7fed', 0, 1, 1743633910),
+	(1, 'plex://episode/5d9c13c07ee0c6001f24fa3b', 180000, 0, 1748802600),
+	(1, 'plex://show/5d9c08e4e9d5a1001f4bc31e', 0, 3, 1748802600);
@@ -0,0 +1,309 @@
+package testing
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Returns every node of ft as "path pinned size" relative to the root, in walk order, failing when the
+// children of a node are out of order or Index and the nodes disagree
+func treeShape(t *testing.T, ft *fs.FileTree) []string {
+	t.Helper()
+
+	shape := make([]string, 0)
+	seen := 0
+	var walk func(n *fs.FileNode)
+	walk = func(n *fs.FileNode) {
+		if !slices.IsSortedFunc(n.Children, func(a, b *fs.FileNode) int { return strings.Compare(a.Entry.Name(), b.Entry.Name()) }) {
+			t.Errorf("children of %s out of order", n.Path)
+		}
+
+		for _, c := range n.Children {
+			if c.Parent != n || ft.Index[c.Path] != c {
+				t.Errorf("%s not indexed below %s", c.Path, n.Path)
+			}
+			seen++
+			shape = append(shape, fmt.Sprintf("%s %v %d", ft.RelBaseFile(c.Path), c.Pinned, c.Size()))
+			walk(c)
+		}
+	}
+	walk(ft.Root)
+
+	if seen != len(ft.Index) {
+		t.Errorf("expected %d indexed nodes, got %d", seen, len(ft.Index))
+	}
+	return shape
+}
+
+func TestTreeMutations(t *testing.T) {
+	root := t.TempDir()
+	now := time.Now()
+	opts := fs.TreeOptions{Pinned: []string{"kids/*"}}
+
+	writeFile(t, filepath.Join(root, "movies", "Heat.mkv"), 100, now)
+	writeFile(t, filepath.Join(root, "tv", "Blue", "S01E01.mkv"), 100, now)
+	writeFile(t, filepath.Join(root, "tv", "Blue", "S01E02.mkv"), 100, now)
+	writeFile(t, filepath.Join(root, "kids", "Up.mkv"), 100, now)
+
+	tree, err := fs.BuildTree(root, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T) // changes the disk and patches tree along
+	}{
+		{
+			name: "insert below missing directories",
+			change: func(t *testing.T) {
+				writeFile(t, filepath.Join(root, "tv", "Bluey", "Season 01", "S01E01.mkv"), 200, now)
+				writeFile(t, filepath.Join(root, "tv", "Bluey", "Season 01", "S01E02.mkv"), 200, now)
+				if n, err := tree.InsertNode(filepath.Join(root, "tv", "Bluey", "Season 01", "S01E01.mkv")); err != nil || n == nil {
+					t.Fatalf("expected the episode inserted, got %v %v", n, err)
+				}
+			},
+		},
+		{
+			name: "hidden files are skipped",
+			change: func(t *testing.T) {
+				writeFile(t, filepath.Join(root, "movies", ".Heat.mkv.part"), 50, now)
+				if n, err := tree.InsertNode(filepath.Join(root, "movies", ".Heat.mkv.part")); err != nil || n != nil {
+					t.Fatalf("expected nothing inserted, got %v %v", n, err)
+				}
+			},
+		},
+		{
+			name: "insert replaces a rewritten file",
+			change: func(t *testing.T) {
+				writeFile(t, filepath.Join(root, "movies", "Heat.mkv"), 300, now)
+				if _, err := tree.InsertNode(filepath.Join(root, "movies", "Heat.mkv")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "remove a directory",
+			change: func(t *testing.T) {
+				if err := os.RemoveAll(filepath.Join(root, "tv", "Blue")); err != nil {
+					t.Fatal(err)
+				}
+				if n := tree.RemoveNode(filepath.Join(root, "tv", "Blue")); n == nil {
+					t.Fatal("expected tv/Blue removed")
+				}
+			},
+		},
+		{
+			name: "move a directory under a pinned glob",
+			change: func(t *testing.T) {
+				from, to := filepath.Join(root, "tv", "Bluey"), filepath.Join(root, "kids", "Bluey")
+				tree.Index[filepath.Join(from, "Season 01", "S01E01.mkv")].Priority = 7
+				if err := os.Rename(from, to); err != nil {
+					t.Fatal(err)
+				}
+
+				if _, err := tree.MoveNode(from, to); err != nil {
+					t.Fatal(err)
+				}
+				if got := tree.Index[filepath.Join(to, "Season 01", "S01E01.mkv")].Priority; got != 7 {
+					t.Errorf("expected the priority kept, got %d", got)
+				}
+			},
+		},
+		{
+			name: "insert a path gone from disk removes it",
+			change: func(t *testing.T) {
+				if err := os.Remove(filepath.Join(root, "kids", "Up.mkv")); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tree.InsertNode(filepath.Join(root, "kids", "Up.mkv")); !os.IsNotExist(err) {
+					t.Fatalf("expected not exist, got %v", err)
+				}
+			},
+		},
+	}
+
+	// Each change is applied on top of the ones before it, the patched tree must match a fresh walk
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+
+			fresh, err := fs.BuildTree(root, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := treeShape(t, tree), treeShape(t, fresh); !slices.Equal(got, want) {
+				t.Errorf("expected\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+			}
+		})
+	}
+
+	if _, err := tree.InsertNode(filepath.Join(filepath.Dir(root), "elsewhere")); err == nil {
+		t.Error("expected an error for a path outside the root")
+	}
+}
+
+func TestSyncChangesPatchesTrees(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("renames are confirmed by inode, unavailable on windows")
+	}
+
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	for _, rel := range []string{filepath.Join("tv", "Blue", "S01E01.mkv"), filepath.Join("tv", "Blue", "S01E02.mkv")} {
+		for _, dir := range []string{srcDir, tgtDir} {
+			writeFile(t, filepath.Join(dir, rel), 100, now.Add(-time.Hour))
+		}
+	}
+
+	cfg := &config.Config{SourceDir: srcDir, TargetDir: tgtDir, MaxFill: 1, SyncDelay: 10 * time.Millisecond}
+	evictor := fakeUsageEvictor(t, cfg, 10000, 200)
+
+	// Walked up front like main does, SyncChanges patches them from there
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+
+	eventChan, changed, exit := make(chan fsnotify.Event), make(chan []string), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		fs.SyncChanges(srcTree, tgtTree, eventChan, nil, changed, exit, make(chan struct{}, 1), evictor, cfg)
+		close(stopped)
+	}()
+	defer func() {
+		close(exit)
+		<-stopped
+	}()
+
+	// Sends events as the watcher would and returns the target directories the sync changed
+	sync := func(t *testing.T, events ...fsnotify.Event) []string {
+		t.Helper()
+		for _, e := range events {
+			eventChan <- e
+		}
+
+		select {
+		case dirs := <-changed:
+			return dirs
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a sync")
+			return nil
+		}
+	}
+
+	assertTarget := func(t *testing.T, want ...string) {
+		t.Helper()
+		got := make([]string, 0)
+		filepath.WalkDir(tgtDir, func(path string, d os.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				rel, _ := filepath.Rel(tgtDir, path)
+				got = append(got, rel)
+			}
+			return err
+		})
+		if !slices.Equal(got, want) {
+			t.Errorf("expected %v on the target, got %v", want, got)
+		}
+	}
+
+	// A renamed series is renamed on the target
+	if err := os.Rename(filepath.Join(srcDir, "tv", "Blue"), filepath.Join(srcDir, "tv", "Bluey")); err != nil {
+		t.Fatal(err)
+	}
+	sync(t, fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Blue"), Op: fsnotify.Rename},
+		fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Bluey"), Op: fsnotify.Create})
+	assertTarget(t, filepath.Join("tv", "Bluey", "S01E01.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv"))
+
+	// The patched trees know the new path, a new episode next to it is copied and nothing else
+	writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S01E03.mkv"), 100, now)
+	sync(t, fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Bluey", "S01E03.mkv"), Op: fsnotify.Create})
+	assertTarget(t, filepath.Join("tv", "Bluey", "S01E01.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv"), filepath.Join("tv", "Bluey", "S01E03.mkv"))
+
+	// Renaming it again is paired against the identities taken at the last sync
+	if err := os.Rename(filepath.Join(srcDir, "tv", "Bluey", "S01E03.mkv"), filepath.Join(srcDir, "tv", "Bluey", "S01E03 - Hospital.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	sync(t, fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Bluey", "S01E03.mkv"), Op: fsnotify.Rename},
+		fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Bluey", "S01E03 - Hospital.mkv"), Op: fsnotify.Create})
+	assertTarget(t, filepath.Join("tv", "Bluey", "S01E01.mkv"), filepath.Join("tv", "Bluey", "S01E02.mkv"), filepath.Join("tv", "Bluey", "S01E03 - Hospital.mkv"))
+
+	// Removed from the source, removed from the target
+	if err := os.Remove(filepath.Join(srcDir, "tv", "Bluey", "S01E01.mkv")); err != nil {
+		t.Fatal(err)
+	}
+	sync(t, fsnotify.Event{Name: filepath.Join(srcDir, "tv", "Bluey", "S01E01.mkv"), Op: fsnotify.Remove})
+	assertTarget(t, filepath.Join("tv", "Bluey", "S01E02.mkv"), filepath.Join("tv", "Bluey", "S01E03 - Hospital.mkv"))
+}
+
+// countingPrioritizer ranks the file at relPath, relative to the source root, and counts its runs
+type countingPrioritizer struct {
+	relPath string
+	runs    int
+}
+
+func (p *countingPrioritizer) Prioritize(src *fs.FileTree) error {
+	p.runs++
+	if n := src.Index[filepath.Join(src.Root.Path, p.relPath)]; n != nil {
+		n.Priority, n.Watch.Rank = 5, 5
+	}
+	return nil
+}
+
+func TestSyncChangesKeepsRanks(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	heat := filepath.Join(srcDir, "movies", "Heat.mkv")
+	writeFile(t, heat, 100, time.Now().Add(-time.Hour))
+
+	cfg := &config.Config{SourceDir: srcDir, TargetDir: tgtDir, MaxFill: 1, SyncDelay: 10 * time.Millisecond, RankRefresh: time.Hour}
+	evictor := fakeUsageEvictor(t, cfg, 10000, 0)
+	prioritizer := &countingPrioritizer{relPath: filepath.Join("movies", "Heat.mkv")}
+	evictor.Prioritizer = prioritizer
+
+	srcTree, tgtTree, _ := admissionQueue(t, srcDir, tgtDir)
+	evictor.Prioritize(srcTree)
+
+	eventChan, changed, exit := make(chan fsnotify.Event), make(chan []string), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		fs.SyncChanges(srcTree, tgtTree, eventChan, nil, changed, exit, make(chan struct{}, 1), evictor, cfg)
+		close(stopped)
+	}()
+	defer func() {
+		close(exit)
+		<-stopped
+	}()
+
+	// Written twice, each sync walks Heat.mkv again without reading the media servers
+	for _, size := range []int{100, 200} {
+		writeFile(t, heat, size, time.Now())
+		eventChan <- fsnotify.Event{Name: heat, Op: fsnotify.Write}
+
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected a sync")
+		}
+	}
+
+	if prioritizer.runs != 1 {
+		t.Errorf("expected the source ranked once at startup, got %d runs", prioritizer.runs)
+	}
+
+	if n := srcTree.Index[heat]; n == nil || n.Priority != 5 || n.Watch.Rank != 5 {
+		t.Errorf("expected Heat.mkv to keep its rank once walked again, got %v", n)
+	}
+
+	if info, err := os.Stat(filepath.Join(tgtDir, "movies", "Heat.mkv")); err != nil || info.Size() != 200 {
+		t.Errorf("expected the last write of Heat.mkv on the target: %v", err)
+	}
+}
@@ -0,0 +1,286 @@
+package testing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"bebop831.com/filo/internal/config"
+	"bebop831.com/filo/internal/fs"
+	"bebop831.com/filo/internal/mediaserver"
+	"bebop831.com/filo/internal/webhook"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Returns the payload recorded in testdata/webhook/name
+func webhookFixture(t *testing.T, name string) []byte {
+	t.Helper()
+
+	body, err := os.ReadFile(filepath.Join("testdata", "webhook", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestWebhookParse(t *testing.T) {
+	tests := []struct {
+		fixture string
+		parse   func([]byte) (*webhook.Event, error)
+		ignored bool
+		want    webhook.Event
+	}{
+		{
+			fixture: "jellyfin_playback_episode.json",
+			parse:   webhook.ParseJellyfin,
+			want:    webhook.Event{Source: "jellyfin", Type: "PlaybackStart", User: "bebop831", Items: []string{"5a6b7c8d9e0f11223344556677889900"}},
+		},
+		{
+			fixture: "jellyfin_playback_movie.json",
+			parse:   webhook.ParseJellyfin,
+			want:    webhook.Event{Source: "jellyfin", Type: "PlaybackStart", User: "guest", Items: []string{"a1b2c3d4e5f6a7b8c9d0e1f2a3b4c5d6"}},
+		},
+		{
+			fixture: "jellyfin_item_added.json",
+			parse:   webhook.ParseJellyfin,
+			want:    webhook.Event{Source: "jellyfin", Type: "ItemAdded", Items: []string{"e0a1b2c3d4e5f60718293a4b5c6d7e8f"}},
+		},
+		{fixture: "jellyfin_playback_stop.json", parse: webhook.ParseJellyfin, ignored: true},
+		{
+			fixture: "plex_play_episode.json",
+			parse:   webhook.ParsePlex,
+			want:    webhook.Event{Source: "plex", Type: "media.play", User: "bebop831", Items: []string{"1934"}},
+		},
+		{
+			fixture: "plex_library_new.json",
+			parse:   webhook.ParsePlex,
+			want:    webhook.Event{Source: "plex", Type: "library.new", User: "bebop831", Items: []string{"2101"}},
+		},
+		{fixture: "plex_pause.json", parse: webhook.ParsePlex, ignored: true},
+		{
+			fixture: "sonarr_download.json",
+			parse:   func(body []byte) (*webhook.Event, error) { return webhook.ParseArr("sonarr", body) },
+			want: webhook.Event{Source: "sonarr", Type: "Download", Paths: []string{
+				"/data/media/tv/Bluey/Season 3/Bluey - S03E49 - The Sign.mkv",
+			}},
+		},
+		{
+			fixture: "sonarr_download_pack.json",
+			parse:   func(body []byte) (*webhook.Event, error) { return webhook.ParseArr("sonarr", body) },
+			want: webhook.Event{Source: "sonarr", Type: "Download", Paths: []string{
+				"/data/media/tv/Bluey/Season 1/Bluey - S01E01 - Magic Xylophone.mkv",
+				"/data/media/tv/Bluey/Season 1/Bluey - S01E02 - Hospital.mkv",
+			}},
+		},
+		{
+			fixture: "sonarr_test.json",
+			parse:   func(body []byte) (*webhook.Event, error) { return webhook.ParseArr("sonarr", body) },
+			ignored: true,
+		},
+		{
+			fixture: "radarr_download.json",
+			parse:   func(body []byte) (*webhook.Event, error) { return webhook.ParseArr("radarr", body) },
+			want: webhook.Event{Source: "radarr", Type: "Download", Paths: []string{
+				"/data/media/movies/Arrival (2016)/Arrival (2016) Bluray-1080p.mkv",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			e, err := tt.parse(webhookFixture(t, tt.fixture))
+			if tt.ignored {
+				if !errors.Is(err, webhook.ErrIgnored) {
+					t.Fatalf("expected the event to be ignored, got %+v (%v)", e, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if e.Source != tt.want.Source || e.Type != tt.want.Type || e.User != tt.want.User ||
+				!slices.Equal(e.Items, tt.want.Items) || !slices.Equal(e.Paths, tt.want.Paths) {
+				t.Errorf("expected %+v, got %+v", tt.want, *e)
+			}
+		})
+	}
+
+	if _, err := webhook.ParseJellyfin([]byte("not json")); err == nil || errors.Is(err, webhook.ErrIgnored) {
+		t.Errorf("expected an invalid payload to fail, got %v", err)
+	}
+}
+
+// fakeResolver returns the paths recorded for each item id
+type fakeResolver map[string][]string
+
+func (r fakeResolver) ItemPaths(ctx context.Context, id string) ([]string, error) {
+	paths, ok := r[id]
+	if !ok {
+		return nil, fmt.Errorf("no item %s", id)
+	}
+	return paths, nil
+}
+
+func TestWebhookHandler(t *testing.T) {
+	pathMap, err := mediaserver.NewPathMap([]config.PathMapping{{Server: "/data/media", Local: "/mnt/pool"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	syncNow := make(chan []string, 1)
+	server := httptest.NewServer(&webhook.Handler{
+		Token: "s3cret",
+		Resolvers: map[string]webhook.Resolver{
+			"jellyfin": fakeResolver{"5a6b7c8d9e0f11223344556677889900": {"/data/media/tv/Bluey"}},
+			"plex":     fakeResolver{"1934": {"/data/media/tv/Bluey"}},
+		},
+		PathMap: pathMap,
+		Sync:    syncNow,
+	})
+	defer server.Close()
+
+	plexForm := func(fixture string) (string, []byte) {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		if err := form.WriteField("payload", string(webhookFixture(t, fixture))); err != nil {
+			t.Fatal(err)
+		}
+		form.Close()
+		return form.FormDataContentType(), body.Bytes()
+	}
+
+	plexType, plexBody := plexForm("plex_play_episode.json")
+	tests := []struct {
+		name        string
+		endpoint    string
+		contentType string
+		body        []byte
+		status      int
+		synced      []string
+	}{
+		{
+			name: "jellyfin playback", endpoint: "/jellyfin?token=s3cret", body: webhookFixture(t, "jellyfin_playback_episode.json"),
+			status: http.StatusAccepted, synced: []string{"/mnt/pool/tv/Bluey"},
+		},
+		{
+			name: "sonarr import", endpoint: "/sonarr?token=s3cret", body: webhookFixture(t, "sonarr_download.json"),
+			status: http.StatusAccepted, synced: []string{"/mnt/pool/tv/Bluey/Season 3/Bluey - S03E49 - The Sign.mkv"},
+		},
+		{
+			name: "plex play", endpoint: "/plex?token=s3cret", contentType: plexType, body: plexBody,
+			status: http.StatusAccepted, synced: []string{"/mnt/pool/tv/Bluey"},
+		},
+		{name: "sonarr test", endpoint: "/sonarr?token=s3cret", body: webhookFixture(t, "sonarr_test.json"), status: http.StatusOK},
+		{name: "wrong token", endpoint: "/radarr?token=guess", body: webhookFixture(t, "radarr_download.json"), status: http.StatusUnauthorized},
+		{name: "unknown endpoint", endpoint: "/emby?token=s3cret", body: []byte("{}"), status: http.StatusNotFound},
+		{name: "unknown item", endpoint: "/jellyfin?token=s3cret", body: webhookFixture(t, "jellyfin_playback_movie.json"), status: http.StatusBadGateway},
+		{name: "invalid payload", endpoint: "/radarr?token=s3cret", body: []byte("{"), status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+
+			resp, err := http.Post(server.URL+tt.endpoint, contentType, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+
+			select {
+			case paths := <-syncNow:
+				want := make([]string, 0, len(tt.synced))
+				for _, p := range tt.synced {
+					want = append(want, filepath.FromSlash(p))
+				}
+				if !slices.Equal(paths, want) {
+					t.Errorf("expected %v to be synced, got %v", want, paths)
+				}
+			default:
+				if tt.synced != nil {
+					t.Errorf("expected %v to be synced, nothing was", tt.synced)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncNow(t *testing.T) {
+	srcDir, tgtDir := t.TempDir(), t.TempDir()
+	now := time.Now()
+	writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S03E48.mkv"), 100, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(srcDir, "movies", "Arrival.mkv"), 100, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(srcDir, "movies", "Heat.mkv"), 100, now.Add(-time.Hour))
+	writeFile(t, filepath.Join(srcDir, "movies", "Sicario.mkv"), 100, now.Add(-time.Hour))
+
+	cfg := &config.Config{SourceDir: srcDir, TargetDir: tgtDir, MaxFill: 1, SyncDelay: time.Hour, UnitDepth: []string{"tv/*"}}
+	evictor := fakeUsageEvictor(t, cfg, 1000, 0)
+
+	syncNow, changed, exit := make(chan []string), make(chan []string), make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		fs.SyncChanges(nil, nil, make(chan fsnotify.Event), syncNow, changed, exit, make(chan struct{}, 1), evictor, cfg)
+		close(stopped)
+	}()
+	defer func() {
+		close(exit)
+		<-stopped
+	}()
+
+	// Imported after the trees were walked, the webhook comes before the watcher reports it. The episode
+	// brings the rest of its unit along.
+	writeFile(t, filepath.Join(srcDir, "tv", "Bluey", "S03E49.mkv"), 100, now.Add(-time.Hour))
+	syncNow <- []string{filepath.Join(srcDir, "tv", "Bluey", "S03E49.mkv"), filepath.Join(srcDir, "movies", "Arrival.mkv"), "/elsewhere/Up.mkv"}
+
+	// Nothing takes the changed directories yet, the next sync does not wait for it
+	select {
+	case syncNow <- []string{filepath.Join(srcDir, "movies", "Sicario.mkv")}:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a sync while the changed directories were not taken")
+	}
+
+	select {
+	case dirs := <-changed:
+		if want := []string{filepath.Join(tgtDir, "movies"), filepath.Join(tgtDir, "tv", "Bluey")}; !slices.Equal(dirs, want) {
+			t.Errorf("expected the directories of both syncs merged into %v, got %v", want, dirs)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a sync")
+	}
+
+	tests := []struct {
+		path   string
+		synced bool
+	}{
+		{path: filepath.Join("tv", "Bluey", "S03E48.mkv"), synced: true},
+		{path: filepath.Join("tv", "Bluey", "S03E49.mkv"), synced: true},
+		{path: filepath.Join("movies", "Arrival.mkv"), synced: true},
+		{path: filepath.Join("movies", "Sicario.mkv"), synced: true},
+		{path: filepath.Join("movies", "Heat.mkv"), synced: false},
+	}
+
+	for _, tt := range tests {
+		if _, err := os.Stat(filepath.Join(tgtDir, tt.path)); (err == nil) != tt.synced {
+			t.Errorf("expected %s synced: %v, got %v", tt.path, tt.synced, err)
+		}
+	}
+}